@@ -0,0 +1,370 @@
+package zinc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transfers are checkpointed in the StateDir of a peer so they survive the
+// peer stopping. The sender records the file it sends and the receiver the
+// partial file, the chunks of it that are on disk and the merkle root the file
+// must have. A receiver picks up its checkpoints when it starts and waits for
+// the sender to offer the file again, then asks only for the chunks it is
+// missing. A sender resumes its transfers when it starts and when it is asked
+// to with ResumeTransfer.
+
+// checkpointEvery is the number of chunks a receiver takes in between
+// checkpoints.
+const checkpointEvery = 256
+
+// ErrNoTransfer is returned for transfers the peer knows nothing about.
+var ErrNoTransfer = errors.New("no such transfer")
+
+// checkpoint is a transfer as it is saved in the state directory.
+type checkpoint struct {
+	Id        uint64 `json:"id"`
+	Direction string `json:"direction"`
+	Name      string `json:"name"`
+	Peer      string `json:"peer"`
+	Size      uint64 `json:"size"`
+	ChunkSize uint32 `json:"chunk_size"`
+	Root      []byte `json:"root"`
+
+	// Path is the file being sent, or the partial file being recieved
+	// into Dest.
+	Path string `json:"path"`
+	Dest string `json:"dest,omitempty"`
+
+	NoMetadata bool   `json:"no_metadata,omitempty"`
+	Meta       []byte `json:"meta,omitempty"`
+
+	// Have is a bitmap of the chunks the receiver has on disk.
+	Have []byte `json:"have,omitempty"`
+}
+
+func (cp *checkpoint) file() string {
+	return fmt.Sprintf("%s-%016x.json", cp.Direction, cp.Id)
+}
+
+func (out *outgoing) checkpoint() *checkpoint {
+	return &checkpoint{
+		Id:         out.offer.id,
+		Direction:  "send",
+		Name:       out.offer.name,
+		Peer:       out.addr.String(),
+		Size:       out.offer.size,
+		ChunkSize:  out.offer.chunkSize,
+		Root:       append([]byte(nil), out.offer.root[:]...),
+		Path:       out.path,
+		NoMetadata: out.noMetadata,
+	}
+}
+
+// checkpoint returns the progress of the transfer, in must be locked.
+func (in *incoming) checkpoint() *checkpoint {
+	cp := &checkpoint{
+		Id:        in.offer.id,
+		Direction: "recieve",
+		Name:      in.offer.name,
+		Peer:      in.addr.String(),
+		Size:      in.offer.size,
+		ChunkSize: in.offer.chunkSize,
+		Root:      append([]byte(nil), in.offer.root[:]...),
+		Path:      in.file.Name(),
+		Dest:      in.dest,
+		Have:      make([]byte, (len(in.have)+7)/8),
+	}
+	if in.offer.meta != nil {
+		cp.Meta = in.offer.meta.marshal()
+	}
+	// the leaves are not saved, the hash blocks are recieved again
+	for i, ok := range in.have[:in.offer.chunks()] {
+		if ok {
+			cp.Have[i/8] |= 1 << (i % 8)
+		}
+	}
+	return cp
+}
+
+// save writes cp to the state directory, replacing the checkpoint before it.
+func (t *transfers) save(cp *checkpoint) error {
+	if t.dir == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(t.dir, ".checkpoint-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(t.dir, cp.file()))
+}
+
+// remove deletes the checkpoint of a transfer that is over.
+func (t *transfers) remove(cp *checkpoint) {
+	if t.dir != "" {
+		os.Remove(filepath.Join(t.dir, cp.file()))
+	}
+}
+
+// checkpoint saves the progress of in once the chunks it has are on disk, in
+// must be locked.
+func (p *Peer) checkpoint(in *incoming) {
+	if p.transfers.dir == "" || in.done {
+		return
+	}
+	err := in.file.Sync()
+	if err == nil {
+		err = p.transfers.save(in.checkpoint())
+	}
+	if err != nil {
+		p.Logger().Warn("checkpointing transfer failed", F("file", in.offer.name), F("error", err))
+		return
+	}
+	in.unsaved = 0
+}
+
+// checkpointTransfers saves the progress of the files being recieved.
+func (p *Peer) checkpointTransfers() {
+	p.transfers.Lock()
+	in := make([]*incoming, 0, len(p.transfers.in))
+	for _, i := range p.transfers.in {
+		in = append(in, i)
+	}
+	p.transfers.Unlock()
+	for _, i := range in {
+		i.Lock()
+		p.checkpoint(i)
+		i.Unlock()
+	}
+}
+
+// restoreTransfers picks up the checkpoints in the StateDir of the peer.
+// Checkpoints that can't be used any more are thrown away.
+func (p *Peer) restoreTransfers() error {
+	t := p.transfers
+	t.dir = p.StateDir
+	if t.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(t.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		cp := new(checkpoint)
+		if err = json.Unmarshal(b, cp); err == nil {
+			err = p.restore(cp)
+		}
+		if err != nil {
+			p.Logger().Warn("dropping checkpoint", F("checkpoint", name), F("error", err))
+			os.Remove(name)
+		}
+	}
+	return nil
+}
+
+func (p *Peer) restore(cp *checkpoint) error {
+	t := p.transfers
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.in[cp.Id]; ok {
+		return nil
+	}
+	if _, ok := t.out[cp.Id]; ok {
+		return nil
+	}
+	switch cp.Direction {
+	case "send":
+		t.interrupted[cp.Id] = cp
+		return nil
+	case "recieve":
+	default:
+		return fmt.Errorf("unknown direction %q", cp.Direction)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", cp.Peer)
+	if err != nil {
+		return err
+	}
+	offer := fileOffer{id: cp.Id, size: cp.Size, chunkSize: cp.ChunkSize, name: cp.Name}
+	copy(offer.root[:], cp.Root)
+	if err := offer.check(); err != nil {
+		return err
+	}
+	if len(cp.Have) != (int(offer.pieces())+7)/8 {
+		return errors.New("invalid checkpoint")
+	}
+	if len(cp.Meta) > 0 {
+		offer.meta = new(FileMeta)
+		if err := offer.meta.unmarshal(cp.Meta); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(cp.Path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if info, err := file.Stat(); err != nil || uint64(info.Size()) != cp.Size {
+		file.Close()
+		return fmt.Errorf("partial file %s changed", cp.Path)
+	}
+	in := &incoming{
+		offer:    offer,
+		addr:     addr,
+		file:     file,
+		dest:     cp.Dest,
+		have:     make([]bool, offer.pieces()),
+		leaves:   make([]merkleHash, offer.chunks()),
+		restored: true,
+		seen:     time.Now(),
+		owner:    p.PreserveOwner,
+	}
+	for i := range in.leaves {
+		in.have[i] = cp.Have[i/8]&(1<<(i%8)) != 0
+	}
+	t.in[cp.Id] = in
+	p.expireIdle(in, t.idle)
+	p.Logger().Info("restored transfer", F("file", cp.Name), F("remote_addr", addr))
+	return nil
+}
+
+// resumeTransfers resumes the interrupted transfers of files the peer was
+// sending, it returns once they are done or ctx is done.
+func (p *Peer) resumeTransfers(ctx context.Context) {
+	p.transfers.Lock()
+	ids := make([]uint64, 0, len(p.transfers.interrupted))
+	for id := range p.transfers.interrupted {
+		ids = append(ids, id)
+	}
+	p.transfers.Unlock()
+	for _, id := range ids {
+		if _, err := p.ResumeTransfer(ctx, id); err != nil {
+			p.Logger().Warn("resuming transfer failed", F("transfer", fmt.Sprintf("%016x", id)), F("error", err))
+		}
+	}
+}
+
+// Transfers returns the transfers the peer is taking part in and those that
+// were interrupted.
+func (p *Peer) Transfers() []TransferStatus {
+	return p.transfers.status()
+}
+
+// ResumeTransfer sends the rest of a file whose transfer was interrupted. It
+// blocks like SendFile does. The file must not have changed since the
+// transfer started. Files being recieved resume when their sender sends them
+// again.
+func (p *Peer) ResumeTransfer(ctx context.Context, id uint64) (*TransferReport, error) {
+	p.transfers.Lock()
+	cp, ok := p.transfers.interrupted[id]
+	_, recieving := p.transfers.in[id]
+	p.transfers.Unlock()
+	if !ok {
+		if recieving {
+			return nil, fmt.Errorf("transfer %016x is recieved, it resumes when the sender sends it again", id)
+		}
+		return nil, fmt.Errorf("resuming transfer %016x: %w", id, ErrNoTransfer)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", cp.Peer)
+	if err != nil {
+		return nil, err
+	}
+	file, offer, err := readOffer(cp.Path, cp.NoMetadata)
+	if err != nil {
+		return nil, err
+	}
+	if file != nil {
+		defer file.Close()
+	}
+	offer.id, offer.chunkSize = cp.Id, cp.ChunkSize
+	tree, err := hashChunks(file, offer.size, offer.chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	offer.root = tree.root()
+	if offer.size != cp.Size || !bytes.Equal(offer.root[:], cp.Root) {
+		return nil, fmt.Errorf("resuming transfer %016x: %s changed since it was sent, cancel the transfer and send it again", id, cp.Path)
+	}
+	out := &outgoing{
+		offer:      offer,
+		addr:       addr,
+		acks:       make(chan fileAck, 1),
+		tree:       tree,
+		path:       cp.Path,
+		noMetadata: cp.NoMetadata,
+	}
+	p.Logger().Info("resuming transfer", F("file", cp.Name), F("remote_addr", addr))
+	return p.runTransfer(ctx, out, file, true)
+}
+
+// CancelTransfer stops a transfer and forgets about it, the partial file of a
+// file being recieved is thrown away.
+func (p *Peer) CancelTransfer(id uint64) error {
+	t := p.transfers
+	t.Lock()
+	out, sending := t.out[id]
+	if sending {
+		out.cancelled = true
+		out.cancel()
+	}
+	cp, interrupted := t.interrupted[id]
+	delete(t.interrupted, id)
+	in, recieving := t.in[id]
+	delete(t.in, id)
+	t.Unlock()
+
+	switch {
+	case sending:
+	case interrupted:
+		t.remove(cp)
+	case recieving:
+		in.Lock()
+		if !in.done {
+			in.abort()
+			in.done = true
+			t.remove(in.checkpoint())
+		}
+		in.Unlock()
+	default:
+		return fmt.Errorf("cancelling transfer %016x: %w", id, ErrNoTransfer)
+	}
+	p.Logger().Info("cancelled transfer", F("transfer", fmt.Sprintf("%016x", id)))
+	return nil
+}
+
+// ParseTransferId parses the id of a transfer as it is shown by zinkctl.
+func ParseTransferId(s string) (uint64, error) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid transfer id %q", s)
+	}
+	return id, nil
+}
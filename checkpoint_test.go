@@ -0,0 +1,212 @@
+package zinc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chunkConn drops the file chunks with an index of limit or more and records
+// the chunks that go through.
+type chunkConn struct {
+	*net.UDPConn
+	sync.Mutex
+	limit uint32
+	sent  []uint32
+}
+
+func (c *chunkConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if len(b) >= packetHeaderLen+fileChunkHeaderLen && PacketType(b[offType]) == FileChunk {
+		c.Lock()
+		index := binary.BigEndian.Uint32(b[packetHeaderLen+8:])
+		drop := index >= c.limit
+		if !drop {
+			c.sent = append(c.sent, index)
+		}
+		c.Unlock()
+		if drop {
+			return len(b), nil
+		}
+	}
+	return c.UDPConn.WriteToUDP(b, addr)
+}
+
+func (c *chunkConn) set(limit uint32) {
+	c.Lock()
+	c.limit, c.sent = limit, nil
+	c.Unlock()
+}
+
+func findTransfer(p *Peer, id uint64) (TransferStatus, bool) {
+	for _, st := range p.Transfers() {
+		if st.Id == id {
+			return st, true
+		}
+	}
+	return TransferStatus{}, false
+}
+
+func checkpoints(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestResumeTransfer(t *testing.T) {
+	senderState, receiverState := t.TempDir(), t.TempDir()
+	wire := new(chunkConn)
+	sender := startTestPeer(t, "sender", func(p *Peer) {
+		p.StateDir = senderState
+		wire.UDPConn = p.lstn
+		p.wire = wire
+	})
+	receiver := startTestPeer(t, "receiver", func(p *Peer) { p.StateDir = receiverState })
+	raddr := receiver.lstn.LocalAddr().(*net.UDPAddr)
+
+	want := make([]byte, 300*defaultChunkSize+17)
+	rand.Read(want)
+	name := filepath.Join(t.TempDir(), "big")
+	if err := os.WriteFile(name, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver only gets the first chunks before the sender gives up
+	const limit = 5
+	wire.set(limit)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	_, err := sender.SendFile(ctx, name, raddr, nil)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the transfer cut short; got %v", err)
+	}
+	st := sender.Transfers()
+	if len(st) != 1 || st[0].State != transferInterrupted || len(checkpoints(t, senderState)) != 1 {
+		t.Fatalf("want one interrupted transfer checkpointed; got %+v", st)
+	}
+	id := st[0].Id
+	chunkSize := sender.transfers.interrupted[id].ChunkSize
+
+	// the receiver restarts on the same address and picks up its checkpoint
+	sctx, scancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	receiver.Shutdown(sctx)
+	scancel()
+	restarted := startTestPeer(t, "receiver", func(p *Peer) {
+		p.lstn.Close()
+		conn, err := net.ListenUDP("udp", raddr)
+		if err != nil {
+			t.Fatalf("listening on %s again: %v", raddr, err)
+		}
+		p.lstn = conn
+		p.ReceiveDir = receiver.ReceiveDir
+		p.StateDir = receiverState
+	})
+	got, ok := findTransfer(restarted, id)
+	if !ok || got.State != transferInterrupted || got.Recieved != limit*uint64(chunkSize) {
+		t.Fatalf("want the partial transfer restored with %d bytes; got %+v", limit*chunkSize, got)
+	}
+	if _, err := restarted.ResumeTransfer(context.Background(), id); err == nil {
+		t.Fatal("want an error resuming a transfer that is recieved")
+	}
+
+	wire.set(^uint32(0))
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := sender.ResumeTransfer(ctx, id); err != nil {
+		t.Fatalf("ResumeTransfer: %v", err)
+	}
+	wire.Lock()
+	defer wire.Unlock()
+	for _, i := range wire.sent {
+		if i < limit {
+			t.Fatalf("want only the missing chunks sent; chunk %d was sent again", i)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(receiver.ReceiveDir, "big"))
+	if err != nil {
+		t.Fatalf("reading recieved file: %v", err)
+	}
+	if !bytes.Equal(want, b) {
+		t.Fatalf("recieved file differs from sent file")
+	}
+	if n := len(checkpoints(t, senderState)) + len(checkpoints(t, receiverState)); n != 0 {
+		t.Fatalf("want the checkpoints removed; %d left", n)
+	}
+	if _, err := sender.ResumeTransfer(ctx, id); !errors.Is(err, ErrNoTransfer) {
+		t.Fatalf("want ErrNoTransfer resuming a finished transfer; got %v", err)
+	}
+}
+
+func TestCancelTransfer(t *testing.T) {
+	senderState, receiverState := t.TempDir(), t.TempDir()
+	wire := new(chunkConn)
+	sender := startTestPeer(t, "sender", func(p *Peer) {
+		p.StateDir = senderState
+		wire.UDPConn = p.lstn
+		p.wire = wire
+	})
+	receiver := startTestPeer(t, "receiver", func(p *Peer) { p.StateDir = receiverState })
+	raddr := receiver.lstn.LocalAddr().(*net.UDPAddr)
+
+	name := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(name, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := sender.SendFile(ctx, name, raddr, nil); err == nil {
+		t.Fatal("want the transfer cut short")
+	}
+	st := sender.Transfers()
+	if len(st) != 1 {
+		t.Fatalf("want one interrupted transfer; got %+v", st)
+	}
+	id := st[0].Id
+
+	// a file that changed since it was sent is not resumed
+	if err := os.WriteFile(name, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.ResumeTransfer(context.Background(), id); err == nil {
+		t.Fatal("want an error resuming a changed file")
+	}
+
+	for _, p := range []*Peer{sender, receiver} {
+		if err := p.CancelTransfer(id); err != nil {
+			t.Fatalf("%s CancelTransfer: %v", p.Name, err)
+		}
+		if _, ok := findTransfer(p, id); ok {
+			t.Fatalf("%s still has the cancelled transfer", p.Name)
+		}
+		if err := p.CancelTransfer(id); !errors.Is(err, ErrNoTransfer) {
+			t.Fatalf("want ErrNoTransfer cancelling twice; got %v", err)
+		}
+	}
+	if n := len(checkpoints(t, senderState)) + len(checkpoints(t, receiverState)); n != 0 {
+		t.Fatalf("want the checkpoints removed; %d left", n)
+	}
+	if entries, _ := os.ReadDir(receiver.ReceiveDir); len(entries) != 0 {
+		t.Fatalf("want the partial file removed; got %d files", len(entries))
+	}
+}
+
+func TestParseTransferId(t *testing.T) {
+	for _, s := range []string{"00000000000000ff", "0xff", "ff"} {
+		if id, err := ParseTransferId(s); err != nil || id != 0xff {
+			t.Errorf("ParseTransferId(%q) = %x, %v", s, id, err)
+		}
+	}
+	if _, err := ParseTransferId("zz"); err == nil {
+		t.Error("want an error parsing an invalid id")
+	}
+}
@@ -2,20 +2,41 @@ package zinc
 
 import (
 	"context"
-	"io"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/Joe-Degs/zinc/internal/config"
 	"github.com/google/uuid"
 )
 
+// A Cluster is a peer that keeps track of a group of other peers. Members come
+// and go, the failure detector and the gossip of the cluster keep the members
+// up to date with who is around.
 type Cluster struct {
 	*Peer
-	Members map[string]*Node
+
+	// nodes are the members of the cluster keyed by their ids, mu guards
+	// them.
+	nodes      map[string]*Node
+	mu         sync.RWMutex
+	membership *membership
+
+	// discovery is nil when the cluster does not discover its members.
+	discovery     *discovery
+	discoveryConf *config.DiscoveryConfig
+
+	// seeds maps the addresses of the peers in the cluster config to their
+	// ids. c.mu guards it.
+	seeds map[string]string
 }
 
 func NewCluster(config *config.ClusterConfig) (*Cluster, error) {
 	cluster := &Cluster{
-		Members: make(map[string]*Node),
+		nodes:      make(map[string]*Node),
+		membership: newMembership(),
+		seeds:      make(map[string]string),
 	}
 
 	if config == nil {
@@ -26,7 +47,7 @@ func NewCluster(config *config.ClusterConfig) (*Cluster, error) {
 	}
 
 	if err := cluster.init(config); err != nil {
-		return cluster, nil
+		return cluster, err
 	}
 
 	return cluster, nil
@@ -34,58 +55,167 @@ func NewCluster(config *config.ClusterConfig) (*Cluster, error) {
 
 // initialize the cluster with the values from the loaded config file
 func (c *Cluster) init(config *config.ClusterConfig) error {
-	if config.Id != "" {
-		id, err := uuid.Parse(config.Id)
-		if err != nil {
-			return err
-		}
-		c.Id = id
-	} else {
-		c.Id = uuid.New()
-	}
-
-	// add address and open connection
-	if err := c.Peer.setAddr(config.Addr); err != nil {
+	// the cluster sends and recieves packets for all its members through
+	// the socket of its own peer.
+	peer, err := NewPeer(config.PeerConfig)
+	if err != nil {
 		return err
 	}
+	c.Peer = peer
+	c.gossip = c
+	c.SetReliable(Gossip, true)
 
 	for _, peer := range config.Peers {
-		var id uuid.UUID
 		if peer.Id != "" {
-			var err error
-			id, err = uuid.Parse(peer.Id)
-			if err != nil {
+			if _, err := uuid.Parse(peer.Id); err != nil {
 				return err
 			}
-		} else {
-			id = uuid.New()
 		}
-		p, err := PeerFromSpec(peer.Name, peer.Addr, id)
+		n, err := c.addSeed(peer)
 		if err != nil {
-			//TODO(joe):
-			// what to do with the error?
+			c.Logger().Warn("skipping cluster member", F("member", peer.Name), F("error", err))
 			continue
 		}
+		if n != nil {
+			c.seeds[peer.Addr] = n.Id.String()
+		}
+	}
+	c.membershipChanged()
 
-		c.Members[id.String()] = NewNode(p)
+	c.discoveryConf = config.Discovery
+	if config.Discovery != nil && config.Discovery.Enabled {
+		if c.discovery, err = newDiscovery(config.Discovery); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 // use the default config files that come with the project
 func (c *Cluster) initDefault() error {
-	return nil
+	conf, err := config.DefaultClusterConfig()
+	if err != nil {
+		return err
+	}
+	return c.init(conf)
 }
 
-func (c *Cluster) StartServer(cl chan<- io.Closer) (context.CancelFunc, error) {
+// newNode returns a member of the cluster that is reached through the
+// socket of the cluster.
+func (c *Cluster) newNode(p *Peer) *Node {
+	n := NewNode(p)
+	n.local = c.Peer
+	return n
+}
+
+// StartServer starts the server of the peer of the cluster, the failure
+// detector that keeps the membership of the cluster up to date and the
+// discovery of members when it is enabled.
+func (c *Cluster) StartServer() (context.CancelFunc, error) {
 	c.initInternalHandlers()
-	return c.Peer.StartServer(cl)
+	if c.ControlPath != "" {
+		c.initControlHandlers()
+	}
+	cancel, err := c.Peer.StartServer()
+	if err != nil {
+		return nil, err
+	}
+	// the cluster stops along with the server of its peer.
+	ctx, stop := context.WithCancel(c.server.ctx)
+	if c.discovery != nil {
+		if err := c.runDiscovery(ctx); err != nil {
+			stop()
+			cancel()
+			return nil, err
+		}
+	}
+	go c.runMembership(ctx)
+	return func() {
+		stop()
+		cancel()
+	}, nil
+}
+
+// Members returns the members of the cluster sorted by name and id.
+func (c *Cluster) Members() []*Node {
+	c.mu.RLock()
+	nodes := make([]*Node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	c.mu.RUnlock()
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Name != nodes[j].Name {
+			return nodes[i].Name < nodes[j].Name
+		}
+		return nodes[i].Id.String() < nodes[j].Id.String()
+	})
+	return nodes
 }
 
+// FindById returns the member of the cluster identified by id. The id can be
+// the full uuid of the member, a prefix of it or the name of the member. Nil
+// is returned when no member matches or when more than one member does.
 func (c *Cluster) FindById(id string) *Node {
-	return nil
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if n, ok := c.nodes[id]; ok {
+		return n
+	}
+
+	var found *Node
+	for key, n := range c.nodes {
+		if strings.HasPrefix(key, id) || (n.Name != "" && n.Name == id) {
+			if found != nil && found != n {
+				return nil
+			}
+			found = n
+		}
+	}
+	return found
 }
 
-func (c *Cluster) Broadcast(b []byte) error {
+// BroadcastError holds the errors of the members a broadcast could not be
+// sent to, keyed by the ids of the members.
+type BroadcastError map[string]error
+
+func (e BroadcastError) Error() string {
+	ids := make([]string, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	str := &strings.Builder{}
+	fmt.Fprintf(str, "broadcast failed for %d members:", len(e))
+	for _, id := range ids {
+		fmt.Fprintf(str, " %s: %v;", id, e[id])
+	}
+	return strings.TrimSuffix(str.String(), ";")
+}
+
+// Broadcast sends packet to all the members of the cluster at the same time.
+// The remote endpoint of the packet is ignored. A BroadcastError is returned
+// when the packet could not be sent to some of the members.
+func (c *Cluster) Broadcast(packet Packet) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(BroadcastError)
+	for _, n := range c.Members() {
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			if err := n.Send(packet); err != nil {
+				mu.Lock()
+				errs[n.Id.String()] = err
+				mu.Unlock()
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
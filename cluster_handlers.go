@@ -1,6 +1,134 @@
 package zinc
 
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
 func (c *Cluster) initInternalHandlers() {
-	ZPrintf("starting default internal request handlers...")
-	// p.handlers[Ping] = p.pingRequestHandler
+	c.Logger().Debug("starting cluster request handlers")
+	c.handle(PingReq, c.pingReqHandler)
+	c.handle(Gossip, c.gossipHandler)
+}
+
+// probe a member on behalf of another member and tell it whether the member
+// responded
+func (c *Cluster) pingReqHandler(ctx context.Context, w ResponseWriter, req Packet) {
+	addr, err := net.ResolveUDPAddr("udp", string(req.Data()))
+	if err != nil {
+		c.Logger().Warn("invalid ping request", F("remote_addr", req.Addr()), F("error", err))
+		return
+	}
+	typ := Error
+	if c.ping(ctx, addr) {
+		typ = Ok
+	}
+	if err := w.Respond(typ, nil); err != nil {
+		c.Logger().Error("failed to respond to ping request", F("remote_addr", req.Addr()), F("error", err))
+	}
+}
+
+// take in the gossip sent with a join or a leave and respond to joins with
+// the state of the cluster
+func (c *Cluster) gossipHandler(_ context.Context, w ResponseWriter, req Packet) {
+	c.absorb(req.Addr(), req.Data())
+	if err := w.Respond(Gossip, marshalEvents(c.events())); err != nil {
+		c.Logger().Error("failed to respond to gossip", F("remote_addr", req.Addr()), F("error", err))
+	}
+}
+
+const (
+	// joinTimeout is how long a join requested through the control socket
+	// waits for the peer being joined.
+	joinTimeout = 5 * time.Second
+
+	// leaveTimeout is how long a leaving cluster waits for its members to
+	// hear about it.
+	leaveTimeout = 5 * time.Second
+)
+
+func (c *Cluster) initControlHandlers() {
+	c.control[Members] = c.controlMembersHandler
+	c.control[Join] = c.controlJoinHandler
+	c.control[Leave] = c.controlLeaveHandler
+	c.control[BroadcastPing] = c.controlBroadcastPingHandler
+}
+
+// status returns what the cluster knows of a member.
+func (c *Cluster) status(n *Node) PeerStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return PeerStatus{
+		Id:       n.Id.String(),
+		Name:     n.Name,
+		Addr:     n.LocalAddr.String(),
+		Status:   n.Status.String(),
+		State:    n.state.String(),
+		LastSeen: n.connStatus.lastUsed,
+	}
+}
+
+func controlJSON(req Packet, v interface{}) Packet {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return controlError(req, err)
+	}
+	return responseTo(req, Ok, data)
+}
+
+// responds with the members of the cluster
+func (c *Cluster) controlMembersHandler(_ context.Context, req Packet) Packet {
+	members := []PeerStatus{}
+	for _, n := range c.Members() {
+		members = append(members, c.status(n))
+	}
+	return controlJSON(req, members)
+}
+
+// joins the cluster of the peer at the address in the request
+func (c *Cluster) controlJoinHandler(ctx context.Context, req Packet) Packet {
+	ctx, cancel := context.WithTimeout(ctx, joinTimeout)
+	defer cancel()
+	if err := c.Join(ctx, string(req.Data())); err != nil {
+		return controlError(req, err)
+	}
+	return c.controlMembersHandler(ctx, req)
+}
+
+// leaves the cluster for good and stops
+func (c *Cluster) controlLeaveHandler(ctx context.Context, req Packet) Packet {
+	ctx, cancel := context.WithTimeout(ctx, leaveTimeout)
+	defer cancel()
+	if err := c.Leave(ctx); err != nil {
+		c.Logger().Error("leaving cluster", F("error", err))
+	}
+	defer c.stop(false)
+	return responseTo(req, Ok, nil)
+}
+
+// pings every member of the cluster and responds with how each of them did
+func (c *Cluster) controlBroadcastPingHandler(ctx context.Context, req Packet) Packet {
+	nodes := c.Members()
+	results := make([]PeerStatus, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(ps *PeerStatus, n *Node) {
+			defer wg.Done()
+			*ps = c.status(n)
+			ps.Status = INACTIVE.String()
+			start := time.Now()
+			if c.ping(ctx, n.LocalAddr.UDPAddr()) {
+				ps.RTT = time.Since(start)
+				ps.Status = ACTIVE.String()
+				n.seen()
+				ps.LastSeen = time.Now()
+			}
+		}(&results[i], n)
+	}
+	wg.Wait()
+	return controlJSON(req, results)
 }
@@ -0,0 +1,453 @@
+package zinc
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Joe-Degs/zinc/internal/config"
+	"github.com/google/uuid"
+)
+
+func TestClusterBroadcast(t *testing.T) {
+	const testPacket PacketType = 0xf1
+	var handled int32
+	count := func(p *Peer) {
+		p.HandleFunc(testPacket, func(context.Context, ResponseWriter, Packet) { atomic.AddInt32(&handled, 1) })
+	}
+
+	conf := &config.ClusterConfig{PeerConfig: &config.PeerConfig{Addr: "127.0.0.1:0"}}
+	for _, name := range []string{"kofi", "messi", "oskee"} {
+		p := startTestPeer(t, name, count)
+		conf.Peers = append(conf.Peers, &config.PeerConfig{
+			Name: name,
+			Id:   p.Id.String(),
+			Addr: p.LocalAddr.String(),
+		})
+	}
+	// a member packets can never be sent to
+	conf.Peers = append(conf.Peers, &config.PeerConfig{Name: "ghost", Addr: "127.0.0.1:0"})
+
+	c, err := NewCluster(conf)
+	if err != nil {
+		t.Fatalf("NewCluster: %v", err)
+	}
+	c.SetReliable(testPacket, true)
+	cancel, err := c.StartServer()
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	defer func() {
+		cancel()
+		c.lstn.Close()
+	}()
+
+	err = c.Broadcast(NewPacket(testPacket, []byte("hello"), nil))
+	var berr BroadcastError
+	if !errors.As(err, &berr) || len(berr) != 1 {
+		t.Fatalf("want a broadcast error for the ghost member; got %v", err)
+	}
+	ghost := c.FindById("ghost")
+	if ghost == nil || berr[ghost.Id.String()] == nil {
+		t.Fatalf("want broadcast to fail for ghost; got %v", err)
+	}
+	if ghost.connStatus.active {
+		t.Errorf("want connection to ghost inactive")
+	}
+
+	if n := atomic.LoadInt32(&handled); n != 3 {
+		t.Fatalf("want broadcast handled by 3 members; got %d", n)
+	}
+	kofi := c.FindById("kofi")
+	if kofi == nil || !kofi.connStatus.active || time.Since(kofi.connStatus.lastUsed) > time.Minute {
+		t.Fatalf("want connection to kofi active and recently used; got %+v", kofi)
+	}
+}
+
+func TestClusterFindById(t *testing.T) {
+	c := &Cluster{nodes: make(map[string]*Node)}
+	ids := []string{
+		"6e3e6d2c-0a3d-4a3b-8f0e-3c1f0e6a0d01",
+		"6e3e6d2c-0a3d-4a3b-8f0e-3c1f0e6a0d02",
+		"9b1c2f00-1111-4a3b-8f0e-3c1f0e6a0d03",
+	}
+	for i, name := range []string{"kofi", "messi", "oskee"} {
+		c.nodes[ids[i]] = NewNode(&Peer{Id: uuid.MustParse(ids[i]), Name: name})
+	}
+
+	testCases := []struct {
+		id   string
+		want string
+	}{
+		{id: ids[0], want: "kofi"},
+		{id: "9b1c", want: "oskee"},
+		{id: "messi", want: "messi"},
+		{id: "6e3e6d2c", want: ""},
+		{id: "nobody", want: ""},
+	}
+	for _, tc := range testCases {
+		n := c.FindById(tc.id)
+		switch {
+		case tc.want == "" && n != nil:
+			t.Errorf("FindById(%q): want no node; got %s", tc.id, n.Name)
+		case tc.want != "" && (n == nil || n.Name != tc.want):
+			t.Errorf("FindById(%q): want %s; got %v", tc.id, tc.want, n)
+		}
+	}
+}
+
+// startTestCluster starts a cluster on a random local port with a fast
+// failure detector.
+func startTestCluster(t *testing.T, name string, members ...*Cluster) (*Cluster, context.CancelFunc) {
+	t.Helper()
+	conf := &config.ClusterConfig{PeerConfig: &config.PeerConfig{Name: name, Addr: "127.0.0.1:0"}}
+	for _, m := range members {
+		conf.Peers = append(conf.Peers, &config.PeerConfig{Name: m.Name, Id: m.Id.String(), Addr: m.LocalAddr.String()})
+	}
+	c, err := NewCluster(conf)
+	if err != nil {
+		t.Fatalf("NewCluster: %v", err)
+	}
+	c.membership.probeInterval = 20 * time.Millisecond
+	c.membership.probeTimeout = 50 * time.Millisecond
+	c.membership.suspectTimeout = 200 * time.Millisecond
+	c.membership.deadTimeout = time.Second
+	cancel, err := c.StartServer()
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	stop := func() {
+		cancel()
+		c.lstn.Close()
+	}
+	t.Cleanup(stop)
+	return c, stop
+}
+
+// waitFor polls cond until it holds or the test runs out of patience.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func memberStatus(c *Cluster, id uuid.UUID) (NodeStatus, bool) {
+	n := c.FindById(id.String())
+	if n == nil {
+		return INACTIVE, false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.Status, true
+}
+
+func TestMembership(t *testing.T) {
+	kofi, _ := startTestCluster(t, "kofi")
+	messi, _ := startTestCluster(t, "messi", kofi)
+	oskee, stopOskee := startTestCluster(t, "oskee")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := oskee.Join(ctx, messi.LocalAddr.String()); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	// kofi only hears of oskee through gossip
+	waitFor(t, "everyone to know everyone", func() bool {
+		for _, c := range []*Cluster{kofi, messi, oskee} {
+			for _, other := range []*Cluster{kofi, messi, oskee} {
+				if c == other {
+					continue
+				}
+				if status, ok := memberStatus(c, other.Id); !ok || status != ACTIVE {
+					return false
+				}
+			}
+		}
+		return true
+	})
+
+	stopOskee()
+	waitFor(t, "oskee to be declared dead", func() bool {
+		for _, c := range []*Cluster{kofi, messi} {
+			if status, ok := memberStatus(c, oskee.Id); !ok || status != INACTIVE {
+				return false
+			}
+		}
+		return true
+	})
+	waitFor(t, "oskee to be forgotten", func() bool {
+		for _, c := range []*Cluster{kofi, messi} {
+			if _, ok := memberStatus(c, oskee.Id); ok {
+				return false
+			}
+		}
+		return true
+	})
+	// old news about oskee does not bring it back
+	kofi.apply(memberEvent{state: stateAlive, incarnation: oskee.membership.incarnation, id: oskee.Id, name: oskee.Name, addr: oskee.LocalAddr.String()})
+	if _, ok := memberStatus(kofi, oskee.Id); ok {
+		t.Fatal("want oskee kept out on old gossip")
+	}
+
+	if err := messi.Leave(ctx); err != nil {
+		t.Fatalf("Leave: %v", err)
+	}
+	if _, ok := memberStatus(kofi, messi.Id); ok {
+		t.Fatalf("want messi removed from kofi after leaving")
+	}
+}
+
+func TestMemberEventOverrides(t *testing.T) {
+	testCases := []struct {
+		event memberEvent
+		state memberState
+		inc   uint32
+		want  bool
+	}{
+		{memberEvent{state: stateSuspect, incarnation: 1}, stateAlive, 1, true},
+		{memberEvent{state: stateAlive, incarnation: 1}, stateSuspect, 1, false},
+		{memberEvent{state: stateAlive, incarnation: 2}, stateSuspect, 1, true},
+		{memberEvent{state: stateAlive, incarnation: 2}, stateDead, 1, true},
+		{memberEvent{state: stateDead, incarnation: 1}, stateAlive, 2, false},
+	}
+	for _, tc := range testCases {
+		if got := tc.event.overrides(tc.state, tc.inc); got != tc.want {
+			t.Errorf("%s@%d overrides %s@%d: want %v; got %v",
+				tc.event.state, tc.event.incarnation, tc.state, tc.inc, tc.want, got)
+		}
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	group := fmt.Sprintf("239.255.90.9:%d", 60009+rand.Intn(5000))
+	start := func(name, clusterId string) *Cluster {
+		c, err := NewCluster(&config.ClusterConfig{
+			PeerConfig: &config.PeerConfig{Name: name, Addr: "127.0.0.1:0"},
+			Discovery:  &config.DiscoveryConfig{Enabled: true, Group: group, ClusterId: clusterId},
+		})
+		if err != nil {
+			t.Fatalf("NewCluster: %v", err)
+		}
+		c.discovery.interval = 20 * time.Millisecond
+		cancel, err := c.StartServer()
+		if err != nil {
+			t.Skipf("multicast not available: %v", err)
+		}
+		t.Cleanup(func() {
+			cancel()
+			c.lstn.Close()
+		})
+		return c
+	}
+
+	kofi := start("kofi", "blue")
+	messi := start("messi", "blue")
+	oskee := start("oskee", "red")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, kofiKnows := memberStatus(kofi, messi.Id)
+		_, messiKnows := memberStatus(messi, kofi.Id)
+		if kofiKnows && messiKnows {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Skip("no multicast route on this host")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, c := range []*Cluster{kofi, messi} {
+		if _, ok := memberStatus(c, oskee.Id); ok {
+			t.Errorf("%s discovered oskee of another cluster", c.Name)
+		}
+	}
+	if n := len(oskee.Members()); n != 0 {
+		t.Errorf("want oskee to discover no members; got %d", n)
+	}
+}
+
+func TestDiscoverySecure(t *testing.T) {
+	kofiKey, messiKey, oskeeKey := testKey(t), testKey(t), testKey(t)
+	cluster := func(name string, setup ...func(*Peer)) *Cluster {
+		c, err := NewCluster(&config.ClusterConfig{
+			PeerConfig: &config.PeerConfig{Name: name, Addr: "127.0.0.1:0"},
+			Discovery:  &config.DiscoveryConfig{Enabled: true, ClusterId: "blue"},
+		})
+		if err != nil {
+			t.Fatalf("NewCluster: %v", err)
+		}
+		t.Cleanup(func() { c.lstn.Close() })
+		for _, f := range setup {
+			f(c.Peer)
+		}
+		return c
+	}
+	kofi := cluster("kofi", secure(kofiKey, messiKey))
+	messi := cluster("messi", secure(messiKey, kofiKey))
+	oskee := cluster("oskee", secure(oskeeKey, kofiKey))
+	plain := cluster("plain")
+
+	announce := func(c *Cluster) []byte {
+		b, err := c.announcement()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	tampered := announce(messi)
+	tampered[len(tampered)-1] ^= 1
+	binary.BigEndian.PutUint32(tampered[offChecksum:], checksum(tampered))
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"untrusted", announce(oskee), ErrUntrustedKey},
+		{"unsigned", announce(plain), ErrUnsignedAnnouncement},
+		{"tampered", tampered, ErrInvalidSignature},
+	} {
+		if err := kofi.discovered(from, tc.b); !errors.Is(err, tc.want) {
+			t.Errorf("%s announcement: want %v; got %v", tc.name, tc.want, err)
+		}
+	}
+	for _, c := range []*Cluster{oskee, plain} {
+		if _, ok := memberStatus(kofi, c.Id); ok {
+			t.Errorf("kofi added %s from its announcement", c.Name)
+		}
+	}
+
+	if err := kofi.discovered(from, announce(messi)); err != nil {
+		t.Fatalf("trusted announcement: %v", err)
+	}
+	if _, ok := memberStatus(kofi, messi.Id); !ok {
+		t.Fatal("kofi did not add messi from its announcement")
+	}
+	// clusters that are not secure take signed announcements as they are
+	if err := plain.discovered(from, announce(messi)); err != nil {
+		t.Fatalf("signed announcement to a plain cluster: %v", err)
+	}
+}
+
+func TestClusterControl(t *testing.T) {
+	kofi, _ := startTestCluster(t, "kofi")
+	messi, _ := startTestCluster(t, "messi")
+
+	c, err := NewCluster(&config.ClusterConfig{PeerConfig: &config.PeerConfig{
+		Name:    "oskee",
+		Addr:    "127.0.0.1:0",
+		Control: filepath.Join(t.TempDir(), "zinc.sock"),
+	}})
+	if err != nil {
+		t.Fatalf("NewCluster: %v", err)
+	}
+	cancel, err := c.StartServer()
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	defer func() {
+		cancel()
+		c.lstn.Close()
+	}()
+
+	client, err := DialControl(c.ControlPath)
+	if err != nil {
+		t.Fatalf("DialControl: %v", err)
+	}
+	defer client.Close()
+
+	request := func(typ PacketType, data []byte) []PeerStatus {
+		t.Helper()
+		resp, err := client.Request(NewPacket(typ, data, nil), 5*time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		var members []PeerStatus
+		if err := json.Unmarshal(resp.Data(), &members); err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		return members
+	}
+
+	if members := request(Members, nil); len(members) != 0 {
+		t.Fatalf("want no members before joining; got %v", members)
+	}
+	for _, other := range []*Cluster{kofi, messi} {
+		request(Join, []byte(other.LocalAddr.String()))
+	}
+	members := request(Members, nil)
+	if len(members) != 2 || members[0].Name != "kofi" || members[1].Name != "messi" {
+		t.Fatalf("want kofi and messi as members; got %v", members)
+	}
+	for _, m := range request(BroadcastPing, nil) {
+		if m.Status != ACTIVE.String() || m.RTT <= 0 {
+			t.Fatalf("want %s to answer the broadcast ping; got %+v", m.Name, m)
+		}
+	}
+
+	if _, err := client.Request(NewPacket(Leave, nil, nil), 5*time.Second); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("cluster not stopped after leaving")
+	}
+	waitFor(t, "kofi to forget oskee", func() bool {
+		_, ok := memberStatus(kofi, c.Id)
+		return !ok
+	})
+}
+
+func TestSecureClusterPlaintextGossip(t *testing.T) {
+	key := testKey(t)
+	kofi, err := NewCluster(&config.ClusterConfig{PeerConfig: &config.PeerConfig{Name: "kofi", Addr: "127.0.0.1:0"}})
+	if err != nil {
+		t.Fatalf("NewCluster: %v", err)
+	}
+	kofi.Secure(key)
+	cancel, err := kofi.StartServer()
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		kofi.lstn.Close()
+	})
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	intruder := uuid.New()
+	gossip := marshalEvents([]memberEvent{{state: stateAlive, incarnation: 1, id: intruder, name: "intruder", addr: conn.LocalAddr().String()}})
+	for _, flags := range []uint8{0, flagReliable} {
+		b, err := MarshalPacket(&requestWrapper{typ: Handshake, flags: flags, seq: 1, data: make([]byte, handshakeLen)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteToUDP(attachGossip(b, gossip), kofi.LocalAddr.UDPAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := memberStatus(kofi, intruder); ok {
+		t.Fatal("want plaintext gossip ignored by a secure cluster")
+	}
+}
@@ -27,9 +27,9 @@ func main() {
 	// output some logs see how it goes
 	text, _ := peer1.MarshalText()
 	peer1.UnmarshalText(text)
-	zinc.ZErrorf("%v", errors.New("Error before everything"))
-	zinc.ZPrintf("%s", text)
-	zinc.ZErrorf("%v", errors.New("The new error in town"))
+	peer1.Logger().Error("before everything", zinc.F("error", errors.New("Error before everything")))
+	peer1.Logger().Info(string(text))
+	peer1.Logger().Error("after everything", zinc.F("error", errors.New("The new error in town")))
 
 	pprint(peer1, peer2, peer3)
 }
@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Joe-Degs/zinc"
+)
+
+// broadcast-ping subcommand of the cluster command.
+// broadcastPing has the running cluster ping all its members.
+type broadcastPing struct {
+	JSON bool `long:"json" description:"print the results as json"`
+}
+
+func (b broadcastPing) Help() string {
+	help := `
+Usage: zinkctl [global options] cluster broadcast-ping <options>
+
+ help
+
+Options:
+-c --control:       control socket of the cluster daemon
+--json:             print the results as json`
+	return strings.TrimSpace(help)
+}
+
+func (b broadcastPing) Execute(args []string) error {
+	help(args, b.Help())
+	packet, err := controlRequest(zinc.NewPacket(zinc.BroadcastPing, nil, nil), 10*time.Second)
+	if err != nil {
+		return err
+	}
+	return printMembers(packet, b.JSON)
+}
+
+func (b broadcastPing) Synopsis() string {
+	return "ping every member of the cluster"
+}
+
+var b broadcastPing
+
+func init() {
+	clusterParser.AddCommand("broadcast-ping", b.Synopsis(), b.Help(), &b)
+}
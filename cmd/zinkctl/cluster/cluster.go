@@ -1,10 +1,14 @@
 package cluster
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/Joe-Degs/zinc"
 	"github.com/Joe-Degs/zinc/cmd/zinkctl/opts"
 	"github.com/jessevdk/go-flags"
 )
@@ -15,15 +19,15 @@ func (Cluster) Help() string {
 	return strings.TrimSpace(`
 Usage: zinkctl [global options] cluster
 
- start, stop, list, delete peers
+ start, members, join, leave and broadcast-ping clusters
 		`)
 }
 
 var options opts.Opts
-var peerParser = opts.Parser(&options)
+var clusterParser = opts.Parser(&options)
 
 func (Cluster) Run(args []string) int {
-	_, err := peerParser.ParseArgs(args)
+	_, err := clusterParser.ParseArgs(args)
 	if err != nil {
 		if f, ok := err.(*flags.Error); ok {
 			printErr(f.Message)
@@ -41,3 +45,49 @@ func printErr(err interface{}) {
 func (Cluster) Synopsis() string {
 	return "Cluster management"
 }
+
+// controlRequest sends packet to the local zinc daemon through its control
+// socket and returns the response.
+func controlRequest(packet zinc.Packet, timeout time.Duration) (zinc.Packet, error) {
+	return options.ControlRequest(packet, timeout)
+}
+
+// printMembers prints the members in a response of the daemon as a table or
+// as json.
+func printMembers(packet zinc.Packet, asJSON bool) error {
+	if asJSON {
+		fmt.Println(string(packet.Data()))
+		return nil
+	}
+	var members []zinc.PeerStatus
+	if err := json.Unmarshal(packet.Data(), &members); err != nil {
+		return err
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 8, 8, 2, '\t', 0)
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t%s\t", "Name", "ID", "Address", "Status", "State", "Last Seen", "RTT")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t%s\t", "----", "--", "-------", "------", "-----", "---------", "---")
+	for _, m := range members {
+		lastSeen, rtt := "never", "-"
+		if !m.LastSeen.IsZero() {
+			lastSeen = m.LastSeen.Format(time.RFC3339)
+		}
+		if m.RTT > 0 {
+			rtt = m.RTT.Round(time.Microsecond).String()
+		}
+		fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t%s\t", m.Name, m.Id, m.Addr, m.Status, m.State, lastSeen, rtt)
+	}
+	fmt.Fprintln(w, "")
+	return w.Flush()
+}
+
+// help prints the help of a command when it is asked for.
+func help(args []string, text string) {
+	for _, v := range args {
+		if v == "help" {
+			fmt.Println(text)
+			os.Exit(0)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Joe-Degs/zinc"
+)
+
+// join subcommand of the cluster command.
+// join adds the running cluster to the cluster of another peer.
+type join struct {
+	JSON bool `long:"json" description:"print the members as json"`
+}
+
+func (j join) Help() string {
+	help := `
+Usage: zinkctl [global options] cluster join <options> <addr>
+
+ help
+
+Options:
+-c --control:       control socket of the cluster daemon
+--json:             print the members as json`
+	return strings.TrimSpace(help)
+}
+
+func (j join) Execute(args []string) error {
+	help(args, j.Help())
+	if len(args) != 1 {
+		return fmt.Errorf("join: expected the address of a single peer, got %d", len(args))
+	}
+	packet, err := controlRequest(zinc.NewPacket(zinc.Join, []byte(args[0]), nil), 10*time.Second)
+	if err != nil {
+		return err
+	}
+	return printMembers(packet, j.JSON)
+}
+
+func (j join) Synopsis() string {
+	return "join the cluster of another peer"
+}
+
+var j join
+
+func init() {
+	clusterParser.AddCommand("join", j.Synopsis(), j.Help(), &j)
+}
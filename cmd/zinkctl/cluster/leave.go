@@ -0,0 +1,43 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Joe-Degs/zinc"
+)
+
+// leave subcommand of the cluster command.
+// leave tells the members of the cluster the daemon is leaving and stops it.
+type leave struct{}
+
+func (lv leave) Help() string {
+	help := `
+Usage: zinkctl [global options] cluster leave <options>
+
+ help
+
+Options:
+-c --control:       control socket of the cluster daemon`
+	return strings.TrimSpace(help)
+}
+
+func (lv leave) Execute(args []string) error {
+	help(args, lv.Help())
+	if _, err := controlRequest(zinc.NewPacket(zinc.Leave, nil, nil), 10*time.Second); err != nil {
+		return err
+	}
+	fmt.Println("left the cluster, daemon stopped")
+	return nil
+}
+
+func (lv leave) Synopsis() string {
+	return "leave the cluster and stop the daemon"
+}
+
+var lv leave
+
+func init() {
+	clusterParser.AddCommand("leave", lv.Synopsis(), lv.Help(), &lv)
+}
@@ -0,0 +1,44 @@
+package cluster
+
+import (
+	"strings"
+
+	"github.com/Joe-Degs/zinc"
+)
+
+// members subcommand of the cluster command.
+// members shows the members of the running cluster.
+type members struct {
+	JSON bool `long:"json" description:"print the members as json"`
+}
+
+func (m members) Help() string {
+	help := `
+Usage: zinkctl [global options] cluster members <options>
+
+ help
+
+Options:
+-c --control:       control socket of the cluster daemon
+--json:             print the members as json`
+	return strings.TrimSpace(help)
+}
+
+func (m members) Execute(args []string) error {
+	help(args, m.Help())
+	packet, err := controlRequest(zinc.NewPacket(zinc.Members, nil, nil), 0)
+	if err != nil {
+		return err
+	}
+	return printMembers(packet, m.JSON)
+}
+
+func (m members) Synopsis() string {
+	return "list the members of the cluster"
+}
+
+var m members
+
+func init() {
+	clusterParser.AddCommand("members", m.Synopsis(), m.Help(), &m)
+}
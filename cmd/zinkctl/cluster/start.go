@@ -0,0 +1,103 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Joe-Degs/zinc"
+	"github.com/Joe-Degs/zinc/cmd/zinkctl/opts"
+	"github.com/Joe-Degs/zinc/internal/config"
+	"github.com/Joe-Degs/zinc/internal/registry"
+)
+
+// start subcommand of the cluster command.
+// start runs a cluster daemon from a cluster config file.
+type start struct{}
+
+func (s start) Help() string {
+	help := `
+Usage: zinkctl [global options] cluster start <options>
+
+ help
+
+Options:
+--config:          config file of the cluster
+-p --port:          port cluster server should listen on
+-n --name:          name of the cluster peer
+-i --id:            id of the cluster peer
+-c --control:       control socket local tools manage the cluster through
+--pidfile:          file the pid of the cluster is written to`
+	return strings.TrimSpace(help)
+}
+
+func (s start) Execute(args []string) error {
+	help(args, s.Help())
+
+	conf, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("error loading configs: %w", err)
+	}
+
+	if err := opts.WritePidFile(options.PidPath()); err != nil {
+		return fmt.Errorf("could not start cluster: %w", err)
+	}
+	c, err := zinc.NewCluster(conf)
+	if err != nil {
+		os.Remove(options.PidPath())
+		return fmt.Errorf("could not start cluster: %w", err)
+	}
+	if _, err := c.StartServer(); err != nil {
+		os.Remove(options.PidPath())
+		return fmt.Errorf("could not start cluster: %w", err)
+	}
+	go opts.HandleShutdown(func() { opts.Shutdown(c.Peer) }, func() {
+		conf, err := loadConfig()
+		if err != nil {
+			opts.LogChanges(nil, err)
+			return
+		}
+		opts.LogChanges(c.Reload(conf))
+	})
+	<-c.Done()
+	if err := opts.Shutdown(c.Peer); err != nil {
+		c.Logger().Warn("shutdown cut short", zinc.F("error", err))
+	}
+
+	if c.RestartRequested() {
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("could not restart cluster: %w", err)
+		}
+		c.Logger().Info("restarting cluster")
+		return opts.Exec(exe, os.Args, os.Environ())
+	}
+	os.Remove(options.PidPath())
+	return nil
+}
+
+// loadConfig loads the config of the cluster. The control socket and registry
+// default to the ones the other commands look for.
+func loadConfig() (*config.ClusterConfig, error) {
+	conf, err := options.Loader().LoadCluster()
+	if err != nil {
+		return nil, err
+	}
+	if conf.Control == "" {
+		conf.Control = options.ControlPath()
+	}
+	if conf.Registry == "" {
+		conf.Registry = registry.DefaultPath()
+	}
+	return conf, nil
+}
+
+func (s start) Synopsis() string {
+	return "Start a zinc cluster daemon"
+}
+
+var s start
+
+func init() {
+	clusterParser.AddCommand("start", s.Synopsis(), s.Help(), &s)
+}
@@ -27,7 +27,7 @@ func main() {
 
 	exitStatus, err := c.Run()
 	if err != nil {
-		zinc.ZErrorf("%v", err)
+		zinc.DefaultLogger().Error("zinkctl", zinc.F("error", err))
 	}
 	os.Exit(exitStatus)
 }
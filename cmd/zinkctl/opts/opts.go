@@ -1,13 +1,21 @@
 package opts
 
 import (
-	"io"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/Joe-Degs/zinc"
+	"github.com/Joe-Degs/zinc/internal/config"
 	"github.com/jessevdk/go-flags"
 )
 
@@ -16,47 +24,180 @@ type Opts struct {
 	Help    bool   `short:"h" long:"help" description:"Display help for command"`
 	Name    string `short:"n" long:"name" description:"Peer or cluster name" optional:"yes"`
 	Id      string `short:"i" long:"id" description:"unique id of peer or cluster" optional:"yes"`
-	Port    string `short:"p" long:"port" default:"6009" description:"Address of peer server"`
+	Port    string `short:"p" long:"port" description:"Port of peer server"`
+	Addr    string `short:"a" long:"addr" description:"Address of a remote peer"`
+	Control string `short:"c" long:"control" description:"Path of the control socket of the zinc daemon"`
+	PidFile string `long:"pidfile" description:"Path of the pid file of the zinc daemon"`
+	Config  string `long:"config" description:"Path of the config file of the zinc daemon"`
+}
+
+// DefaultPidPath is where the zinc daemon writes its pid when no other path
+// is given, next to its control socket in the runtime directory of the user.
+var DefaultPidPath = filepath.Join(zinc.RuntimeDir(), "zinc.pid")
+
+// ControlPath returns the control socket the command line tools should talk
+// to.
+func (o Opts) ControlPath() string {
+	if o.Control != "" {
+		return o.Control
+	}
+	return zinc.DefaultControlPath
+}
+
+// Loader returns the loader of the config of the zinc daemon, the flags
+// override the config file and the environment.
+func (o Opts) Loader() config.Loader {
+	var level string
+	if o.Verbose {
+		level = "debug"
+	}
+	return config.Loader{
+		File: o.Config,
+		Flags: config.Overrides{
+			Name:     o.Name,
+			Id:       o.Id,
+			Port:     o.Port,
+			Control:  o.Control,
+			LogLevel: level,
+		},
+	}
+}
+
+// LogChanges logs the changes a reload made, or why it failed.
+func LogChanges(changes []zinc.ConfigChange, err error) {
+	if err != nil {
+		log.Printf("reload failed: %v", err)
+		return
+	}
+	if len(changes) == 0 {
+		log.Println("reload: nothing changed")
+		return
+	}
+	for _, c := range changes {
+		log.Printf("reload: %s", c)
+	}
+}
+
+// ControlRequest sends packet to the local zinc daemon through its control
+// socket and returns the response.
+func (o Opts) ControlRequest(packet zinc.Packet, timeout time.Duration) (zinc.Packet, error) {
+	client, err := zinc.DialControl(o.ControlPath())
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.Request(packet, timeout)
+}
+
+// CheckDaemon makes sure the process with the given pid is the zinc daemon
+// behind the control socket before it is signalled, a pid file alone is not
+// trusted with that.
+func (o Opts) CheckDaemon(pid int) error {
+	packet, err := o.ControlRequest(zinc.NewPacket(zinc.Status, nil, nil), time.Second)
+	if err != nil {
+		return fmt.Errorf("could not make sure pid %d is the zinc daemon: %w", pid, err)
+	}
+	var st zinc.DaemonStatus
+	if err := json.Unmarshal(packet.Data(), &st); err != nil {
+		return err
+	}
+	if st.Pid != pid {
+		return fmt.Errorf("pid file names pid %d but the zinc daemon runs as pid %d", pid, st.Pid)
+	}
+	return nil
+}
+
+// PidPath returns the pid file of the zinc daemon.
+func (o Opts) PidPath() string {
+	if o.PidFile != "" {
+		return o.PidFile
+	}
+	return DefaultPidPath
+}
+
+// WritePidFile records the pid of the running process in the file at path.
+// It fails if the file belongs to another process that is still running. The
+// file is made afresh so nothing left in its place is written through.
+func WritePidFile(path string) error {
+	if err := zinc.PrivateDir(path); err != nil {
+		return err
+	}
+	if pid, err := ReadPidFile(path); err == nil && pid != os.Getpid() {
+		return fmt.Errorf("zinc daemon already running with pid %d", pid)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|noFollow, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strconv.Itoa(os.Getpid()) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadPidFile returns the pid recorded in the file at path. A pid file left
+// behind by a process that is no longer running is reported as missing.
+func ReadPidFile(path string) (int, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("pid file %s is not a regular file", path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("pid file %s: %w", path, err)
+	}
+	if !processRunning(pid) {
+		return 0, os.ErrNotExist
+	}
+	return pid, nil
 }
 
 func Parser(opts *Opts) *flags.Parser {
 	return flags.NewParser(opts, flags.HelpFlag|flags.PassDoubleDash|flags.IgnoreUnknown)
 }
 
-func HandleShutdown(cl <-chan io.Closer) {
+// ShutdownTimeout is how long the zinc daemon gets to finish its transfers
+// when it is stopped.
+const ShutdownTimeout = 30 * time.Second
+
+// Shutdown stops the peer of the zinc daemon gracefully.
+func Shutdown(p *zinc.Peer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	return p.Shutdown(ctx)
+}
+
+// HandleShutdown calls shutdown on SIGINT and SIGTERM and reload on SIGHUP.
+// The process ends right away on a second SIGINT or SIGTERM.
+func HandleShutdown(shutdown func(), reload func()) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
-	for {
-		sign := <-signals
-		sig, ok := sign.(syscall.Signal)
-		if !ok {
-			log.Fatal(sign.String() + "not a posix signal")
-		}
-		switch sig {
+	stopping := false
+	for sign := range signals {
+		switch sign {
 		case syscall.SIGINT, syscall.SIGTERM:
-			// end the process
-			log.Printf("recieved signal '%s'", sign.String())
-			donec := make(chan bool)
-			go func() {
-				c := <-cl
-				if err := c.Close(); err != nil {
-					log.Fatalf("error shutting down: %s", err.Error())
-				}
-				donec <- true
-			}()
-			select {
-			case <-donec:
-				os.Exit(0)
-			case <-time.After(3 * time.Second):
-				log.Fatal("timeout shutting down")
+			if stopping {
+				log.Fatalf("recieved signal '%s' while shutting down, exiting", sign)
 			}
+			stopping = true
+			log.Printf("recieved signal '%s', shutting down", sign)
+			go shutdown()
 		case syscall.SIGHUP:
-			// restart
-			log.Println("restarting process...")
-			continue
-		default:
-			// unexpected something
-			log.Fatalf("unexpected signal '%s'", sign.String())
+			log.Println("reloading config...")
+			if reload != nil {
+				reload()
+			}
 		}
 	}
 }
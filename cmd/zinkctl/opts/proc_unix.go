@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package opts
+
+import (
+	"errors"
+	"syscall"
+)
+
+// noFollow keeps the pid file from being opened through a symbolic link.
+const noFollow = syscall.O_NOFOLLOW
+
+// processRunning reports whether the process with the given pid exists.
+func processRunning(pid int) bool {
+	// signal 0 checks that the process exists without disturbing it.
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Terminate asks the process with the given pid to stop.
+func Terminate(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// Exec replaces the running process with a new run of exe, keeping its pid.
+func Exec(exe string, args, env []string) error {
+	return syscall.Exec(exe, args, env)
+}
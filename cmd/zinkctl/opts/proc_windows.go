@@ -0,0 +1,34 @@
+package opts
+
+import (
+	"errors"
+	"os"
+)
+
+var errUnsupported = errors.New("not supported on windows")
+
+// noFollow keeps the pid file from being opened through a symbolic link,
+// O_EXCL already does on windows.
+const noFollow = 0
+
+// processRunning reports whether the process with the given pid exists.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// Terminate asks the process with the given pid to stop, the zinc daemon is
+// only stopped through its control socket on windows.
+func Terminate(pid int) error {
+	return errUnsupported
+}
+
+// Exec replaces the running process with a new run of exe, which windows
+// can't do.
+func Exec(exe string, args, env []string) error {
+	return errUnsupported
+}
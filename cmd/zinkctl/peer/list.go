@@ -1,34 +1,148 @@
 package peer
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Joe-Degs/zinc"
+	"github.com/Joe-Degs/zinc/internal/registry"
 )
 
 // peer subcommand of the list command LOL!
+// list shows the peers the local zinc daemon knows of. The registry of the
+// daemon is read directly when the daemon is not running.
 type list struct {
-	FromRegistry bool `short:"r" long:"from-registry" description:"load peer spec from registry"`
+	FromRegistry bool   `short:"r" long:"from-registry" description:"load peer spec from registry"`
+	Registry     string `long:"registry" description:"path of the peer registry"`
+	Status       string `short:"s" long:"status" description:"only list peers with status ACTIVE or INACTIVE"`
+	JSON         bool   `long:"json" description:"print the peers as json"`
 }
 
 func (l list) Help() string {
 	help := `
 Usage: zinkctl [global options] peer list <options>
- 
+
  help
 
 Options:
--p --port:			port peer server should listen on
--n --name:			name of a zinc peer
--i --id:            id of a zinc peer
+-n --name:          only list peers with this name
+-i --id:            only list peers whose id starts with this
+-s --status:        only list ACTIVE or INACTIVE peers
+-c --control:       control socket of the zinc daemon
 -r --from-registry: read peer spec from registry
+--registry:         path of the peer registry
+--json:             print the peers as json
 	`
 	return strings.TrimSpace(help)
 }
 
+// listTimeout is how long to wait for the daemon to check on its peers.
+const listTimeout = 10 * time.Second
+
 func (l list) Execute(args []string) error {
 	l.help(args)
-	return nil
+
+	var peers []zinc.PeerStatus
+	var err error
+	if !l.FromRegistry {
+		peers, err = l.fromDaemon()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not reach the zinc daemon, reading the registry: %v\n", err)
+		}
+	}
+	if l.FromRegistry || err != nil {
+		if peers, err = l.fromRegistry(); err != nil {
+			return err
+		}
+	}
+
+	peers = l.filter(peers)
+	if l.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(peers)
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 8, 8, 2, '\t', 0)
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t", "Name", "ID", "Address", "Status", "Last Seen", "RTT")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t", "----", "--", "-------", "------", "---------", "---")
+	for _, p := range peers {
+		lastSeen, rtt := "never", "-"
+		if !p.LastSeen.IsZero() {
+			lastSeen = p.LastSeen.Format(time.RFC3339)
+		}
+		if p.RTT > 0 {
+			rtt = p.RTT.Round(time.Microsecond).String()
+		}
+		fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t", p.Name, p.Id, p.Addr, p.Status, lastSeen, rtt)
+	}
+	fmt.Fprintln(w, "")
+	return w.Flush()
+}
+
+// fromDaemon asks the running daemon for its peers.
+func (l list) fromDaemon() ([]zinc.PeerStatus, error) {
+	packet, err := controlRequest(zinc.NewPacket(zinc.ListPeers, nil, nil), listTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var peers []zinc.PeerStatus
+	if err := json.Unmarshal(packet.Data(), &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// fromRegistry reads the peers from the registry, their status is the one
+// last recorded by the daemon.
+func (l list) fromRegistry() ([]zinc.PeerStatus, error) {
+	reg, err := registry.Open(l.Registry)
+	if err != nil {
+		return nil, err
+	}
+	records, err := reg.List()
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]zinc.PeerStatus, len(records))
+	for i, r := range records {
+		peers[i] = zinc.PeerStatus{
+			Id:       r.Id,
+			Name:     r.Name,
+			Status:   zinc.INACTIVE.String(),
+			LastSeen: r.LastSeen,
+		}
+		if r.Status == registry.Active {
+			peers[i].Status = zinc.ACTIVE.String()
+		}
+		if len(r.Addrs) > 0 {
+			peers[i].Addr = r.Addrs[0]
+		}
+	}
+	return peers, nil
+}
+
+// filter drops the peers that don't match the name, id and status options.
+func (l list) filter(peers []zinc.PeerStatus) []zinc.PeerStatus {
+	filtered := []zinc.PeerStatus{}
+	for _, p := range peers {
+		if options.Name != "" && p.Name != options.Name {
+			continue
+		}
+		if options.Id != "" && !strings.HasPrefix(p.Id, options.Id) {
+			continue
+		}
+		if l.Status != "" && !strings.EqualFold(p.Status, l.Status) {
+			continue
+		}
+		filtered = append(filtered, p)
+	}
+	return filtered
 }
 
 func (l list) help(args []string) {
@@ -41,11 +155,11 @@ func (l list) help(args []string) {
 }
 
 func (l list) Synopsis() string {
-	return "list a zinc Peer Server"
+	return "list the peers known to the zinc daemon"
 }
 
 var l list
 
 func init() {
-	peerParser.AddCommand("list", s.Synopsis(), s.Help(), &l)
+	peerParser.AddCommand("list", l.Synopsis(), l.Help(), &l)
 }
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/Joe-Degs/zinc"
 	"github.com/Joe-Degs/zinc/cmd/zinkctl/opts"
 	"github.com/jessevdk/go-flags"
 )
@@ -15,7 +17,7 @@ func (Peer) Help() string {
 	return strings.TrimSpace(`
 Usage: zinkctl [global options] peer
 
- start, stop, list, delete peers
+ start, stop, restart, status, list and ping peers and manage their transfers
 		`)
 }
 
@@ -41,3 +43,9 @@ func printErr(err interface{}) {
 func (Peer) Synopsis() string {
 	return "Peer management"
 }
+
+// controlRequest sends packet to the local zinc daemon through its control
+// socket and returns the response.
+func controlRequest(packet zinc.Packet, timeout time.Duration) (zinc.Packet, error) {
+	return options.ControlRequest(packet, timeout)
+}
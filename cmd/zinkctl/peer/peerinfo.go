@@ -1,12 +1,13 @@
 package peer
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/Joe-Degs/zinc"
-	"github.com/Joe-Degs/zinc/internal/netutil"
 )
 
 // peerinfo subcommand of the peer command LOL!
@@ -24,6 +25,8 @@ Options:
 -p --port:			port peer server should peerinfoen on
 -n --name:			name of a zinc peer
 -i --id:            id of a zinc peer
+-a --addr:          get information on a remote peer over the network
+-c --control:       control socket of the zinc daemon
 -r --from-registry: read peer spec from registry
 	`
 	return strings.TrimSpace(help)
@@ -31,18 +34,26 @@ Options:
 
 func (l peerinfo) Execute(args []string) error {
 	l.help(args)
-	conn, err := netutil.TryConnect("localhost:11121", 1000)
+
+	var packet zinc.Packet
+	var err error
+	if options.Addr != "" {
+		packet, err = pingRemote(options.Addr)
+	} else {
+		packet, err = controlRequest(zinc.NewPacket(zinc.Ping, nil, nil), 0)
+	}
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return err
 	}
-	defer conn.Close()
-	// a peerinfo request packet
-	packet := []byte{byte(zinc.PeerInfo), 0xf}
-	if _, err := conn.Write(packet); err != nil {
-		zinc.ZErrorf("could not write peerinfo packet: %v", err)
-		os.Exit(1)
+	if packet.Type() != zinc.PeerInfo {
+		return fmt.Errorf("unexpected %s response from peer", packet.Type())
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, packet.Data(), "", "  "); err != nil {
+		return err
 	}
+	fmt.Println(buf.String())
 	return nil
 }
 
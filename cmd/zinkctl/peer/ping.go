@@ -1,6 +1,7 @@
 package peer
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -8,10 +9,10 @@ import (
 	"os"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/Joe-Degs/zinc"
-	"github.com/Joe-Degs/zinc/internal/netutil"
-	"github.com/Joe-Degs/zinc/internal/pool"
+	"github.com/google/uuid"
 )
 
 // ping subcommand of the peer command LOL!
@@ -27,42 +28,60 @@ Options:
 -p --port:			port peer server should pingen on
 -n --name:			name of a zinc peer
 -i --id:            id of a zinc peer
+-a --addr:          ping a remote peer over the network
+-c --control:       control socket of the zinc daemon
 -r --from-registry: read peer spec from registry
 	`
 	return strings.TrimSpace(help)
 }
 
-func sendPingPacket(conn *net.UDPConn) error {
-	packet := []byte{byte(zinc.Ping)}
-	if _, err := conn.Write(packet); err != nil {
-		return err
-	}
-	return nil
-}
+// pingTimeout is how long to wait for a remote peer to respond to a ping.
+const pingTimeout = 3 * time.Second
 
-func (l ping) Execute(args []string) error {
-	l.help(args)
-
-	addr := fmt.Sprintf("localhost:%s", options.Port)
-	conn, err := netutil.Connect(addr)
+// pingRemote pings the peer listening on addr over the network. The peer info
+// in the response is turned into json like the responses of the control
+// socket.
+func pingRemote(addr string) (zinc.Packet, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
-		return fmt.Errorf("ping: %w", err)
+		return nil, fmt.Errorf("ping: %w", err)
 	}
-	defer conn.Close()
-
-	if err := sendPingPacket(conn); err != nil {
-		zinc.ZErrorf("could not write ping packet: %v", err)
+	pier, err := zinc.PeerFromSpec("zinkctl", "0.0.0.0:0", uuid.New())
+	if err != nil {
+		return nil, fmt.Errorf("ping: %w", err)
 	}
+	if _, err := pier.StartServer(); err != nil {
+		return nil, fmt.Errorf("ping: %w", err)
+	}
+	defer pier.Shutdown(context.Background())
 
-	buffer := pool.GetBufferSized(100)
-	defer pool.PutBuffer(buffer)
-	buf := buffer.Bytes()
-	n, err := conn.Read(buf)
+	ctx, done := context.WithTimeout(context.Background(), pingTimeout)
+	defer done()
+	resp, err := pier.Request(ctx, zinc.NewPacket(zinc.Ping, nil, raddr))
+	if err != nil || resp.Type() != zinc.PeerInfo {
+		return resp, err
+	}
+	var info zinc.Peer
+	if err := info.UnmarshalBinary(resp.Data()); err != nil {
+		return nil, fmt.Errorf("ping: %w", err)
+	}
+	data, err := info.MarshalJSON()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return zinc.NewPacket(zinc.PeerInfo, data, resp.Addr()), nil
+}
 
-	packet, err := zinc.UnmarshalPacket(buf[:n])
+func (l ping) Execute(args []string) error {
+	l.help(args)
+
+	var packet zinc.Packet
+	var err error
+	if options.Addr != "" {
+		packet, err = pingRemote(options.Addr)
+	} else {
+		packet, err = controlRequest(zinc.NewPacket(zinc.Ping, nil, nil), 0)
+	}
 	if err != nil {
 		return err
 	}
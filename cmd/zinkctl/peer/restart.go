@@ -0,0 +1,73 @@
+package peer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Joe-Degs/zinc"
+)
+
+// restart subcommand of the peer command LOL!
+// restart asks the local zinc daemon to finish its transfers and start again.
+type restart struct {
+	Drain time.Duration `long:"drain" default:"30s" description:"how long to wait for transfers in flight"`
+}
+
+func (rs restart) Help() string {
+	help := `
+Usage: zinkctl [global options] peer restart <options>
+
+ help
+
+Options:
+-c --control:       control socket of the zinc daemon
+--drain:            how long to wait for transfers in flight (default 30s)
+	`
+	return strings.TrimSpace(help)
+}
+
+// restartTimeout is how long to wait for the daemon to come back up.
+const restartTimeout = 10 * time.Second
+
+func (rs restart) Execute(args []string) error {
+	rs.help(args)
+	report, err := shutdown(zinc.ShutdownRequest{Drain: rs.Drain, Restart: true})
+	if err != nil {
+		return err
+	}
+	printAbandoned(report)
+
+	deadline := time.Now().Add(restartTimeout)
+	for {
+		_, err := controlRequest(zinc.NewPacket(zinc.Ping, nil, nil), time.Second)
+		if err == nil {
+			fmt.Println("zinc daemon restarted")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("zinc daemon did not come back up: %w", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (rs restart) help(args []string) {
+	for _, v := range args {
+		if v == "help" {
+			fmt.Println(rs.Help())
+			os.Exit(0)
+		}
+	}
+}
+
+func (rs restart) Synopsis() string {
+	return "restart the zinc daemon"
+}
+
+var rs restart
+
+func init() {
+	peerParser.AddCommand("restart", rs.Synopsis(), rs.Help(), &rs)
+}
@@ -0,0 +1,89 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Joe-Degs/zinc"
+)
+
+// send subcommand of the peer command LOL!
+// send asks the local zinc daemon to send a file to a remote peer.
+type send struct {
+	NoMetadata bool `long:"no-metadata" description:"send just the content of the file"`
+}
+
+func (sd send) Help() string {
+	help := `
+Usage: zinkctl [global options] peer send <options> <file>
+ 
+ help
+
+Options:
+-a --addr:          address of the peer to send the file to
+-c --control:       control socket of the zinc daemon
+--no-metadata:      send just the content of the file
+	`
+	return strings.TrimSpace(help)
+}
+
+func (sd send) Execute(args []string) error {
+	sd.help(args)
+	if len(args) != 1 {
+		return fmt.Errorf("send: expected a single file, got %d", len(args))
+	}
+	if options.Addr == "" {
+		return fmt.Errorf("send: specify the address of the peer with --addr")
+	}
+
+	// the daemon opens the file so it needs the full path to it.
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(zinc.SendFileRequest{
+		Path:       path,
+		Addr:       options.Addr,
+		NoMetadata: sd.NoMetadata,
+	})
+	if err != nil {
+		return err
+	}
+	packet, err := controlRequest(zinc.NewPacket(zinc.SendFile, data, nil), time.Hour)
+	if err != nil {
+		return err
+	}
+
+	var report zinc.TransferReport
+	if err := json.Unmarshal(packet.Data(), &report); err != nil {
+		return err
+	}
+	fmt.Printf("sent %s (%d bytes) to %s\n", report.Name, report.Size, options.Addr)
+	for _, attr := range report.Unapplied {
+		fmt.Fprintf(os.Stderr, "could not apply %s\n", attr)
+	}
+	return nil
+}
+
+func (sd send) help(args []string) {
+	for _, v := range args {
+		if v == "help" {
+			fmt.Println(sd.Help())
+			os.Exit(0)
+		}
+	}
+}
+
+func (sd send) Synopsis() string {
+	return "send a file to a zinc Peer"
+}
+
+var sd send
+
+func init() {
+	peerParser.AddCommand("send", sd.Synopsis(), sd.Help(), &sd)
+}
@@ -2,13 +2,13 @@ package peer
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"strings"
 
 	"github.com/Joe-Degs/zinc"
 	"github.com/Joe-Degs/zinc/cmd/zinkctl/opts"
 	"github.com/Joe-Degs/zinc/internal/config"
+	"github.com/Joe-Degs/zinc/internal/registry"
 )
 
 // peer subcommand of the start command LOL!
@@ -21,42 +21,76 @@ Usage: zinkctl [global options] peer start <options>
  help
 
 Options:
--p --port:			port peer server should listen on
--n --name:			name of a zinc peer
--i --id:            id of a zinc peer`
+--config:          config file of the peer
+-p --port:          port peer server should listen on
+-n --name:          name of a zinc peer
+-i --id:            id of a zinc peer
+-c --control:       control socket local tools manage the peer through
+--pidfile:          file the pid of the peer is written to`
 	return strings.TrimSpace(help)
 }
 
 func (s start) Execute(args []string) error {
 	s.help(args)
 
-	// addr := fmt.Sprintf("127.0.0.1:%s", options.Port)
-	// zinc.ZPrintf("address to start peer on: %s", addr)
-	// pier, err := zinc.PeerFromSpec(options.Name, addr, uuid.New())
-	conf, err := config.DefaultPeerConfig()
+	conf, err := loadConfig()
 	if err != nil {
 		return fmt.Errorf("error loading configs: %w", err)
 	}
+	if err := opts.WritePidFile(options.PidPath()); err != nil {
+		return fmt.Errorf("could not start peer: %w", err)
+	}
 	pier, err := zinc.NewPeer(conf)
 	if err != nil {
+		os.Remove(options.PidPath())
 		return fmt.Errorf("could not start peer: %w", err)
 	}
-	cl := make(chan io.Closer)
-	cancel, err := pier.StartServer(cl)
-	if err != nil {
-		if cancel != nil {
-			cancel()
-		}
+	if _, err := pier.StartServer(); err != nil {
+		os.Remove(options.PidPath())
 		return fmt.Errorf("could not start peer: %w", err)
 	}
-	started := true
-	go opts.HandleShutdown(cl)
-	if started {
-		select {}
+	go opts.HandleShutdown(func() { opts.Shutdown(pier) }, func() {
+		conf, err := loadConfig()
+		if err != nil {
+			opts.LogChanges(nil, err)
+			return
+		}
+		opts.LogChanges(pier.Reload(conf))
+	})
+	<-pier.Done()
+	if err := opts.Shutdown(pier); err != nil {
+		pier.Logger().Warn("shutdown cut short", zinc.F("error", err))
+	}
+
+	if pier.RestartRequested() {
+		// the new process keeps the pid so the pid file stays valid.
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("could not restart peer: %w", err)
+		}
+		pier.Logger().Info("restarting peer")
+		return opts.Exec(exe, os.Args, os.Environ())
 	}
+	os.Remove(options.PidPath())
 	return nil
 }
 
+// loadConfig loads the config of the peer. The control socket and registry
+// default to the ones the other commands look for.
+func loadConfig() (*config.PeerConfig, error) {
+	conf, err := options.Loader().LoadPeer()
+	if err != nil {
+		return nil, err
+	}
+	if conf.Control == "" {
+		conf.Control = options.ControlPath()
+	}
+	if conf.Registry == "" {
+		conf.Registry = registry.DefaultPath()
+	}
+	return conf, nil
+}
+
 func (s start) help(args []string) {
 	for _, v := range args {
 		if v == "help" {
@@ -0,0 +1,99 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Joe-Degs/zinc"
+	"github.com/Joe-Degs/zinc/cmd/zinkctl/opts"
+)
+
+// status subcommand of the peer command LOL!
+// status shows the state of the local zinc daemon.
+type status struct {
+	JSON bool `long:"json" description:"print the status as json"`
+}
+
+func (su status) Help() string {
+	help := `
+Usage: zinkctl [global options] peer status <options>
+
+ help
+
+Options:
+-c --control:       control socket of the zinc daemon
+--pidfile:          pid file of the zinc daemon
+--json:             print the status as json
+	`
+	return strings.TrimSpace(help)
+}
+
+func (su status) Execute(args []string) error {
+	su.help(args)
+	packet, err := controlRequest(zinc.NewPacket(zinc.Status, nil, nil), 0)
+	if err != nil {
+		if pid, perr := opts.ReadPidFile(options.PidPath()); perr == nil {
+			return fmt.Errorf("zinc daemon running with pid %d but its control socket is unreachable: %w", pid, err)
+		}
+		return fmt.Errorf("zinc daemon is not running: %w", err)
+	}
+	if su.JSON {
+		fmt.Println(string(packet.Data()))
+		return nil
+	}
+
+	var st zinc.DaemonStatus
+	if err := json.Unmarshal(packet.Data(), &st); err != nil {
+		return err
+	}
+	fmt.Printf("Name:      %s\n", st.Name)
+	fmt.Printf("ID:        %s\n", st.Id)
+	fmt.Printf("Address:   %s\n", st.Addr)
+	fmt.Printf("Pid:       %d\n", st.Pid)
+	fmt.Printf("Uptime:    %s (since %s)\n", st.Uptime.Round(time.Second), st.Started.Format(time.RFC3339))
+	fmt.Printf("Handlers:  %s\n", strings.Join(st.Handlers, ", "))
+	wk := st.Workers
+	fmt.Printf("Workers:   %d running of %d, %d of %d queued, %d served, %d dropped\n",
+		wk.Running, wk.Workers, wk.Queued, wk.QueueSize, wk.Served, wk.Dropped)
+	if len(st.Transfers) == 0 {
+		fmt.Println("Transfers: none")
+		return nil
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 8, 8, 2, '\t', 0)
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "Name", "Peer", "Direction", "Size", "Recieved")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", "----", "----", "---------", "----", "--------")
+	for _, t := range st.Transfers {
+		recieved := "-"
+		if t.Direction == "recieve" {
+			recieved = fmt.Sprint(t.Recieved)
+		}
+		fmt.Fprintf(w, "\n %s\t%s\t%s\t%d\t%s\t", t.Name, t.Peer, t.Direction, t.Size, recieved)
+	}
+	fmt.Fprintln(w, "")
+	return w.Flush()
+}
+
+func (su status) help(args []string) {
+	for _, v := range args {
+		if v == "help" {
+			fmt.Println(su.Help())
+			os.Exit(0)
+		}
+	}
+}
+
+func (su status) Synopsis() string {
+	return "show the state of the zinc daemon"
+}
+
+var su status
+
+func init() {
+	peerParser.AddCommand("status", su.Synopsis(), su.Help(), &su)
+}
@@ -0,0 +1,99 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Joe-Degs/zinc"
+	"github.com/Joe-Degs/zinc/cmd/zinkctl/opts"
+)
+
+// stop subcommand of the peer command LOL!
+// stop asks the local zinc daemon to finish its transfers and stop.
+type stop struct {
+	Drain time.Duration `long:"drain" default:"30s" description:"how long to wait for transfers in flight"`
+}
+
+func (st stop) Help() string {
+	help := `
+Usage: zinkctl [global options] peer stop <options>
+
+ help
+
+Options:
+-c --control:       control socket of the zinc daemon
+--pidfile:          pid file of the zinc daemon
+--drain:            how long to wait for transfers in flight (default 30s)
+	`
+	return strings.TrimSpace(help)
+}
+
+func (st stop) Execute(args []string) error {
+	st.help(args)
+	report, err := shutdown(zinc.ShutdownRequest{Drain: st.Drain})
+	if err == nil {
+		fmt.Println("zinc daemon stopped")
+		printAbandoned(report)
+		return nil
+	}
+
+	// the daemon may have failed to stop on its own, it is only signalled
+	// once it is known to be the process in the pid file.
+	pid, perr := opts.ReadPidFile(options.PidPath())
+	if perr != nil {
+		return fmt.Errorf("zinc daemon is not running: %w", err)
+	}
+	if cerr := options.CheckDaemon(pid); cerr != nil {
+		return fmt.Errorf("stopping zinc daemon: %v, not signalling: %w", err, cerr)
+	}
+	fmt.Fprintf(os.Stderr, "stopping through the control socket failed, sending SIGTERM to pid %d: %v\n", pid, err)
+	return opts.Terminate(pid)
+}
+
+// shutdown sends r to the daemon and waits for it to stop.
+func shutdown(r zinc.ShutdownRequest) (*zinc.ShutdownReport, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	// the daemon responds after it is done draining its transfers.
+	packet, err := controlRequest(zinc.NewPacket(zinc.Shutdown, data, nil), r.Drain+5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	var report zinc.ShutdownReport
+	if len(packet.Data()) > 0 {
+		if err := json.Unmarshal(packet.Data(), &report); err != nil {
+			return nil, err
+		}
+	}
+	return &report, nil
+}
+
+func printAbandoned(report *zinc.ShutdownReport) {
+	if report.Abandoned > 0 {
+		fmt.Fprintf(os.Stderr, "%d transfers did not finish in time\n", report.Abandoned)
+	}
+}
+
+func (st stop) help(args []string) {
+	for _, v := range args {
+		if v == "help" {
+			fmt.Println(st.Help())
+			os.Exit(0)
+		}
+	}
+}
+
+func (st stop) Synopsis() string {
+	return "stop the zinc daemon"
+}
+
+var st stop
+
+func init() {
+	peerParser.AddCommand("stop", st.Synopsis(), st.Help(), &st)
+}
@@ -0,0 +1,130 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Joe-Degs/zinc"
+)
+
+// transfers subcommand of the peer command LOL!
+// transfers lists the transfers of the local zinc daemon, the interrupted ones
+// included, and resumes or cancels them.
+type transfers struct {
+	JSON bool `long:"json" description:"print the transfers as json"`
+}
+
+func (tr transfers) Help() string {
+	help := `
+Usage: zinkctl [global options] peer transfers <options> [list | resume <id> | cancel <id>]
+
+ help
+
+ list:              list the transfers, the interrupted ones included
+ resume <id>:       resume an interrupted transfer of a file being sent
+ cancel <id>:       stop a transfer and throw away what was recieved
+
+Options:
+-c --control:       control socket of the zinc daemon
+--json:             print the transfers as json
+	`
+	return strings.TrimSpace(help)
+}
+
+func (tr transfers) Execute(args []string) error {
+	tr.help(args)
+	if len(args) == 0 || args[0] == "list" {
+		return tr.list()
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("transfers: %s takes the id of a single transfer", args[0])
+	}
+	id, err := zinc.ParseTransferId(args[1])
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(zinc.TransferRequest{Id: id})
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "resume":
+		packet, err := controlRequest(zinc.NewPacket(zinc.ResumeTransfer, data, nil), time.Hour)
+		if err != nil {
+			return err
+		}
+		var report zinc.TransferReport
+		if err := json.Unmarshal(packet.Data(), &report); err != nil {
+			return err
+		}
+		fmt.Printf("sent %s (%d bytes)\n", report.Name, report.Size)
+		for _, attr := range report.Unapplied {
+			fmt.Fprintf(os.Stderr, "could not apply %s\n", attr)
+		}
+	case "cancel":
+		if _, err := controlRequest(zinc.NewPacket(zinc.CancelTransfer, data, nil), 0); err != nil {
+			return err
+		}
+		fmt.Printf("cancelled transfer %016x\n", id)
+	default:
+		return fmt.Errorf("transfers: unknown action %q, want list, resume or cancel", args[0])
+	}
+	return nil
+}
+
+func (tr transfers) list() error {
+	packet, err := controlRequest(zinc.NewPacket(zinc.Transfers, nil, nil), 0)
+	if err != nil {
+		return err
+	}
+	if tr.JSON {
+		fmt.Println(string(packet.Data()))
+		return nil
+	}
+	var list []zinc.TransferStatus
+	if err := json.Unmarshal(packet.Data(), &list); err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Println("no transfers")
+		return nil
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 8, 8, 2, '\t', 0)
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t%s\t", "ID", "Name", "Peer", "Direction", "State", "Size", "Recieved")
+	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t%s\t", "--", "----", "----", "---------", "-----", "----", "--------")
+	for _, t := range list {
+		recieved := "-"
+		if t.Direction == "recieve" {
+			recieved = fmt.Sprint(t.Recieved)
+		}
+		fmt.Fprintf(w, "\n %016x\t%s\t%s\t%s\t%s\t%d\t%s\t", t.Id, t.Name, t.Peer, t.Direction, t.State, t.Size, recieved)
+	}
+	fmt.Fprintln(w, "")
+	return w.Flush()
+}
+
+func (tr transfers) help(args []string) {
+	for _, v := range args {
+		if v == "help" {
+			fmt.Println(tr.Help())
+			os.Exit(0)
+		}
+	}
+}
+
+func (tr transfers) Synopsis() string {
+	return "list, resume and cancel the transfers of the zinc daemon"
+}
+
+var tr transfers
+
+func init() {
+	peerParser.AddCommand("transfers", tr.Synopsis(), tr.Help(), &tr)
+}
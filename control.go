@@ -0,0 +1,518 @@
+package zinc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Joe-Degs/zinc/internal/pool"
+)
+
+// The control socket is a unix datagram socket that local tools use to manage
+// a running peer. Packets on the control socket are marshaled just like the
+// packets peers send to each other, but they are handled by a separate set of
+// handlers so administrative requests are never served over the network.
+// Access to the control socket is controlled by the permissions of the socket
+// file and of the directory it is in.
+
+// DefaultControlPath is where the control socket of a peer is created when
+// no other path is configured, in the runtime directory of the user.
+var DefaultControlPath = filepath.Join(RuntimeDir(), "zinc.sock")
+
+// RuntimeDir returns the directory the control sockets and pid files of the
+// user go in, $XDG_RUNTIME_DIR or a directory of the user's own in the
+// temporary directory of the system when it is not set.
+func RuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return userTempDir()
+}
+
+// userTempDir is the directory of the user in the temporary directory of the
+// system. Anyone can create files there, so it is checked before it is used.
+func userTempDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("zinc-%d", os.Getuid()))
+}
+
+// PrivateDir makes sure the directory a socket or file at path goes in is
+// only open to the user when it is the directory of the user in the temporary
+// directory of the system, creating it if needed.
+func PrivateDir(path string) error {
+	dir := filepath.Dir(path)
+	if dir != userTempDir() {
+		return nil
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() || info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is not a directory only its owner can use", dir)
+	}
+	if uid, ok := fileOwner(info); ok && uid != os.Getuid() {
+		return fmt.Errorf("%s belongs to another user", dir)
+	}
+	return nil
+}
+
+const (
+	// controlPerm restricts the control socket to its owner and group.
+	controlPerm = 0660
+
+	// controlTimeout is how long a ControlClient waits for a response.
+	controlTimeout = 5 * time.Second
+
+	// listProbeTimeout is how long the peers in a listing get to respond
+	// to the ping that checks on them.
+	listProbeTimeout = time.Second
+
+	// defaultDrainTimeout is how long a stopping peer waits for its
+	// transfers to finish unless it is told otherwise.
+	defaultDrainTimeout = 30 * time.Second
+)
+
+// ControlHandlerFunc handles a request that came in through the control
+// socket and returns the response to send back to the requester. The context
+// is done when the peer stops serving.
+type ControlHandlerFunc func(context.Context, Packet) Packet
+
+// PeerStatus is what a peer knows about another peer. The RTT is that of the
+// ping sent to check on the peer, it is zero for peers that did not respond.
+type PeerStatus struct {
+	Id       string        `json:"id"`
+	Name     string        `json:"name,omitempty"`
+	Addr     string        `json:"addr,omitempty"`
+	Status   string        `json:"status"`
+	State    string        `json:"state,omitempty"`
+	LastSeen time.Time     `json:"last_seen"`
+	RTT      time.Duration `json:"rtt,omitempty"`
+}
+
+// ShutdownRequest asks a peer to stop once its transfers in flight are done
+// or Drain runs out. A peer asked to restart starts again after it stops.
+type ShutdownRequest struct {
+	Drain   time.Duration `json:"drain,omitempty"`
+	Restart bool          `json:"restart,omitempty"`
+}
+
+// ShutdownReport is the response to a ShutdownRequest.
+type ShutdownReport struct {
+	// Abandoned is the number of transfers that were still in flight when
+	// the peer stopped.
+	Abandoned int `json:"abandoned"`
+}
+
+// DaemonStatus is the state of a running peer.
+type DaemonStatus struct {
+	Id        string           `json:"id"`
+	Name      string           `json:"name,omitempty"`
+	Addr      string           `json:"addr"`
+	Pid       int              `json:"pid"`
+	Started   time.Time        `json:"started"`
+	Uptime    time.Duration    `json:"uptime"`
+	Handlers  []string         `json:"handlers"`
+	Transfers []TransferStatus `json:"transfers"`
+	Workers   WorkerStats      `json:"workers"`
+}
+
+// SendFileRequest asks a peer to send one of its files to another peer.
+type SendFileRequest struct {
+	Path       string `json:"path"`
+	Addr       string `json:"addr"`
+	NoMetadata bool   `json:"no_metadata,omitempty"`
+}
+
+// TransferRequest asks a peer to resume or cancel one of its transfers.
+type TransferRequest struct {
+	Id uint64 `json:"id"`
+}
+
+func (p *Peer) initControlHandlers() {
+	p.control[Ping] = p.controlPingHandler
+	p.control[SendFile] = p.controlSendFileHandler
+	p.control[Shutdown] = p.controlShutdownHandler
+	p.control[ListPeers] = p.controlListPeersHandler
+	p.control[Status] = p.controlStatusHandler
+	p.control[Transfers] = p.controlTransfersHandler
+	p.control[ResumeTransfer] = p.controlResumeTransferHandler
+	p.control[CancelTransfer] = p.controlCancelTransferHandler
+}
+
+// listenControl opens the control socket at p.ControlPath. A socket file left
+// behind by a peer that did not shut down cleanly is replaced, but a socket
+// some other process is still listening on is left alone.
+func (p *Peer) listenControl() (*net.UnixConn, error) {
+	path := p.ControlPath
+	if err := PrivateDir(path); err != nil {
+		return nil, fmt.Errorf("control socket %s: %w", path, err)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("control socket %s: file exists", path)
+		}
+		if c, err := net.Dial("unixgram", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("control socket %s: in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, controlPerm); err != nil {
+		conn.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// serveControl reads requests from the control socket until ctx is done or
+// the peer is stopped. Requests being handled when the peer stops still get
+// their responses. closed is closed once the socket is.
+func (p *Peer) serveControl(ctx context.Context, conn *net.UnixConn, closed chan<- struct{}) {
+	// requests hold a read lock while they are handled.
+	var inflight sync.RWMutex
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-p.done:
+		}
+		inflight.Lock()
+		conn.Close()
+		inflight.Unlock()
+		os.Remove(p.ControlPath)
+		close(closed)
+	}()
+
+	p.Logger().Info("control socket open", F("path", p.ControlPath))
+	for {
+		buffer := pool.GetBufferSized(maxDatagramSize)
+		buf := buffer.Bytes()
+		n, raddr, err := conn.ReadFromUnix(buf)
+		if err != nil {
+			pool.PutBuffer(buffer)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.Logger().Error("control socket", F("error", err))
+			continue
+		}
+		if raddr == nil {
+			// there is no way to respond to unbound sockets.
+			pool.PutBuffer(buffer)
+			continue
+		}
+		req, err := UnmarshalPacket(append(make([]byte, 0, n), buf[:n]...))
+		pool.PutBuffer(buffer)
+		if err != nil {
+			p.Logger().Warn("invalid control request", F("remote_addr", raddr), F("error", err))
+			continue
+		}
+
+		inflight.RLock()
+		go func(req Packet, raddr *net.UnixAddr) {
+			defer inflight.RUnlock()
+			var resp Packet
+			if f, ok := p.control[req.Type()]; ok {
+				resp = f(ctx, req)
+			} else {
+				resp = responseTo(req, Error, []byte(fmt.Sprintf("unknown control request %s", req.Type())))
+			}
+			b, err := MarshalPacket(resp)
+			if err == nil {
+				_, err = conn.WriteToUnix(b, raddr)
+			}
+			if err != nil {
+				p.Logger().Error("failed to respond to control request", F("remote_addr", raddr), F("error", err))
+			}
+		}(req, raddr)
+	}
+}
+
+// stop signals everyone waiting on Done that the peer has been asked to stop,
+// and to start again if restart is set.
+func (p *Peer) stop(restart bool) {
+	p.stopOnce.Do(func() {
+		*p.restart = restart
+		close(p.done)
+	})
+}
+
+// Done returns a channel that is closed when the peer is asked to stop
+// through its control socket.
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+// RestartRequested reports whether the peer was asked to start again after
+// it stopped. It is only meaningful once Done is closed.
+func (p *Peer) RestartRequested() bool {
+	select {
+	case <-p.done:
+		return *p.restart
+	default:
+		return false
+	}
+}
+
+// controlError responds to req with err.
+func controlError(req Packet, err error) Packet {
+	return responseTo(req, Error, []byte(err.Error()))
+}
+
+// responds to pings with the state of the peer
+func (p *Peer) controlPingHandler(_ context.Context, req Packet) Packet {
+	data, err := p.info(p.MarshalJSON)
+	if err != nil {
+		return controlError(req, err)
+	}
+	return responseTo(req, PeerInfo, data)
+}
+
+// sends a file to another peer and responds with the report of the transfer
+func (p *Peer) controlSendFileHandler(ctx context.Context, req Packet) Packet {
+	var r SendFileRequest
+	if err := json.Unmarshal(req.Data(), &r); err != nil {
+		return controlError(req, fmt.Errorf("invalid send file request: %w", err))
+	}
+	addr, err := net.ResolveUDPAddr("udp", r.Addr)
+	if err != nil {
+		return controlError(req, err)
+	}
+	report, err := p.SendFile(ctx, r.Path, addr, &TransferOptions{NoMetadata: r.NoMetadata})
+	if err != nil {
+		return controlError(req, err)
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return controlError(req, err)
+	}
+	return responseTo(req, Ok, data)
+}
+
+// responds with the peers in the registry, each of them is pinged to find out
+// if it is still around
+func (p *Peer) controlListPeersHandler(ctx context.Context, req Packet) Packet {
+	if p.registry == nil {
+		return controlError(req, errors.New("peer keeps no registry"))
+	}
+	records, err := p.registry.List()
+	if err != nil {
+		return controlError(req, err)
+	}
+
+	peers := make([]PeerStatus, len(records))
+	var wg sync.WaitGroup
+	for i, r := range records {
+		peers[i] = PeerStatus{
+			Id:       r.Id,
+			Name:     r.Name,
+			Status:   INACTIVE.String(),
+			LastSeen: r.LastSeen,
+		}
+		if len(r.Addrs) == 0 {
+			continue
+		}
+		peers[i].Addr = r.Addrs[0]
+		wg.Add(1)
+		go func(ps *PeerStatus) {
+			defer wg.Done()
+			addr, err := net.ResolveUDPAddr("udp", ps.Addr)
+			if err != nil {
+				return
+			}
+			ctx, cancel := context.WithTimeout(ctx, listProbeTimeout)
+			defer cancel()
+			start := time.Now()
+			if resp, err := p.Request(ctx, NewPacket(Ping, nil, addr)); err == nil && resp.Type() != Error {
+				ps.RTT = time.Since(start)
+				ps.Status = ACTIVE.String()
+				ps.LastSeen = time.Now()
+			}
+		}(&peers[i])
+	}
+	wg.Wait()
+
+	data, err := json.Marshal(peers)
+	if err != nil {
+		return controlError(req, err)
+	}
+	return responseTo(req, Ok, data)
+}
+
+// responds with the state of the running peer
+func (p *Peer) controlStatusHandler(_ context.Context, req Packet) Packet {
+	p.settings.RLock()
+	status := DaemonStatus{
+		Id:        p.Id.String(),
+		Name:      p.Name,
+		Addr:      p.LocalAddr.String(),
+		Pid:       os.Getpid(),
+		Started:   p.started,
+		Uptime:    time.Since(p.started),
+		Transfers: p.transfers.status(),
+		Workers:   p.WorkerStats(),
+	}
+	p.settings.RUnlock()
+	for _, typ := range p.router.types() {
+		status.Handlers = append(status.Handlers, typ.String())
+	}
+	sort.Strings(status.Handlers)
+	data, err := json.Marshal(status)
+	if err != nil {
+		return controlError(req, err)
+	}
+	return responseTo(req, Ok, data)
+}
+
+// responds with the transfers of the peer, the interrupted ones included
+func (p *Peer) controlTransfersHandler(_ context.Context, req Packet) Packet {
+	data, err := json.Marshal(p.Transfers())
+	if err != nil {
+		return controlError(req, err)
+	}
+	return responseTo(req, Ok, data)
+}
+
+// resumes an interrupted transfer and responds with its report
+func (p *Peer) controlResumeTransferHandler(ctx context.Context, req Packet) Packet {
+	var r TransferRequest
+	if err := json.Unmarshal(req.Data(), &r); err != nil {
+		return controlError(req, fmt.Errorf("invalid resume transfer request: %w", err))
+	}
+	report, err := p.ResumeTransfer(ctx, r.Id)
+	if err != nil {
+		return controlError(req, err)
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return controlError(req, err)
+	}
+	return responseTo(req, Ok, data)
+}
+
+// cancels a transfer
+func (p *Peer) controlCancelTransferHandler(_ context.Context, req Packet) Packet {
+	var r TransferRequest
+	if err := json.Unmarshal(req.Data(), &r); err != nil {
+		return controlError(req, fmt.Errorf("invalid cancel transfer request: %w", err))
+	}
+	if err := p.CancelTransfer(r.Id); err != nil {
+		return controlError(req, err)
+	}
+	return responseTo(req, Ok, nil)
+}
+
+// asks the peer to stop once its transfers are done
+func (p *Peer) controlShutdownHandler(ctx context.Context, req Packet) Packet {
+	r := ShutdownRequest{Drain: defaultDrainTimeout}
+	if len(req.Data()) > 0 {
+		if err := json.Unmarshal(req.Data(), &r); err != nil {
+			return controlError(req, fmt.Errorf("invalid shutdown request: %w", err))
+		}
+	}
+	p.Logger().Info("shutdown requested through control socket, draining transfers", F("drain", r.Drain))
+
+	ctx, cancel := context.WithTimeout(ctx, r.Drain)
+	defer cancel()
+	var report ShutdownReport
+	if err := p.transfers.drain(ctx); err != nil {
+		report.Abandoned = p.transfers.active()
+		p.Logger().Warn("stopping with transfers in flight", F("abandoned", report.Abandoned))
+	}
+	defer p.stop(r.Restart)
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return controlError(req, err)
+	}
+	return responseTo(req, Ok, data)
+}
+
+// A ControlClient sends requests to a peer through its control socket.
+type ControlClient struct {
+	conn  *net.UnixConn
+	raddr *net.UnixAddr
+	laddr string
+}
+
+// DialControl connects to the control socket at path. The client binds its
+// own socket in the runtime directory of the user to recieve responses on.
+func DialControl(path string) (*ControlClient, error) {
+	if path == "" {
+		path = DefaultControlPath
+	}
+	laddr := filepath.Join(RuntimeDir(), fmt.Sprintf("zinkctl-%d.sock", os.Getpid()))
+	if err := PrivateDir(laddr); err != nil {
+		return nil, err
+	}
+	os.Remove(laddr)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: laddr, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &ControlClient{
+		conn:  conn,
+		raddr: &net.UnixAddr{Name: path, Net: "unixgram"},
+		laddr: laddr,
+	}, nil
+}
+
+// Request sends packet to the peer and waits for its response. An Error
+// response is returned as a *ZinkError.
+func (c *ControlClient) Request(packet Packet, timeout time.Duration) (Packet, error) {
+	if timeout == 0 {
+		timeout = controlTimeout
+	}
+	req := &requestWrapper{typ: packet.Type(), id: newRequestId(), data: packet.Data()}
+	b, err := MarshalPacket(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.WriteToUnix(b, c.raddr); err != nil {
+		return nil, fmt.Errorf("is the zinc daemon running? %w", err)
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, _, err := c.conn.ReadFromUnix(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := UnmarshalPacket(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		if resp.Id() != req.id {
+			// a late response to an earlier request
+			continue
+		}
+		if resp.Type() == Error {
+			return nil, NewError(string(resp.Data()))
+		}
+		return resp, nil
+	}
+}
+
+// Close closes the client and removes its socket file.
+func (c *ControlClient) Close() error {
+	defer os.Remove(c.laddr)
+	return c.conn.Close()
+}
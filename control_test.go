@@ -0,0 +1,216 @@
+package zinc
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Joe-Degs/zinc/internal/registry"
+)
+
+func TestControlSocket(t *testing.T) {
+	p := RandomPeer("controlled")
+	p.ControlPath = filepath.Join(t.TempDir(), "zinc.sock")
+	cancel, err := p.StartServer()
+	if err != nil {
+		t.Fatalf("failed to start peer: %v", err)
+	}
+	defer func() {
+		cancel()
+		p.lstn.Close()
+	}()
+
+	client, err := DialControl(p.ControlPath)
+	if err != nil {
+		t.Fatalf("DialControl: %v", err)
+	}
+	defer client.Close()
+
+	resp, err := client.Request(NewPacket(Ping, nil, nil), time.Second)
+	if err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	var got Peer
+	if resp.Type() != PeerInfo {
+		t.Fatalf("want %s response; got %s", PeerInfo, resp.Type())
+	}
+	if err := json.Unmarshal(resp.Data(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != p.Id {
+		t.Fatalf("want peer %s; got %s", p.Id, got.Id)
+	}
+
+	// packets meant for other peers are not served on the control socket
+	if _, err := client.Request(NewPacket(FileOffer, nil, nil), time.Second); err == nil {
+		t.Fatalf("want error for %s on control socket", FileOffer)
+	}
+
+	if _, err := client.Request(NewPacket(Shutdown, nil, nil), time.Second); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("peer not stopped after shutdown request")
+	}
+}
+
+func TestControlListPeers(t *testing.T) {
+	kofi := startTestPeer(t, "kofi")
+	reg, err := registry.Open(filepath.Join(t.TempDir(), "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []registry.Record{
+		{Id: kofi.Id.String(), Name: "kofi", Addrs: []string{kofi.LocalAddr.String()}},
+		// nobody listens on port zero
+		{Id: "ghost", Name: "ghost", Addrs: []string{"127.0.0.1:0"}},
+	} {
+		r := r
+		if err := reg.Update(r.Id, func(rec *registry.Record) { *rec = r }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := startTestPeer(t, "lister", func(p *Peer) {
+		p.registry = reg
+		p.ControlPath = filepath.Join(t.TempDir(), "zinc.sock")
+	})
+	client, err := DialControl(p.ControlPath)
+	if err != nil {
+		t.Fatalf("DialControl: %v", err)
+	}
+	defer client.Close()
+
+	resp, err := client.Request(NewPacket(ListPeers, nil, nil), 5*time.Second)
+	if err != nil {
+		t.Fatalf("list peers: %v", err)
+	}
+	var peers []PeerStatus
+	if err := json.Unmarshal(resp.Data(), &peers); err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[string]PeerStatus)
+	for _, ps := range peers {
+		status[ps.Name] = ps
+	}
+	if s := status["kofi"]; s.Status != ACTIVE.String() || s.RTT <= 0 {
+		t.Errorf("want kofi active with an rtt; got %+v", s)
+	}
+	if s := status["ghost"]; s.Status != INACTIVE.String() || s.RTT != 0 {
+		t.Errorf("want ghost inactive; got %+v", s)
+	}
+}
+
+func TestControlStatusAndDrain(t *testing.T) {
+	p := startTestPeer(t, "drained", func(p *Peer) {
+		p.ControlPath = filepath.Join(t.TempDir(), "zinc.sock")
+	})
+	client, err := DialControl(p.ControlPath)
+	if err != nil {
+		t.Fatalf("DialControl: %v", err)
+	}
+	defer client.Close()
+
+	// a transfer that is still being recieved
+	in := &incoming{
+		offer: fileOffer{id: 42, name: "big", size: 3 * defaultChunkSize, chunkSize: defaultChunkSize},
+		addr:  p.LocalAddr.UDPAddr(),
+		have:  []bool{true, false, false},
+	}
+	p.transfers.Lock()
+	p.transfers.in[in.offer.id] = in
+	p.transfers.Unlock()
+
+	resp, err := client.Request(NewPacket(Status, nil, nil), time.Second)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	var st DaemonStatus
+	if err := json.Unmarshal(resp.Data(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Id != p.Id.String() || st.Uptime <= 0 || len(st.Handlers) == 0 {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if len(st.Transfers) != 1 || st.Transfers[0].Recieved != defaultChunkSize {
+		t.Fatalf("want the transfer in flight in the status; got %+v", st.Transfers)
+	}
+
+	// the transfer finishes while the peer drains
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		in.Lock()
+		in.done = true
+		in.Unlock()
+	}()
+	data, _ := json.Marshal(ShutdownRequest{Drain: 5 * time.Second, Restart: true})
+	resp, err = client.Request(NewPacket(Shutdown, data, nil), 10*time.Second)
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	var report ShutdownReport
+	if err := json.Unmarshal(resp.Data(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Abandoned != 0 {
+		t.Errorf("want no abandoned transfers; got %d", report.Abandoned)
+	}
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("peer not stopped after shutdown request")
+	}
+	if !p.RestartRequested() {
+		t.Errorf("want restart requested")
+	}
+
+	// new transfers are turned away once the peer is stopping
+	var offer fileOffer
+	offer.id, offer.name = 7, "late"
+	p.fileOfferHandler(context.Background(), nil, &requestWrapper{typ: FileOffer, data: offer.marshal(), addr: p.LocalAddr.UDPAddr()})
+	if _, ok := p.transfers.incoming(7); ok {
+		t.Errorf("want offer rejected while draining")
+	}
+}
+
+func TestPrivateDir(t *testing.T) {
+	tmp := t.TempDir()
+	old, had := os.LookupEnv("TMPDIR")
+	os.Setenv("TMPDIR", tmp)
+	defer func() {
+		if had {
+			os.Setenv("TMPDIR", old)
+		} else {
+			os.Unsetenv("TMPDIR")
+		}
+	}()
+	if os.TempDir() != tmp {
+		t.Skip("temporary directory not set through TMPDIR on this system")
+	}
+
+	path := filepath.Join(userTempDir(), "zinc.sock")
+	if err := PrivateDir(path); err != nil {
+		t.Fatalf("PrivateDir: %v", err)
+	}
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Fatalf("want the directory created with mode 0700; got %v", perm)
+	}
+	if err := os.Chmod(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := PrivateDir(path); err == nil {
+		t.Fatal("want an error for a directory open to everyone")
+	}
+	if err := PrivateDir(filepath.Join(tmp, "zinc.sock")); err != nil {
+		t.Fatalf("want other directories left alone; got %v", err)
+	}
+}
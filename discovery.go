@@ -0,0 +1,212 @@
+package zinc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Joe-Degs/zinc/internal/config"
+	"github.com/Joe-Degs/zinc/internal/pool"
+	"inet.af/netaddr"
+)
+
+// A cluster with discovery enabled announces itself on a multicast group of
+// the local network and adds the clusters it hears announcing the same
+// cluster id to its members. From there on the members are kept track of by
+// the membership of the cluster like any other member.
+//
+// The announcements of a secure cluster are signed with its key, along with
+// the time they were made. A secure cluster only adds the clusters whose
+// announcements are recent and signed with a trusted key, the same keys it
+// handshakes with.
+
+// DefaultDiscoveryGroup is the multicast group clusters announce themselves
+// on when no other group is configured.
+const DefaultDiscoveryGroup = "239.255.90.9:60010"
+
+// discoveryInterval is how often a cluster announces itself.
+const discoveryInterval = 5 * time.Second
+
+// announcementMaxAge is how old a signed announcement can get before it is
+// ignored, it allows for the clocks of the hosts being a little apart.
+const announcementMaxAge = time.Minute
+
+// announcementSigLen is the size of the time, the public key and the
+// signature that end a signed announcement.
+const announcementSigLen = 8 + ed25519.PublicKeySize + ed25519.SignatureSize
+
+var ErrUnsignedAnnouncement = errors.New("announcement is not signed")
+
+// discovery is the state of the discovery of a cluster.
+type discovery struct {
+	group     *net.UDPAddr
+	clusterId string
+	interval  time.Duration
+}
+
+func newDiscovery(conf *config.DiscoveryConfig) (*discovery, error) {
+	group := conf.Group
+	if group == "" {
+		group = DefaultDiscoveryGroup
+	}
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, errors.New("discovery group " + group + " is not a multicast address")
+	}
+	return &discovery{group: addr, clusterId: conf.ClusterId, interval: discoveryInterval}, nil
+}
+
+// announcement returns the packet a cluster announces itself with, the id of
+// the cluster followed by an alive event about the cluster. A secure cluster
+// signs the announcement.
+func (c *Cluster) announcement() ([]byte, error) {
+	b := new(bytes.Buffer)
+	writeString(b, c.discovery.clusterId)
+	e := c.self(stateAlive)
+	e.marshal(b)
+	if c.secure != nil {
+		binary.Write(b, binary.BigEndian, time.Now().Unix())
+		b.Write(c.secure.key.Public().(ed25519.PublicKey))
+		b.Write(ed25519.Sign(c.secure.key, b.Bytes()))
+	}
+	return MarshalPacket(NewPacket(Announce, b.Bytes(), nil))
+}
+
+// verifyAnnouncement checks the signature that ends the announcement data of
+// a secure cluster, the signature starts after the first n bytes.
+func (s *security) verifyAnnouncement(data []byte, n int) error {
+	if len(data)-n != announcementSigLen {
+		return ErrUnsignedAnnouncement
+	}
+	signed := data[:len(data)-ed25519.SignatureSize]
+	made := time.Unix(int64(binary.BigEndian.Uint64(data[n:])), 0)
+	pub := ed25519.PublicKey(data[n+8 : n+8+ed25519.PublicKeySize])
+	if !s.trusted[string(pub)] {
+		return fmt.Errorf("%w: %s", ErrUntrustedKey, EncodeKey(pub))
+	}
+	if !ed25519.Verify(pub, signed, data[len(signed):]) {
+		return ErrInvalidSignature
+	}
+	if age := time.Since(made); age > announcementMaxAge || age < -announcementMaxAge {
+		return fmt.Errorf("announcement made at %s is stale", made.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// discovered handles an announcement recieved from addr.
+func (c *Cluster) discovered(addr *net.UDPAddr, data []byte) error {
+	packet, err := UnmarshalPacket(data)
+	if err != nil {
+		return err
+	}
+	if packet.Type() != Announce {
+		return nil
+	}
+	r := bytes.NewReader(packet.Data())
+	id, err := readString(r)
+	if err != nil {
+		return err
+	}
+	if id != c.discovery.clusterId {
+		return nil
+	}
+	var e memberEvent
+	if err := e.unmarshal(r); err != nil {
+		return err
+	}
+	if c.secure != nil {
+		if err := c.secure.verifyAnnouncement(packet.Data(), len(packet.Data())-r.Len()); err != nil {
+			return err
+		}
+	}
+	if e.state != stateAlive || e.id == c.Id {
+		return nil
+	}
+
+	// a cluster listening on all interfaces announces an unspecified address,
+	// it is reached on the address the announcement came from.
+	if unspecified(e.addr) {
+		ipport := netaddr.MustParseIPPort(e.addr)
+		if ip, ok := netaddr.FromStdIP(addr.IP); ok {
+			e.addr = netaddr.IPPortFrom(ip, ipport.Port()).String()
+		}
+	}
+	c.apply(e)
+	return nil
+}
+
+// unspecified reports whether addr is on all the interfaces of a host.
+func unspecified(addr string) bool {
+	ipport, err := netaddr.ParseIPPort(addr)
+	return err == nil && ipport.IP().IsUnspecified()
+}
+
+// runDiscovery announces the cluster and listens for the announcements of
+// other clusters until ctx is done.
+func (c *Cluster) runDiscovery(ctx context.Context) error {
+	lstn, err := net.ListenMulticastUDP("udp4", nil, c.discovery.group)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp4", nil, c.discovery.group)
+	if err != nil {
+		lstn.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		lstn.Close()
+		conn.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(c.discovery.interval)
+		defer ticker.Stop()
+		for {
+			b, err := c.announcement()
+			if err == nil {
+				_, err = conn.Write(b)
+			}
+			if err != nil && ctx.Err() == nil {
+				c.Logger().Error("discovery: announcing", F("error", err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	go func() {
+		c.Logger().Info("discovering cluster", F("cluster_id", c.discovery.clusterId), F("group", c.discovery.group))
+		for {
+			buffer := pool.GetBufferSized(maxDatagramSize)
+			buf := buffer.Bytes()
+			n, raddr, err := lstn.ReadFromUDP(buf)
+			if err != nil {
+				pool.PutBuffer(buffer)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				c.Logger().Error("discovery", F("error", err))
+				continue
+			}
+			err = c.discovered(raddr, append(make([]byte, 0, n), buf[:n]...))
+			pool.PutBuffer(buffer)
+			if err != nil {
+				c.Logger().Warn("discovery: invalid announcement", F("remote_addr", raddr), F("error", err))
+			}
+		}
+	}()
+	return nil
+}
@@ -15,6 +15,9 @@ func NewError(msg string) *ZinkError {
 var (
 	UnImplementedEndPoint = NewError("unimplemented endpoint")
 	UnknownPacketType     = NewError("unknown packet type")
+	Unauthorized          = NewError("unauthorized")
+	RateLimited           = NewError("rate limit exceeded")
+	ShuttingDown          = NewError("peer is shutting down")
 )
 
 func ErrrorWithAddr(err *ZinkError, addr *net.UDPAddr) *ZinkError {
@@ -9,5 +9,6 @@ require (
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/jessevdk/go-flags v1.5.0
 	github.com/mitchellh/cli v1.1.2
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
 	inet.af/netaddr v0.0.0-20211027220019-c74959edd3b6
 )
@@ -0,0 +1,258 @@
+package zinc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Packets are served by the handler registered for their type. The types
+// below UserPacketType are reserved for the packets peers use to talk to each
+// other, applications register handlers for their own types from
+// UserPacketType up. Middleware wraps handlers with behavior they share, like
+// logging or access control.
+
+// UserPacketType is the first packet type applications can handle.
+const UserPacketType PacketType = 128
+
+// DefaultHandlerTimeout is how long a handler runs before its context is
+// cancelled, unless the peer says otherwise.
+const DefaultHandlerTimeout = 30 * time.Second
+
+var (
+	ErrReservedPacketType = errors.New("packet type is reserved")
+	ErrNilHandler         = errors.New("nil handler")
+)
+
+// A ResponseWriter sends the response to the packet a handler serves.
+type ResponseWriter interface {
+	// Respond sends a packet of type typ carrying data to the sender of the
+	// packet being served. The response carries the id of the packet so it
+	// reaches the request waiting for it.
+	Respond(typ PacketType, data []byte) error
+}
+
+// A Handler serves the packets of the types it is registered for. The context
+// is cancelled when the peer stops serving or the handler runs for longer than
+// the HandlerTimeout of the peer.
+type Handler interface {
+	ServePacket(ctx context.Context, w ResponseWriter, packet Packet)
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as
+// handlers.
+type HandlerFunc func(context.Context, ResponseWriter, Packet)
+
+func (f HandlerFunc) ServePacket(ctx context.Context, w ResponseWriter, packet Packet) {
+	f(ctx, w, packet)
+}
+
+// Middleware returns a handler that does something before or after calling
+// the handler it wraps, or instead of calling it.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with mw, the first middleware is the outermost.
+func Chain(h Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// router holds the handlers of a peer and the middleware wrapping them.
+type router struct {
+	sync.RWMutex
+	handlers   map[PacketType]Handler
+	middleware []Middleware
+}
+
+func newRouter() *router {
+	return &router{handlers: make(map[PacketType]Handler)}
+}
+
+func (r *router) handle(typ PacketType, h Handler) {
+	r.Lock()
+	r.handlers[typ] = h
+	r.Unlock()
+}
+
+// handler returns the handler of typ wrapped in the middleware of the peer, or
+// nil if there is no handler for typ.
+func (r *router) handler(typ PacketType) Handler {
+	r.RLock()
+	defer r.RUnlock()
+	h, ok := r.handlers[typ]
+	if !ok {
+		return nil
+	}
+	return Chain(h, r.middleware...)
+}
+
+func (r *router) types() []PacketType {
+	r.RLock()
+	defer r.RUnlock()
+	types := make([]PacketType, 0, len(r.handlers))
+	for typ := range r.handlers {
+		types = append(types, typ)
+	}
+	return types
+}
+
+// Handle registers h to serve the packets of type typ, replacing the handler
+// registered before it. Handlers can be registered while the peer is running.
+// Only the types from UserPacketType up can be handled.
+func (p *Peer) Handle(typ PacketType, h Handler) error {
+	if typ < UserPacketType {
+		return fmt.Errorf("handling %s: %w", typ, ErrReservedPacketType)
+	}
+	if h == nil {
+		return fmt.Errorf("handling %s: %w", typ, ErrNilHandler)
+	}
+	p.router.handle(typ, h)
+	return nil
+}
+
+// HandleFunc registers f to serve the packets of type typ.
+func (p *Peer) HandleFunc(typ PacketType, f func(context.Context, ResponseWriter, Packet)) error {
+	if f == nil {
+		return fmt.Errorf("handling %s: %w", typ, ErrNilHandler)
+	}
+	return p.Handle(typ, HandlerFunc(f))
+}
+
+// Use adds middleware that wraps every handler of the peer, those of the
+// reserved packet types included. Middleware added first is the outermost.
+func (p *Peer) Use(mw ...Middleware) {
+	p.router.Lock()
+	p.router.middleware = append(p.router.middleware, mw...)
+	p.router.Unlock()
+}
+
+// handle registers the handler of a reserved packet type.
+func (p *Peer) handle(typ PacketType, f HandlerFunc) {
+	p.router.handle(typ, f)
+}
+
+// serve runs the handler of the packet, the sender of a packet nothing
+// handles is told so. ctx is done when the peer stops serving.
+func (p *Peer) serve(ctx context.Context, req Packet) {
+	w := &responseWriter{p: p, req: req}
+	if h := p.router.handler(req.Type()); h != nil {
+		timeout := p.HandlerTimeout
+		if timeout <= 0 {
+			timeout = DefaultHandlerTimeout
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		h.ServePacket(ctx, w, req)
+		return
+	}
+	p.Logger().Warn("no registered handler", F("packet_type", req.Type()), F("remote_addr", req.Addr()))
+	if isTrouble(req.Type()) {
+		return
+	}
+	if err := w.Respond(Error, UnknownPacketType.Data()); err != nil {
+		p.Logger().Error("sending error response failed", F("remote_addr", req.Addr()), F("error", err))
+	}
+}
+
+// isTrouble reports whether packets of type typ tell of trouble. Errors are
+// never sent back for them, so two peers don't keep telling each other
+// about the trouble.
+func isTrouble(typ PacketType) bool {
+	return typ == Error || typ == Busy
+}
+
+type responseWriter struct {
+	p   *Peer
+	req Packet
+}
+
+func (w *responseWriter) Respond(typ PacketType, data []byte) error {
+	return w.p.Send(responseTo(w.req, typ, data))
+}
+
+// recorder is a ResponseWriter that remembers the response sent through it.
+type recorder struct {
+	ResponseWriter
+	typ       PacketType
+	responded bool
+}
+
+func (r *recorder) Respond(typ PacketType, data []byte) error {
+	r.typ, r.responded = typ, true
+	return r.ResponseWriter.Respond(typ, data)
+}
+
+// LogPackets returns middleware that logs every packet served to l, with the
+// type of the response and how long the handler took.
+func LogPackets(l *Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, packet Packet) {
+			rec := &recorder{ResponseWriter: w}
+			start := time.Now()
+			next.ServePacket(ctx, rec, packet)
+			fields := []Field{
+				F("packet_type", packet.Type()),
+				F("remote_addr", packet.Addr()),
+				F("duration", time.Since(start)),
+			}
+			if rec.responded {
+				fields = append(fields, F("response_type", rec.typ))
+			}
+			l.Info("served packet", fields...)
+		})
+	}
+}
+
+// Authorize returns middleware that serves only the packets allow accepts.
+// The senders of the other packets get an Unauthorized error.
+func Authorize(allow func(Packet) bool) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, packet Packet) {
+			if !allow(packet) {
+				w.Respond(Error, Unauthorized.Data())
+				return
+			}
+			next.ServePacket(ctx, w, packet)
+		})
+	}
+}
+
+// RateLimit returns middleware that serves at most n packets from each address
+// in every interval of length per. The senders of the packets over the limit
+// get a RateLimited error.
+func RateLimit(n int, per time.Duration) Middleware {
+	l := &limiter{n: n, per: per}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, packet Packet) {
+			if !l.allow(packet.Addr().String(), time.Now()) {
+				w.Respond(Error, RateLimited.Data())
+				return
+			}
+			next.ServePacket(ctx, w, packet)
+		})
+	}
+}
+
+// limiter counts the packets of each address in fixed windows of time.
+type limiter struct {
+	sync.Mutex
+	n      int
+	per    time.Duration
+	window time.Time
+	counts map[string]int
+}
+
+func (l *limiter) allow(addr string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	if now.Sub(l.window) >= l.per {
+		l.window = now
+		l.counts = make(map[string]int)
+	}
+	l.counts[addr]++
+	return l.counts[addr] <= l.n
+}
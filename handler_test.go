@@ -0,0 +1,179 @@
+package zinc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const echoPacket = UserPacketType + 1
+
+func echo(_ context.Context, w ResponseWriter, packet Packet) {
+	w.Respond(echoPacket, packet.Data())
+}
+
+func request(t *testing.T, from, to *Peer, typ PacketType, data []byte) Packet {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := from.Request(ctx, NewPacket(typ, data, to.lstn.LocalAddr().(*net.UDPAddr)))
+	if err != nil {
+		t.Fatalf("%s request: %v", typ, err)
+	}
+	return resp
+}
+
+func TestHandleReserved(t *testing.T) {
+	p := RandomPeer("reserved")
+	defer p.lstn.Close()
+	if err := p.HandleFunc(Ping, echo); !errors.Is(err, ErrReservedPacketType) {
+		t.Fatalf("want ErrReservedPacketType handling %s; got %v", Ping, err)
+	}
+	if err := p.Handle(echoPacket, nil); !errors.Is(err, ErrNilHandler) {
+		t.Fatalf("want ErrNilHandler; got %v", err)
+	}
+	if err := p.HandleFunc(echoPacket, echo); err != nil {
+		t.Fatalf("HandleFunc: %v", err)
+	}
+}
+
+func TestHandleUserPacket(t *testing.T) {
+	server := startTestPeer(t, "server", func(p *Peer) {
+		p.HandleFunc(echoPacket, echo)
+	})
+	client := startTestPeer(t, "client")
+
+	resp := request(t, client, server, echoPacket, []byte("hello"))
+	if resp.Type() != echoPacket || string(resp.Data()) != "hello" {
+		t.Fatalf("want echo of hello; got %s %q", resp.Type(), resp.Data())
+	}
+
+	// handlers registered on a running peer serve the next packet
+	const late = UserPacketType + 2
+	resp = request(t, client, server, late, nil)
+	if resp.Type() != Error || string(resp.Data()) != string(UnknownPacketType.Data()) {
+		t.Fatalf("want unknown packet type error; got %s %q", resp.Type(), resp.Data())
+	}
+	server.HandleFunc(late, func(ctx context.Context, w ResponseWriter, packet Packet) { w.Respond(Ok, nil) })
+	if resp = request(t, client, server, late, nil); resp.Type() != Ok {
+		t.Fatalf("want %s; got %s", Ok, resp.Type())
+	}
+}
+
+func TestHandleMiddleware(t *testing.T) {
+	b := new(syncBuffer)
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, w ResponseWriter, packet Packet) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				next.ServePacket(ctx, w, packet)
+			})
+		}
+	}
+	server := startTestPeer(t, "server", func(p *Peer) {
+		p.HandleFunc(echoPacket, echo)
+		p.Use(LogPackets(NewLogger(b, LevelInfo, FormatText)), Authorize(func(packet Packet) bool {
+			return string(packet.Data()) != "intruder"
+		}))
+		p.Handle(echoPacket+1, Chain(HandlerFunc(echo), trace("outer"), trace("inner")))
+	})
+	client := startTestPeer(t, "client")
+
+	if resp := request(t, client, server, echoPacket, []byte("intruder")); resp.Type() != Error ||
+		string(resp.Data()) != string(Unauthorized.Data()) {
+		t.Fatalf("want unauthorized error; got %s %q", resp.Type(), resp.Data())
+	}
+	if resp := request(t, client, server, echoPacket+1, []byte("friend")); resp.Type() != echoPacket {
+		t.Fatalf("want echo; got %s %q", resp.Type(), resp.Data())
+	}
+	mu.Lock()
+	got := strings.Join(order, ",")
+	mu.Unlock()
+	if got != "outer,inner" {
+		t.Fatalf("want middleware run outer first; got %s", got)
+	}
+
+	// the middleware of the peer wraps the reserved handlers too
+	request(t, client, server, Ping, nil)
+	waitFor(t, "the packets to be logged", func() bool {
+		return strings.Count(b.String(), "served packet") == 3
+	})
+	for _, want := range []string{"response_type=Error", "response_type=PeerInfo", "packet_type=Ping"} {
+		if !strings.Contains(b.String(), want) {
+			t.Fatalf("want %s in log:\n%s", want, b)
+		}
+	}
+}
+
+func TestHandleRateLimit(t *testing.T) {
+	server := startTestPeer(t, "server", func(p *Peer) {
+		p.HandleFunc(echoPacket, echo)
+		p.Use(RateLimit(2, time.Hour))
+	})
+	client := startTestPeer(t, "client")
+	other := startTestPeer(t, "other")
+
+	for i := 0; i < 2; i++ {
+		if resp := request(t, client, server, echoPacket, nil); resp.Type() != echoPacket {
+			t.Fatalf("want echo %d; got %s %q", i, resp.Type(), resp.Data())
+		}
+	}
+	if resp := request(t, client, server, echoPacket, nil); resp.Type() != Error ||
+		string(resp.Data()) != string(RateLimited.Data()) {
+		t.Fatalf("want rate limit error; got %s %q", resp.Type(), resp.Data())
+	}
+	if resp := request(t, other, server, echoPacket, nil); resp.Type() != echoPacket {
+		t.Fatalf("want other addresses served; got %s %q", resp.Type(), resp.Data())
+	}
+}
+
+func TestHandlerContext(t *testing.T) {
+	server := startTestPeer(t, "server", func(p *Peer) {
+		p.HandlerTimeout = 50 * time.Millisecond
+		p.HandleFunc(echoPacket, func(ctx context.Context, w ResponseWriter, packet Packet) {
+			<-ctx.Done()
+			w.Respond(echoPacket, []byte(ctx.Err().Error()))
+		})
+	})
+	client := startTestPeer(t, "client")
+	if resp := request(t, client, server, echoPacket, nil); string(resp.Data()) != context.DeadlineExceeded.Error() {
+		t.Fatalf("want handler timed out; got %q", resp.Data())
+	}
+
+	// stopping the peer cancels the handlers that are running
+	p := RandomPeer("stopping")
+	started, stopped := make(chan struct{}), make(chan error, 1)
+	p.HandleFunc(echoPacket, func(ctx context.Context, w ResponseWriter, packet Packet) {
+		close(started)
+		<-ctx.Done()
+		stopped <- ctx.Err()
+	})
+	cancel, err := p.StartServer()
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	defer p.lstn.Close()
+	if err := client.Send(NewPacket(echoPacket, nil, p.lstn.LocalAddr().(*net.UDPAddr))); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-started
+	cancel()
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("want handler cancelled; got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+}
@@ -14,10 +14,10 @@ var sampleClusterConfig = `{
 	"addr": "localhost:6009",
 	"peers": [{
 		"name": "kofi",
-		"addr": "localhost:7000",
+		"addr": "localhost:7000"
 	},{
 		"name": "messi",
-		"addr": "localhost:30011",
+		"addr": "localhost:30011"
 	}, {
 		"name": "oskee",
 		"addr": "localhost:40011"
@@ -31,14 +31,61 @@ var samplePeerConfig = `{
 }`
 
 type PeerConfig struct {
-	Name string `json:"name"`
-	Addr string `json:"addr"`
-	Id   string `json:"id"`
+	Name       string `json:"name"`
+	Addr       string `json:"addr"`
+	Id         string `json:"id"`
+	ReceiveDir string `json:"receive_dir"`
+	Control    string `json:"control"`
+
+	// StateDir is the directory the peer checkpoints its transfers in so
+	// they can be resumed after it restarts. Transfers are not checkpointed
+	// when it is empty.
+	StateDir string `json:"state_dir"`
+
+	// MaxFileSize is the largest file in bytes the peer accepts from other
+	// peers. A default limit is used when it is zero.
+	MaxFileSize int64 `json:"max_file_size"`
+
+	// PreserveOwner makes the peer give the files it recieves the owners
+	// they were sent with. Files belong to the user running the peer when
+	// it is not set.
+	PreserveOwner bool `json:"preserve_owner"`
+
+	// Registry is the file the peer remembers the peers it hears of in.
+	Registry string `json:"registry"`
+
+	// KeyFile is the file holding the private key of the peer. Peers with a
+	// key file encrypt their packets and only talk to the peers whose
+	// public keys are in TrustedKeys.
+	KeyFile     string   `json:"key_file"`
+	TrustedKeys []string `json:"trusted_keys"`
+
+	// LogLevel is the lowest level of the log entries the peer writes, one
+	// of debug, info, warn and error. LogFormat is one of text, json and
+	// syslog. Entries are written to LogFile, or stdout when it is empty.
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+	LogFile   string `json:"log_file"`
+
+	// Workers is the number of packets the peer serves at a time and
+	// QueueSize the number of packets that wait for a worker, packets that
+	// find the queue full are dropped.
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queue_size"`
 }
 
 type ClusterConfig struct {
 	*PeerConfig
-	Peers []*PeerConfig
+	Peers     []*PeerConfig
+	Discovery *DiscoveryConfig `json:"discovery"`
+}
+
+// DiscoveryConfig configures how a cluster finds its members on the local
+// network. Only clusters with the same ClusterId discover each other.
+type DiscoveryConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Group     string `json:"group"`
+	ClusterId string `json:"cluster_id"`
 }
 
 func (c PeerConfig) GetConnAndIP() (conn *net.UDPConn, addr *netaddr.IPPort, err error) {
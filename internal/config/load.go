@@ -0,0 +1,296 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// A config is loaded in layers, each layer overriding the ones before it:
+//
+//	defaults < config file < ZINC_* environment variables < command line flags
+//
+// The result is validated once all the layers are applied and every problem
+// found along the way is reported together.
+
+// DefaultAddr is the address a peer listens on when no other address is
+// configured.
+const DefaultAddr = "localhost:6009"
+
+// EnvPrefix is the prefix of the environment variables a config is read from.
+const EnvPrefix = "ZINC_"
+
+// Overrides are the settings of a peer that can be set from the environment
+// and the command line. Empty fields leave the setting as it is.
+type Overrides struct {
+	Name       string
+	Id         string
+	Addr       string
+	Port       string // replaces only the port of the address
+	ReceiveDir string
+	Control    string
+	StateDir   string
+	Registry   string
+	KeyFile    string
+	LogLevel   string
+	LogFormat  string
+	LogFile    string
+
+	TrustedKeys []string
+}
+
+// Errors are all the problems found while loading a config.
+type Errors []error
+
+func (e Errors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d config errors:", len(e))
+	for _, err := range e {
+		b.WriteString("\n\t" + err.Error())
+	}
+	return b.String()
+}
+
+// A Loader loads the config of a peer or cluster.
+type Loader struct {
+	// File is the json config file, no file is read when it is empty.
+	File string
+
+	// Flags are the settings given on the command line.
+	Flags Overrides
+
+	// LookupEnv looks up environment variables, os.LookupEnv is used when
+	// it is nil.
+	LookupEnv func(string) (string, bool)
+}
+
+// LoadPeer loads the config of a peer.
+func (l Loader) LoadPeer() (*PeerConfig, error) {
+	conf := defaultPeerConfig()
+	errs := l.load(conf, conf)
+	errs = append(errs, conf.validate("")...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return conf, nil
+}
+
+// LoadCluster loads the config of a cluster, the environment and flags
+// override the settings of the cluster's own peer.
+func (l Loader) LoadCluster() (*ClusterConfig, error) {
+	conf := &ClusterConfig{PeerConfig: defaultPeerConfig()}
+	errs := l.load(conf, conf.PeerConfig)
+	errs = append(errs, conf.validate()...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return conf, nil
+}
+
+// load reads the config file into v and applies the environment and the
+// flags to peer.
+func (l Loader) load(v interface{}, peer *PeerConfig) Errors {
+	var errs Errors
+	if l.File != "" {
+		if err := decodeFile(l.File, v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	lookup := l.LookupEnv
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	env, envErrs := overridesFromEnv(lookup)
+	errs = append(errs, envErrs...)
+	peer.apply(env)
+	peer.apply(l.Flags)
+	return errs
+}
+
+func defaultPeerConfig() *PeerConfig {
+	name, _ := os.Hostname()
+	return &PeerConfig{Name: name, Addr: DefaultAddr}
+}
+
+// decodeFile decodes the json config file into v. Unknown fields are
+// rejected so misspelt settings don't go unnoticed.
+func decodeFile(filename string, v interface{}) error {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("config file %s: %w", filename, err)
+	}
+	return nil
+}
+
+// overridesFromEnv reads the ZINC_* environment variables.
+func overridesFromEnv(lookup func(string) (string, bool)) (Overrides, Errors) {
+	var o Overrides
+	var errs Errors
+	for _, v := range []struct {
+		name  string
+		value *string
+	}{
+		{"NAME", &o.Name},
+		{"ID", &o.Id},
+		{"ADDR", &o.Addr},
+		{"PORT", &o.Port},
+		{"RECEIVE_DIR", &o.ReceiveDir},
+		{"CONTROL", &o.Control},
+		{"STATE_DIR", &o.StateDir},
+		{"REGISTRY", &o.Registry},
+		{"KEY_FILE", &o.KeyFile},
+		{"LOG_LEVEL", &o.LogLevel},
+		{"LOG_FORMAT", &o.LogFormat},
+		{"LOG_FILE", &o.LogFile},
+	} {
+		if s, ok := lookup(EnvPrefix + v.name); ok {
+			*v.value = s
+		}
+	}
+	if s, ok := lookup(EnvPrefix + "TRUSTED_KEYS"); ok {
+		for _, k := range strings.Split(s, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				o.TrustedKeys = append(o.TrustedKeys, k)
+			}
+		}
+		if len(o.TrustedKeys) == 0 {
+			errs = append(errs, errors.New(EnvPrefix+"TRUSTED_KEYS: no keys in a comma separated list"))
+		}
+	}
+	return o, errs
+}
+
+// apply sets the settings of o that are not empty.
+func (c *PeerConfig) apply(o Overrides) {
+	set := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	set(&c.Name, o.Name)
+	set(&c.Id, o.Id)
+	set(&c.Addr, o.Addr)
+	set(&c.ReceiveDir, o.ReceiveDir)
+	set(&c.Control, o.Control)
+	set(&c.StateDir, o.StateDir)
+	set(&c.Registry, o.Registry)
+	set(&c.KeyFile, o.KeyFile)
+	set(&c.LogLevel, o.LogLevel)
+	set(&c.LogFormat, o.LogFormat)
+	set(&c.LogFile, o.LogFile)
+	if o.Port != "" {
+		host, _, err := net.SplitHostPort(c.Addr)
+		if err != nil {
+			host = "localhost"
+		}
+		c.Addr = net.JoinHostPort(host, o.Port)
+	}
+	if len(o.TrustedKeys) > 0 {
+		c.TrustedKeys = o.TrustedKeys
+	}
+}
+
+// validate checks the settings of the peer, field names in the errors are
+// prefixed with prefix.
+func (c *PeerConfig) validate(prefix string) Errors {
+	var errs Errors
+	if err := validateAddr(c.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("%saddr %q: %w", prefix, c.Addr, err))
+	}
+	if c.Id != "" {
+		if _, err := uuid.Parse(c.Id); err != nil {
+			errs = append(errs, fmt.Errorf("%sid %q: %w", prefix, c.Id, err))
+		}
+	}
+	if len(c.TrustedKeys) > 0 && c.KeyFile == "" {
+		errs = append(errs, fmt.Errorf("%strusted_keys: a key_file is needed to talk to trusted peers", prefix))
+	}
+	if c.LogLevel != "" && !oneOf(c.LogLevel, "debug", "info", "warn", "error") {
+		errs = append(errs, fmt.Errorf("%slog_level %q: not one of debug, info, warn and error", prefix, c.LogLevel))
+	}
+	if c.LogFormat != "" && !oneOf(c.LogFormat, "text", "json", "syslog") {
+		errs = append(errs, fmt.Errorf("%slog_format %q: not one of text, json and syslog", prefix, c.LogFormat))
+	}
+	if c.MaxFileSize < 0 {
+		errs = append(errs, fmt.Errorf("%smax_file_size %d: must not be negative", prefix, c.MaxFileSize))
+	}
+	if c.Workers < 0 {
+		errs = append(errs, fmt.Errorf("%sworkers %d: must not be negative", prefix, c.Workers))
+	}
+	if c.QueueSize < 0 {
+		errs = append(errs, fmt.Errorf("%squeue_size %d: must not be negative", prefix, c.QueueSize))
+	}
+	for _, k := range c.TrustedKeys {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(k))
+		if err == nil && len(b) != ed25519.PublicKeySize {
+			err = fmt.Errorf("invalid public key length %d", len(b))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%strusted_keys %q: %w", prefix, k, err))
+		}
+	}
+	return errs
+}
+
+// validate checks the settings of the cluster and all its peers.
+func (c *ClusterConfig) validate() Errors {
+	errs := c.PeerConfig.validate("")
+	for i, p := range c.Peers {
+		prefix := fmt.Sprintf("peers[%d].", i)
+		if p == nil {
+			errs = append(errs, fmt.Errorf("peers[%d]: missing peer", i))
+			continue
+		}
+		if p.Addr == "" {
+			errs = append(errs, fmt.Errorf("%saddr: missing address", prefix))
+			continue
+		}
+		errs = append(errs, p.validate(prefix)...)
+	}
+	if d := c.Discovery; d != nil && d.Enabled && d.Group != "" {
+		if addr, err := net.ResolveUDPAddr("udp4", d.Group); err != nil {
+			errs = append(errs, fmt.Errorf("discovery.group %q: %w", d.Group, err))
+		} else if !addr.IP.IsMulticast() {
+			errs = append(errs, fmt.Errorf("discovery.group %q: not a multicast address", d.Group))
+		}
+	}
+	return errs
+}
+
+func oneOf(s string, choices ...string) bool {
+	for _, c := range choices {
+		if strings.EqualFold(s, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAddr checks that addr is a host and a port.
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, s string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "zinc.json")
+	if err := os.WriteFile(name, []byte(s), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestLoaderLayers(t *testing.T) {
+	file := writeConfig(t, `{
+		"name": "from-file",
+		"addr": "127.0.0.1:7000",
+		"receive_dir": "/tmp/file",
+		"control": "/tmp/file.sock"
+	}`)
+
+	testCases := []struct {
+		name  string
+		env   map[string]string
+		flags Overrides
+		want  PeerConfig
+	}{
+		{
+			name: "file",
+			want: PeerConfig{Name: "from-file", Addr: "127.0.0.1:7000", ReceiveDir: "/tmp/file", Control: "/tmp/file.sock"},
+		},
+		{
+			name: "env over file",
+			env:  map[string]string{"ZINC_NAME": "from-env", "ZINC_RECEIVE_DIR": "/tmp/env"},
+			want: PeerConfig{Name: "from-env", Addr: "127.0.0.1:7000", ReceiveDir: "/tmp/env", Control: "/tmp/file.sock"},
+		},
+		{
+			name:  "flags over env",
+			env:   map[string]string{"ZINC_NAME": "from-env", "ZINC_PORT": "8000"},
+			flags: Overrides{Name: "from-flags", Control: "/tmp/flags.sock"},
+			want:  PeerConfig{Name: "from-flags", Addr: "127.0.0.1:8000", ReceiveDir: "/tmp/file", Control: "/tmp/flags.sock"},
+		},
+		{
+			name:  "port flag over addr env",
+			env:   map[string]string{"ZINC_ADDR": "0.0.0.0:9000"},
+			flags: Overrides{Port: "9001"},
+			want:  PeerConfig{Name: "from-file", Addr: "0.0.0.0:9001", ReceiveDir: "/tmp/file", Control: "/tmp/file.sock"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := Loader{File: file, Flags: tc.flags, LookupEnv: env(tc.env)}
+			got, err := l.LoadPeer()
+			if err != nil {
+				t.Fatalf("LoadPeer: %v", err)
+			}
+			if got.Name != tc.want.Name || got.Addr != tc.want.Addr ||
+				got.ReceiveDir != tc.want.ReceiveDir || got.Control != tc.want.Control {
+				t.Fatalf("want %+v; got %+v", tc.want, *got)
+			}
+		})
+	}
+}
+
+func TestLoaderDefaults(t *testing.T) {
+	got, err := Loader{LookupEnv: env(nil)}.LoadPeer()
+	if err != nil {
+		t.Fatalf("LoadPeer: %v", err)
+	}
+	if got.Addr != DefaultAddr {
+		t.Fatalf("want default address %s; got %s", DefaultAddr, got.Addr)
+	}
+}
+
+func TestLoaderCluster(t *testing.T) {
+	file := writeConfig(t, `{
+		"name": "joe",
+		"addr": "127.0.0.1:6009",
+		"peers": [{"name": "kofi", "addr": "127.0.0.1:7000"}],
+		"discovery": {"enabled": true, "cluster_id": "test"}
+	}`)
+	l := Loader{File: file, Flags: Overrides{Port: "6010"}, LookupEnv: env(nil)}
+	got, err := l.LoadCluster()
+	if err != nil {
+		t.Fatalf("LoadCluster: %v", err)
+	}
+	if got.Name != "joe" || got.Addr != "127.0.0.1:6010" {
+		t.Fatalf("want joe on 127.0.0.1:6010; got %s on %s", got.Name, got.Addr)
+	}
+	if len(got.Peers) != 1 || got.Peers[0].Name != "kofi" {
+		t.Fatalf("want kofi as the only peer; got %v", got.Peers)
+	}
+	if got.Discovery == nil || got.Discovery.ClusterId != "test" {
+		t.Fatalf("want discovery of cluster test; got %+v", got.Discovery)
+	}
+}
+
+func TestLoaderReportsAllErrors(t *testing.T) {
+	file := writeConfig(t, `{
+		"addr": "127.0.0.1:6009",
+		"workers": -1,
+		"max_file_size": -1,
+		"peers": [{"name": "kofi"}, {"addr": "127.0.0.1:7000", "id": "not-a-uuid"}],
+		"discovery": {"enabled": true, "group": "127.0.0.1:60010"}
+	}`)
+	l := Loader{
+		File:      file,
+		Flags:     Overrides{Port: "http"},
+		LookupEnv: env(map[string]string{"ZINC_TRUSTED_KEYS": "bm90IGEga2V5", "ZINC_LOG_LEVEL": "loud"}),
+	}
+	_, err := l.LoadCluster()
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("want Errors; got %v", err)
+	}
+	for _, want := range []string{
+		`addr "127.0.0.1:http"`,
+		"trusted_keys: a key_file is needed",
+		"invalid public key length",
+		"peers[0].addr: missing address",
+		`peers[1].id "not-a-uuid"`,
+		"not a multicast address",
+		`log_level "loud"`,
+		"workers -1",
+		"max_file_size -1",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want error %q in:\n%v", want, err)
+		}
+	}
+	if len(errs) != 9 {
+		t.Fatalf("want 9 errors; got %d:\n%v", len(errs), err)
+	}
+}
+
+func TestLoaderUnknownField(t *testing.T) {
+	file := writeConfig(t, `{"nmae": "typo"}`)
+	if _, err := (Loader{File: file, LookupEnv: env(nil)}).LoadPeer(); err == nil {
+		t.Fatal("want error for unknown field in config file")
+	}
+}
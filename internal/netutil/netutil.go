@@ -78,6 +78,16 @@ func ListenOnLocalRandomPort() (*net.UDPConn, error) {
 	return Listen("localhost:0")
 }
 
+// ResolveIPPort is like IPPortFromAddr but it also resolves the host part of
+// addr when it is a name instead of an ip address.
+func ResolveIPPort(addr string) (*netaddr.IPPort, error) {
+	raddr, err := resolveAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return IPPortFromAddr(raddr.String())
+}
+
 // IPPortFromAddr tries to return a valid netaddr.IPPort from an address string
 // The address must be an ip:port pair, address resolution is not done by this
 // package.
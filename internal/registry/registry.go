@@ -0,0 +1,243 @@
+// Package registry keeps the peers a zinc daemon has heard of on disk so
+// they are remembered across restarts. The daemon and the command line tools
+// share the registry, every read and update takes a lock on the registry
+// file so they don't step on each other.
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status of a peer in the registry.
+const (
+	Active   = "active"
+	Inactive = "inactive"
+)
+
+var ErrNotFound = errors.New("peer not in registry")
+
+// SeenResolution is how stale the LastSeen of a record gets before an update
+// that changes nothing else writes the registry. Peers are heard from every
+// second or so, writing the registry each time is not worth it.
+const SeenResolution = time.Minute
+
+// errUnchanged is returned by the functions passed to locked that leave the
+// records as they are, so they are not written back.
+var errUnchanged = errors.New("records unchanged")
+
+// A Record is what the registry knows of a peer.
+type Record struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Addrs     []string  `json:"addrs,omitempty"`
+	PublicKey string    `json:"public_key,omitempty"`
+	LastSeen  time.Time `json:"last_seen"`
+	Status    string    `json:"status"`
+}
+
+// AddAddr adds addr to the addresses of the peer, the most recently seen
+// address goes first.
+func (r *Record) AddAddr(addr string) {
+	addrs := []string{addr}
+	for _, a := range r.Addrs {
+		if a != addr {
+			addrs = append(addrs, a)
+		}
+	}
+	r.Addrs = addrs
+}
+
+// A Registry is a file of records.
+type Registry struct {
+	path string
+
+	// mu serializes the goroutines of a process, the lock on the file
+	// serializes processes.
+	mu sync.Mutex
+}
+
+// DefaultPath returns where the registry is kept when no other path is
+// configured.
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "zinc", "registry.json")
+}
+
+// Open returns the registry at path, the directory of the registry is
+// created when it does not exist.
+func Open(path string) (*Registry, error) {
+	if path == "" {
+		path = DefaultPath()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return &Registry{path: path}, nil
+}
+
+// Path returns the path of the registry file.
+func (r *Registry) Path() string {
+	return r.path
+}
+
+// List returns all the records in the registry sorted by name and id.
+func (r *Registry) List() ([]Record, error) {
+	var records []Record
+	err := r.locked(false, func(m map[string]*Record) error {
+		for _, rec := range m {
+			records = append(records, *rec)
+		}
+		return nil
+	})
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		return records[i].Id < records[j].Id
+	})
+	return records, err
+}
+
+// Get returns the record of the peer with the given id.
+func (r *Registry) Get(id string) (*Record, error) {
+	var rec *Record
+	err := r.locked(false, func(m map[string]*Record) error {
+		found, ok := m[id]
+		if !ok {
+			return ErrNotFound
+		}
+		rec = found
+		return nil
+	})
+	return rec, err
+}
+
+// Update calls f with the record of the peer with the given id and saves
+// the changes f makes to it. A new record is made for peers that are not in
+// the registry yet. The registry is not written when f only moves LastSeen
+// by less than SeenResolution.
+func (r *Registry) Update(id string, f func(*Record)) error {
+	return r.locked(true, func(m map[string]*Record) error {
+		rec, ok := m[id]
+		if !ok {
+			rec = &Record{Id: id, Status: Inactive}
+			m[id] = rec
+		}
+		before := *rec
+		before.Addrs = append([]string(nil), rec.Addrs...)
+		f(rec)
+		rec.Id = id
+		if ok && rec.LastSeen.Sub(before.LastSeen) < SeenResolution && sameRecord(before, *rec) {
+			return errUnchanged
+		}
+		return nil
+	})
+}
+
+// sameRecord reports whether a and b differ in nothing but when the peer was
+// last seen.
+func sameRecord(a, b Record) bool {
+	if a.Id != b.Id || a.Name != b.Name || a.PublicKey != b.PublicKey || a.Status != b.Status || len(a.Addrs) != len(b.Addrs) {
+		return false
+	}
+	for i := range a.Addrs {
+		if a.Addrs[i] != b.Addrs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Delete removes the peer with the given id from the registry.
+func (r *Registry) Delete(id string) error {
+	return r.locked(true, func(m map[string]*Record) error {
+		if _, ok := m[id]; !ok {
+			return ErrNotFound
+		}
+		delete(m, id)
+		return nil
+	})
+}
+
+// locked calls f with the records of the registry while holding the lock on
+// the registry. The records are written back when write is set and f
+// succeeds.
+func (r *Registry) locked(write bool, f func(map[string]*Record) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unlock, err := lockFile(r.path+".lock", write)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	records, err := r.load()
+	if err != nil {
+		return err
+	}
+	if err := f(records); err == errUnchanged {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !write {
+		return nil
+	}
+	return r.save(records)
+}
+
+func (r *Registry) load() (map[string]*Record, error) {
+	records := make(map[string]*Record)
+	b, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*Record
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	for _, rec := range list {
+		records[rec.Id] = rec
+	}
+	return records, nil
+}
+
+// save writes the records to a temporary file and renames it over the
+// registry, so readers never see a half written registry.
+func (r *Registry) save(records map[string]*Record) error {
+	list := make([]*Record, 0, len(records))
+	for _, rec := range records {
+		list = append(list, rec)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".registry-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
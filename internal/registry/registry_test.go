@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	reg, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := time.Date(2022, time.January, 28, 12, 0, 0, 0, time.UTC)
+	err = reg.Update("b", func(r *Record) {
+		r.Name = "kofi"
+		r.AddAddr("127.0.0.1:7000")
+		r.AddAddr("127.0.0.1:7001")
+		r.AddAddr("127.0.0.1:7000")
+		r.LastSeen = seen
+		r.Status = Active
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	// a registry opened later, as if by another process, sees the update
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := reopened.Get("b")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if rec.Name != "kofi" || !rec.LastSeen.Equal(seen) || rec.Status != Active {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+	if want := []string{"127.0.0.1:7000", "127.0.0.1:7001"}; fmt.Sprint(rec.Addrs) != fmt.Sprint(want) {
+		t.Fatalf("want addrs %v; got %v", want, rec.Addrs)
+	}
+
+	if err := reopened.Delete("b"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := reg.Get("b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound after delete; got %v", err)
+	}
+}
+
+func TestRegistryConcurrentUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// separate registries share nothing but the file
+			reg, err := Open(path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := reg.Update(fmt.Sprint(i), func(r *Record) { r.Status = Active }); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	reg, _ := Open(path)
+	records, err := reg.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(records) != 20 {
+		t.Fatalf("want 20 records; got %d", len(records))
+	}
+}
+
+func TestRegistrySeenResolution(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	reg, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := time.Date(2022, time.January, 28, 12, 0, 0, 0, time.UTC)
+	update := func(name string, at time.Time) {
+		t.Helper()
+		if err := reg.Update("b", func(r *Record) { r.Name, r.LastSeen = name, at }); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+	}
+	lastSeen := func() time.Time {
+		t.Helper()
+		rec, err := reg.Get("b")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		return rec.LastSeen
+	}
+
+	update("kofi", seen)
+	update("kofi", seen.Add(time.Second))
+	if got := lastSeen(); !got.Equal(seen) {
+		t.Fatalf("want an update of just LastSeen skipped; got %v", got)
+	}
+	update("kofi", seen.Add(SeenResolution))
+	if got := lastSeen(); !got.Equal(seen.Add(SeenResolution)) {
+		t.Fatalf("want a stale LastSeen written; got %v", got)
+	}
+	update("messi", seen.Add(SeenResolution+time.Second))
+	if got := lastSeen(); !got.Equal(seen.Add(SeenResolution + time.Second)) {
+		t.Fatalf("want the record written along with other changes; got %v", got)
+	}
+}
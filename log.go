@@ -0,0 +1,298 @@
+package zinc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Joe-Degs/zinc/internal/config"
+)
+
+// Level is the severity of a log entry.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l >= LevelDebug && l <= LevelError {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("Level(%d)", l)
+}
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Format is how log entries are written.
+type Format int
+
+const (
+	// FormatText writes an entry per line, the fields of the entry follow
+	// the message as key=value pairs.
+	FormatText Format = iota
+
+	// FormatJSON writes an entry per line as a json object.
+	FormatJSON
+
+	// FormatSyslog writes an entry per line in the format of RFC 5424, for
+	// log collectors that speak syslog.
+	FormatSyslog
+)
+
+var formatNames = []string{"text", "json", "syslog"}
+
+func (f Format) String() string {
+	if f >= FormatText && f <= FormatSyslog {
+		return formatNames[f]
+	}
+	return fmt.Sprintf("Format(%d)", f)
+}
+
+// ParseFormat returns the format with the given name.
+func ParseFormat(s string) (Format, error) {
+	for i, name := range formatNames {
+		if strings.EqualFold(s, name) {
+			return Format(i), nil
+		}
+	}
+	return FormatText, fmt.Errorf("unknown log format %q", s)
+}
+
+// A Field is a key-value pair attached to a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a field with the given key and value.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// sink is where the entries of a logger and the loggers derived from it end
+// up.
+type sink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+	level  int32
+}
+
+// A Logger writes levelled log entries with fields. A Logger is safe to use
+// from multiple goroutines, the loggers returned by With share the output and
+// level of the logger they are derived from.
+type Logger struct {
+	sink   *sink
+	fields []Field
+}
+
+// NewLogger returns a logger that writes the entries of level and above to w
+// in format.
+func NewLogger(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{sink: &sink{w: w, format: format, level: int32(level)}}
+}
+
+var defaultLogger = NewLogger(os.Stdout, LevelInfo, FormatText)
+
+// DefaultLogger returns the logger of the peers that are not given one.
+func DefaultLogger() *Logger {
+	return defaultLogger
+}
+
+// With returns a logger that adds fields to every entry.
+func (l *Logger) With(fields ...Field) *Logger {
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	return &Logger{sink: l.sink, fields: append(all, fields...)}
+}
+
+// SetLevel changes the lowest level of the entries that are written.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.sink.level, int32(level))
+}
+
+// Level returns the lowest level of the entries that are written.
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.sink.level))
+}
+
+// SetOutput makes the logger write to w in format.
+func (l *Logger) SetOutput(w io.Writer, format Format) {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.w, l.sink.format = w, format
+}
+
+// Enabled reports whether entries of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+func (l *Logger) log(level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	all := l.fields
+	if len(fields) > 0 {
+		all = make([]Field, 0, len(l.fields)+len(fields))
+		all = append(append(all, l.fields...), fields...)
+	}
+	now := time.Now()
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	b := new(bytes.Buffer)
+	switch l.sink.format {
+	case FormatJSON:
+		writeJSONEntry(b, now, level, msg, all)
+	case FormatSyslog:
+		writeSyslogEntry(b, now, level, msg, all)
+	default:
+		b.WriteString(now.Format("2006-01-02 15:04:05 "))
+		fmt.Fprintf(b, "%-5s %s", strings.ToUpper(level.String()), msg)
+		writeTextFields(b, all)
+	}
+	b.WriteByte('\n')
+	l.sink.w.Write(b.Bytes())
+}
+
+// fieldValue returns the value of a field as it is logged.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeTextFields(b *bytes.Buffer, fields []Field) {
+	for _, f := range fields {
+		s := fmt.Sprint(fieldValue(f.Value))
+		if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(b, " %s=%s", f.Key, s)
+	}
+}
+
+func writeJSONEntry(b *bytes.Buffer, now time.Time, level Level, msg string, fields []Field) {
+	entry := map[string]interface{}{
+		"time":  now.Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	for _, f := range fields {
+		entry[f.Key] = fieldValue(f.Value)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		// a field that does not marshal is logged as text.
+		for _, f := range fields {
+			entry[f.Key] = fmt.Sprint(fieldValue(f.Value))
+		}
+		data, _ = json.Marshal(entry)
+	}
+	b.Write(data)
+}
+
+// syslogSeverity are the severities of RFC 5424 for the levels.
+var syslogSeverity = []int{7, 6, 4, 3}
+
+// syslogDaemon is the facility of system daemons in RFC 5424.
+const syslogDaemon = 3
+
+var hostname = func() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "-"
+	}
+	return name
+}()
+
+func writeSyslogEntry(b *bytes.Buffer, now time.Time, level Level, msg string, fields []Field) {
+	fmt.Fprintf(b, "<%d>1 %s %s zinc %d - - %s",
+		syslogDaemon*8+syslogSeverity[level], now.Format(time.RFC3339Nano), hostname, os.Getpid(), msg)
+	writeTextFields(b, fields)
+}
+
+// SetLogger makes the peer log to l, the entries of the peer carry its id.
+// It must be called before the peer is started.
+func (p *Peer) SetLogger(l *Logger) {
+	p.logger = l.With(F("peer_id", p.Id))
+}
+
+// Logger returns the logger of the peer.
+func (p *Peer) Logger() *Logger {
+	if p.logger == nil {
+		return defaultLogger
+	}
+	return p.logger
+}
+
+// configLogger returns the logger a peer config asks for. Entries are written
+// to stdout as text from the info level up unless the config says otherwise.
+func configLogger(conf *config.PeerConfig) (*Logger, error) {
+	level, format := LevelInfo, FormatText
+	var err error
+	if conf.LogLevel != "" {
+		if level, err = ParseLevel(conf.LogLevel); err != nil {
+			return nil, err
+		}
+	}
+	if conf.LogFormat != "" {
+		if format, err = ParseFormat(conf.LogFormat); err != nil {
+			return nil, err
+		}
+	}
+	var w io.Writer = os.Stdout
+	if conf.LogFile != "" {
+		f, err := os.OpenFile(conf.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return NewLogger(w, level, format), nil
+}
+
+// ZPrintf logs a message at the info level with the default logger.
+//
+// Deprecated: use the levelled methods of a Logger.
+func ZPrintf(format string, v ...interface{}) {
+	defaultLogger.Info(fmt.Sprintf(format, v...))
+}
+
+// ZErrorf logs a message at the error level with the default logger.
+//
+// Deprecated: use the levelled methods of a Logger.
+func ZErrorf(format string, v ...interface{}) {
+	defaultLogger.Error(fmt.Sprintf(format, v...))
+}
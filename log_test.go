@@ -0,0 +1,164 @@
+package zinc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a buffer the goroutines of a peer can log to while a test
+// reads it.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestLoggerLevels(t *testing.T) {
+	b := new(bytes.Buffer)
+	l := NewLogger(b, LevelWarn, FormatText)
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error")
+	if got := strings.Count(b.String(), "\n"); got != 2 {
+		t.Fatalf("want 2 entries at warn; got %d:\n%s", got, b)
+	}
+	if strings.Contains(b.String(), "info") {
+		t.Fatalf("want no info entries at warn:\n%s", b)
+	}
+
+	// loggers made with With share the level
+	l.With(F("k", "v")).SetLevel(LevelDebug)
+	l.Debug("debug")
+	if !strings.Contains(b.String(), "DEBUG debug") {
+		t.Fatalf("want debug entry after lowering the level:\n%s", b)
+	}
+
+	for _, name := range []string{"debug", "INFO", "Warn", "error"} {
+		if _, err := ParseLevel(name); err != nil {
+			t.Errorf("ParseLevel(%q): %v", name, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Errorf("want error parsing unknown level")
+	}
+}
+
+func TestLoggerFormats(t *testing.T) {
+	fields := []Field{
+		F("peer_id", "kofi"),
+		F("packet_type", Ping),
+		F("error", errors.New("no route to host")),
+		F("size", 42),
+	}
+
+	b := new(bytes.Buffer)
+	NewLogger(b, LevelInfo, FormatText).With(fields[0]).Info("hello", fields[1:]...)
+	want := `INFO  hello peer_id=kofi packet_type=Ping error="no route to host" size=42`
+	if !strings.HasSuffix(strings.TrimSpace(b.String()), want) {
+		t.Fatalf("want text entry ending with %s; got %s", want, b)
+	}
+
+	b.Reset()
+	NewLogger(b, LevelInfo, FormatJSON).Warn("hello", fields...)
+	var entry map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid json entry %s: %v", b, err)
+	}
+	for k, v := range map[string]interface{}{
+		"level":       "warn",
+		"msg":         "hello",
+		"peer_id":     "kofi",
+		"packet_type": "Ping",
+		"error":       "no route to host",
+		"size":        float64(42),
+	} {
+		if entry[k] != v {
+			t.Errorf("want %s %v; got %v", k, v, entry[k])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(entry["time"])); err != nil {
+		t.Errorf("invalid time in entry: %v", err)
+	}
+
+	b.Reset()
+	NewLogger(b, LevelInfo, FormatSyslog).Error("hello", fields[0])
+	if !strings.HasPrefix(b.String(), "<27>1 ") || !strings.Contains(b.String(), " zinc ") {
+		t.Fatalf("want syslog entry of an error of a daemon; got %s", b)
+	}
+}
+
+func TestLoggerConcurrent(t *testing.T) {
+	b := new(bytes.Buffer)
+	l := NewLogger(b, LevelDebug, FormatText)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.With(F("goroutine", i)).Error("entry", F("n", j))
+			}
+		}(i)
+	}
+	wg.Wait()
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 800 {
+		t.Fatalf("want 800 entries; got %d", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "ERROR entry goroutine=") {
+			t.Fatalf("garbled entry %q", line)
+		}
+	}
+}
+
+func TestPeerLogger(t *testing.T) {
+	b := new(syncBuffer)
+	p := RandomPeer("logged")
+	p.SetLogger(NewLogger(b, LevelDebug, FormatJSON))
+	cancel, err := p.StartServer()
+	if err != nil {
+		t.Fatalf("failed to start peer: %v", err)
+	}
+	defer func() {
+		cancel()
+		p.lstn.Close()
+	}()
+
+	pinger := startTestPeer(t, "pinger")
+	if _, err := pinger.Request(context.Background(), NewPacket(Ping, nil, p.LocalAddr.UDPAddr())); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+
+	waitFor(t, "the ping to be logged", func() bool {
+		return strings.Contains(b.String(), `"packet_type":"Ping"`)
+	})
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid json entry %s: %v", line, err)
+		}
+		if entry["peer_id"] != p.Id.String() {
+			t.Fatalf("want peer_id %s on every entry; got %s", p.Id, line)
+		}
+	}
+}
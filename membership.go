@@ -0,0 +1,573 @@
+package zinc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The membership of a cluster is kept up to date the way SWIM does it. Every
+// probe interval a cluster pings one of its members, going round the members
+// in a random order. A member that does not respond in time is pinged
+// indirectly through a few other members with a PingReq. A member nobody
+// could reach is suspected, and declared dead when it does not refute the
+// suspicion within the suspect timeout. Dead members are forgotten after the
+// dead timeout.
+//
+// Changes to the membership are gossiped as events piggybacked on the packets
+// the cluster sends anyway. Every event carries the incarnation of the member
+// it is about. Only a member increments its own incarnation, which it does to
+// refute suspicions about itself, so newer news about a member always wins.
+
+const (
+	// probeInterval is how often a member of the cluster is probed.
+	probeInterval = time.Second
+
+	// probeTimeout is how long to wait for the response to a probe.
+	probeTimeout = 500 * time.Millisecond
+
+	// suspectTimeout is how long a suspected member has to refute the
+	// suspicion before it is declared dead.
+	suspectTimeout = 5 * probeInterval
+
+	// deadTimeout is how long a dead member is kept around, long enough
+	// for the news of its death to go round, before it is forgotten.
+	deadTimeout = 30 * probeInterval
+
+	// indirectProbes is the number of members asked to probe a member that
+	// did not respond to a direct probe.
+	indirectProbes = 3
+
+	// gossipRetransmits scales the number of times an event is piggybacked,
+	// an event is sent gossipRetransmits * log2(n) times in a cluster of n
+	// members.
+	gossipRetransmits = 3
+)
+
+// gossiper attaches gossip to the packets of a peer and takes in the gossip
+// attached to the packets the peer recieves.
+type gossiper interface {
+	// piggyback returns as much gossip as fits in room bytes.
+	piggyback(room int) []byte
+
+	// absorb handles gossip recieved from addr.
+	absorb(addr *net.UDPAddr, gossip []byte)
+}
+
+type memberState uint8
+
+const (
+	stateAlive memberState = iota
+	stateSuspect
+	stateDead
+	stateLeft
+)
+
+func (s memberState) String() string {
+	switch s {
+	case stateAlive:
+		return "alive"
+	case stateSuspect:
+		return "suspect"
+	case stateDead:
+		return "dead"
+	case stateLeft:
+		return "left"
+	}
+	return fmt.Sprintf("memberState(%d)", s)
+}
+
+// memberEvent is news about the state of a member of the cluster.
+type memberEvent struct {
+	state       memberState
+	incarnation uint32
+	id          uuid.UUID
+	name        string
+	addr        string
+}
+
+func (e *memberEvent) marshal(b *bytes.Buffer) {
+	b.WriteByte(byte(e.state))
+	binary.Write(b, binary.BigEndian, e.incarnation)
+	b.Write(e.id[:])
+	writeString(b, e.name)
+	writeString(b, e.addr)
+}
+
+func (e *memberEvent) unmarshal(r *bytes.Reader) error {
+	state, err := r.ReadByte()
+	if err != nil {
+		return ErrShortPacket
+	}
+	e.state = memberState(state)
+	if err := binary.Read(r, binary.BigEndian, &e.incarnation); err != nil {
+		return ErrShortPacket
+	}
+	if _, err := io.ReadFull(r, e.id[:]); err != nil {
+		return ErrShortPacket
+	}
+	if e.name, err = readString(r); err != nil {
+		return err
+	}
+	e.addr, err = readString(r)
+	return err
+}
+
+// overrides reports whether the event is newer than what is known of a
+// member in state at incarnation. At the same incarnation worse news wins.
+func (e *memberEvent) overrides(state memberState, incarnation uint32) bool {
+	return e.incarnation > incarnation || (e.incarnation == incarnation && e.state > state)
+}
+
+func marshalEvents(events []memberEvent) []byte {
+	b := new(bytes.Buffer)
+	for i := range events {
+		events[i].marshal(b)
+	}
+	return b.Bytes()
+}
+
+func unmarshalEvents(data []byte) ([]memberEvent, error) {
+	var events []memberEvent
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		var e memberEvent
+		if err := e.unmarshal(r); err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// queuedEvent is an event waiting to be gossiped.
+type queuedEvent struct {
+	event     memberEvent
+	encoded   []byte
+	transmits int
+}
+
+// membership is the state of the failure detector and the gossip of a
+// cluster.
+type membership struct {
+	sync.Mutex
+	incarnation uint32
+	left        bool
+	size        int
+	queue       map[uuid.UUID]*queuedEvent
+	gone        map[uuid.UUID]uint32
+	order       []uuid.UUID
+	next        int
+
+	probeInterval  time.Duration
+	probeTimeout   time.Duration
+	suspectTimeout time.Duration
+	deadTimeout    time.Duration
+}
+
+func newMembership() *membership {
+	return &membership{
+		// a restarted member starts at an incarnation newer than the one it
+		// had before so its old death is not held against it.
+		incarnation:    uint32(time.Now().Unix()),
+		queue:          make(map[uuid.UUID]*queuedEvent),
+		gone:           make(map[uuid.UUID]uint32),
+		probeInterval:  probeInterval,
+		probeTimeout:   probeTimeout,
+		suspectTimeout: suspectTimeout,
+		deadTimeout:    deadTimeout,
+	}
+}
+
+// enqueue queues e to be gossiped, replacing older news about the same
+// member.
+func (m *membership) enqueue(e memberEvent) {
+	b := new(bytes.Buffer)
+	e.marshal(b)
+	m.Lock()
+	m.queue[e.id] = &queuedEvent{event: e, encoded: b.Bytes()}
+	m.Unlock()
+}
+
+// piggyback returns the queued events that fit in room bytes, the events
+// that have been sent the least go first.
+func (m *membership) piggyback(room int) []byte {
+	m.Lock()
+	defer m.Unlock()
+	if len(m.queue) == 0 || room <= 0 {
+		return nil
+	}
+
+	queued := make([]*queuedEvent, 0, len(m.queue))
+	for _, q := range m.queue {
+		queued = append(queued, q)
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].transmits < queued[j].transmits })
+
+	limit := gossipRetransmits * bits.Len(uint(m.size+1))
+	var gossip []byte
+	for _, q := range queued {
+		if len(gossip)+len(q.encoded) > room {
+			continue
+		}
+		gossip = append(gossip, q.encoded...)
+		if q.transmits++; q.transmits >= limit {
+			delete(m.queue, q.event.id)
+		}
+	}
+	return gossip
+}
+
+func (c *Cluster) piggyback(room int) []byte {
+	return c.membership.piggyback(room)
+}
+
+func (c *Cluster) absorb(addr *net.UDPAddr, gossip []byte) {
+	events, err := unmarshalEvents(gossip)
+	if err != nil {
+		c.Logger().Warn("invalid gossip", F("remote_addr", addr), F("error", err))
+	}
+	for _, e := range events {
+		c.apply(e)
+	}
+}
+
+// self returns the event announcing the state of the cluster itself.
+func (c *Cluster) self(state memberState) memberEvent {
+	c.membership.Lock()
+	defer c.membership.Unlock()
+	c.settings.RLock()
+	defer c.settings.RUnlock()
+	return memberEvent{
+		state:       state,
+		incarnation: c.membership.incarnation,
+		id:          c.Id,
+		name:        c.Name,
+		addr:        c.LocalAddr.String(),
+	}
+}
+
+// apply updates the membership with e and gossips it on when it is news.
+func (c *Cluster) apply(e memberEvent) {
+	m := c.membership
+	if e.id == c.Id {
+		// others think we are gone, tell them otherwise.
+		m.Lock()
+		refute := !m.left && (e.state == stateSuspect || e.state == stateDead) && e.incarnation >= m.incarnation
+		if refute {
+			m.incarnation = e.incarnation + 1
+		}
+		m.Unlock()
+		if refute {
+			c.Logger().Info("refuting gossip", F("state", e.state))
+			m.enqueue(c.self(stateAlive))
+		}
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := e.id.String()
+	n, ok := c.nodes[key]
+	if !ok {
+		m.Lock()
+		inc, gone := m.gone[e.id]
+		m.Unlock()
+		if e.state >= stateDead || (gone && e.incarnation <= inc) {
+			return
+		}
+		p, err := remotePeer(e.name, e.addr, e.id)
+		if err != nil {
+			c.Logger().Warn("ignoring gossip", F("member_id", e.id), F("error", err))
+			return
+		}
+		n = c.newNode(p)
+		n.setState(e.state, e.incarnation)
+		c.nodes[key] = n
+		c.membershipChanged()
+		c.Logger().Info("member joined", memberFields(n)...)
+		m.enqueue(e)
+		return
+	}
+
+	state, inc := n.memberState()
+	if !e.overrides(state, inc) {
+		return
+	}
+	if e.state == stateLeft {
+		delete(c.nodes, key)
+		m.Lock()
+		m.gone[e.id] = e.incarnation
+		m.Unlock()
+		c.membershipChanged()
+		c.Logger().Info("member left", memberFields(n)...)
+	} else {
+		if e.name != n.Name || (e.addr != n.LocalAddr.String() && !unspecified(e.addr)) {
+			// the member was renamed or moved to another address, nodes
+			// are shared with the probes so it gets a new one. Members
+			// listening on all interfaces stay where they were found.
+			p, err := remotePeer(e.name, e.addr, e.id)
+			if err != nil {
+				c.Logger().Warn("ignoring gossip", F("member_id", e.id), F("error", err))
+				return
+			}
+			n = c.newNode(p)
+			c.nodes[key] = n
+			c.membershipChanged()
+			c.Logger().Info("member moved", memberFields(n)...)
+		}
+		n.setState(e.state, e.incarnation)
+		if e.state != state {
+			c.Logger().Info("member is "+e.state.String(), memberFields(n)...)
+		}
+	}
+	m.enqueue(e)
+}
+
+// memberFields are the log fields about member n.
+func memberFields(n *Node) []Field {
+	return []Field{F("member_id", n.Id), F("member", n.Name), F("member_addr", n.LocalAddr)}
+}
+
+// membershipChanged resets the probe order and the number of times events
+// are gossiped after members come or go. c.mu must be held.
+func (c *Cluster) membershipChanged() {
+	m := c.membership
+	m.Lock()
+	m.size = len(c.nodes)
+	m.order, m.next = nil, 0
+	m.Unlock()
+}
+
+// events returns the state of the whole cluster as gossip.
+func (c *Cluster) events() []memberEvent {
+	events := []memberEvent{c.self(stateAlive)}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, n := range c.nodes {
+		state, inc := n.memberState()
+		events = append(events, memberEvent{
+			state:       state,
+			incarnation: inc,
+			id:          n.Id,
+			name:        n.Name,
+			addr:        n.LocalAddr.String(),
+		})
+	}
+	return events
+}
+
+// nextProbe returns the next member to probe, members are probed in a random
+// order that is shuffled after every round. Dead members are not probed.
+func (c *Cluster) nextProbe() *Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m := c.membership
+	m.Lock()
+	defer m.Unlock()
+	for tries := 0; tries < 2; tries++ {
+		for ; m.next < len(m.order); m.next++ {
+			n, ok := c.nodes[m.order[m.next].String()]
+			if !ok {
+				continue
+			}
+			if state, _ := n.memberState(); state < stateDead {
+				m.next++
+				return n
+			}
+		}
+		m.order, m.next = m.order[:0], 0
+		for _, n := range c.nodes {
+			m.order = append(m.order, n.Id)
+		}
+		rand.Shuffle(len(m.order), func(i, j int) { m.order[i], m.order[j] = m.order[j], m.order[i] })
+	}
+	return nil
+}
+
+// helpers returns up to k alive members other than target to probe target
+// through.
+func (c *Cluster) helpers(target *Node, k int) []*Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var alive []*Node
+	for _, n := range c.nodes {
+		if state, _ := n.memberState(); n != target && state == stateAlive {
+			alive = append(alive, n)
+		}
+	}
+	rand.Shuffle(len(alive), func(i, j int) { alive[i], alive[j] = alive[j], alive[i] })
+	if len(alive) > k {
+		alive = alive[:k]
+	}
+	return alive
+}
+
+// ping reports whether the member at addr responds to a ping in time.
+func (c *Cluster) ping(ctx context.Context, addr *net.UDPAddr) bool {
+	ctx, cancel := context.WithTimeout(ctx, c.membership.probeTimeout)
+	defer cancel()
+	resp, err := c.Request(ctx, NewPacket(Ping, nil, addr))
+	return err == nil && resp.Type() != Error
+}
+
+// probe checks that n is still around, directly first and through other
+// members when n does not respond. n is suspected if nobody reaches it.
+func (c *Cluster) probe(ctx context.Context, n *Node) {
+	addr := n.LocalAddr.UDPAddr()
+	if c.ping(ctx, addr) {
+		n.seen()
+		c.refreshPath(ctx, n)
+		return
+	}
+
+	helpers := c.helpers(n, indirectProbes)
+	reached := make(chan bool, len(helpers))
+	for _, h := range helpers {
+		go func(h *Node) {
+			ctx, cancel := context.WithTimeout(ctx, 2*c.membership.probeTimeout)
+			defer cancel()
+			resp, err := c.Request(ctx, NewPacket(PingReq, []byte(addr.String()), h.LocalAddr.UDPAddr()))
+			reached <- err == nil && resp.Type() == Ok
+		}(h)
+	}
+	for range helpers {
+		if <-reached {
+			n.seen()
+			return
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	state, inc := n.memberState()
+	if state == stateAlive {
+		c.apply(memberEvent{state: stateSuspect, incarnation: inc, id: n.Id, name: n.Name, addr: n.LocalAddr.String()})
+	}
+}
+
+// reap declares the members that have been suspected for too long dead and
+// forgets the ones that have been dead for too long.
+func (c *Cluster) reap() {
+	var dead []memberEvent
+	var gone []*Node
+	c.mu.RLock()
+	for _, n := range c.nodes {
+		n.mu.Lock()
+		switch {
+		case n.state == stateSuspect && time.Since(n.suspected) > c.membership.suspectTimeout:
+			dead = append(dead, memberEvent{state: stateDead, incarnation: n.incarnation, id: n.Id, name: n.Name, addr: n.LocalAddr.String()})
+		case n.state == stateDead && time.Since(n.died) > c.membership.deadTimeout:
+			gone = append(gone, n)
+		}
+		n.mu.Unlock()
+	}
+	c.mu.RUnlock()
+	for _, e := range dead {
+		c.apply(e)
+	}
+	if len(gone) > 0 {
+		c.forget(gone)
+	}
+}
+
+// forget removes dead members from the cluster. Like members that left, they
+// are not taken back on old news about them.
+func (c *Cluster) forget(nodes []*Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range nodes {
+		key := n.Id.String()
+		state, inc := n.memberState()
+		if c.nodes[key] != n || state != stateDead {
+			// the member came back or moved since it was found dead.
+			continue
+		}
+		delete(c.nodes, key)
+		c.membership.Lock()
+		c.membership.gone[n.Id] = inc
+		c.membership.Unlock()
+		c.Logger().Info("member forgotten", memberFields(n)...)
+	}
+	c.membershipChanged()
+}
+
+// runMembership runs the failure detector until ctx is done.
+func (c *Cluster) runMembership(ctx context.Context) {
+	ticker := time.NewTicker(c.membership.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := c.nextProbe(); n != nil {
+				c.probe(ctx, n)
+			}
+			c.reap()
+		}
+	}
+}
+
+// Join adds the cluster to the cluster of the peer at addr. The two exchange
+// everything they know about their members and the rest of the cluster hears
+// of the join through gossip.
+func (c *Cluster) Join(ctx context.Context, addr string) error {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Request(ctx, NewPacket(Gossip, marshalEvents(c.events()), raddr))
+	if err != nil {
+		return fmt.Errorf("joining %s: %w", addr, err)
+	}
+	if resp.Type() != Gossip {
+		return fmt.Errorf("joining %s: unexpected %s response", addr, resp.Type())
+	}
+	c.absorb(raddr, resp.Data())
+	return nil
+}
+
+// Leave tells the members of the cluster that it is leaving for good. The
+// cluster should be stopped after it has left.
+func (c *Cluster) Leave(ctx context.Context) error {
+	m := c.membership
+	m.Lock()
+	m.left = true
+	m.incarnation++
+	m.Unlock()
+	data := marshalEvents([]memberEvent{c.self(stateLeft)})
+
+	c.mu.RLock()
+	var alive []*Node
+	for _, n := range c.nodes {
+		if state, _ := n.memberState(); state == stateAlive {
+			alive = append(alive, n)
+		}
+	}
+	c.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, n := range alive {
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			if _, err := c.Request(ctx, NewPacket(Gossip, data, n.LocalAddr.UDPAddr())); err != nil {
+				c.Logger().Warn("telling member about leaving", append(memberFields(n), F("error", err))...)
+			}
+		}(n)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
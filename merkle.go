@@ -0,0 +1,128 @@
+package zinc
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"io"
+)
+
+// The content of a file is hashed into a merkle tree. Its leaves are the
+// hashes of the chunks of the file and every node above them is the hash of
+// its two children, a node without a sibling is carried up a level as it is.
+// The root of the tree goes out with the offer of the file. The leaves follow
+// in hash blocks, runs of leaves that make up a whole subtree sent along with
+// the hashes that lead from the subtree to the root, so the receiver checks
+// every hash block on its own and every chunk against its leaf as it arrives.
+// Leaves and nodes are hashed with different prefixes so one can't pass for
+// the other.
+
+type merkleHash = [sha256.Size]byte
+
+func leafHash(data []byte) merkleHash {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	var sum merkleHash
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func nodeHash(left, right merkleHash) merkleHash {
+	b := make([]byte, 1+2*sha256.Size)
+	b[0] = 1
+	copy(b[1:], left[:])
+	copy(b[1+sha256.Size:], right[:])
+	return sha256.Sum256(b)
+}
+
+// merkleTree holds every level of a merkle tree, the leaves first.
+type merkleTree struct {
+	levels [][]merkleHash
+}
+
+func newMerkleTree(leaves []merkleHash) *merkleTree {
+	t := &merkleTree{levels: [][]merkleHash{leaves}}
+	for level := leaves; len(level) > 1; {
+		up := make([]merkleHash, (len(level)+1)/2)
+		for i := range up {
+			if 2*i+1 < len(level) {
+				up[i] = nodeHash(level[2*i], level[2*i+1])
+			} else {
+				up[i] = level[2*i]
+			}
+		}
+		t.levels = append(t.levels, up)
+		level = up
+	}
+	return t
+}
+
+// hashChunks builds the merkle tree of the first size bytes of r cut into
+// chunks of chunkSize bytes.
+func hashChunks(r io.ReaderAt, size uint64, chunkSize uint32) (*merkleTree, error) {
+	var leaves []merkleHash
+	if size > 0 {
+		leaves = make([]merkleHash, 0, (size+uint64(chunkSize)-1)/uint64(chunkSize))
+	}
+	br := bufio.NewReaderSize(io.NewSectionReader(r, 0, int64(size)), 1<<16)
+	buf := make([]byte, chunkSize)
+	for left := size; left > 0; {
+		n := uint64(chunkSize)
+		if left < n {
+			n = left
+		}
+		if _, err := io.ReadFull(br, buf[:n]); err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, leafHash(buf[:n]))
+		left -= n
+	}
+	return newMerkleTree(leaves), nil
+}
+
+// root returns the root of the tree, the hash of nothing for an empty file.
+func (t *merkleTree) root() merkleHash {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		return sha256.Sum256(nil)
+	}
+	return top[0]
+}
+
+// proof returns the hashes that lead from the node at index of level up to
+// the root, the lowest first.
+func (t *merkleTree) proof(level, index int) []merkleHash {
+	var proof []merkleHash
+	for ; level < len(t.levels)-1; level++ {
+		nodes := t.levels[level]
+		switch {
+		case index%2 == 1:
+			proof = append(proof, nodes[index-1])
+		case index+1 < len(nodes):
+			proof = append(proof, nodes[index+1])
+		}
+		index /= 2
+	}
+	return proof
+}
+
+// verifyProof reports whether proof leads from node, at index of a level of
+// width nodes, to root.
+func verifyProof(root, node merkleHash, index, width int, proof []merkleHash) bool {
+	for ; width > 1; width = (width + 1) / 2 {
+		switch {
+		case index%2 == 1:
+			if len(proof) == 0 {
+				return false
+			}
+			node, proof = nodeHash(proof[0], node), proof[1:]
+		case index+1 < width:
+			if len(proof) == 0 {
+				return false
+			}
+			node, proof = nodeHash(node, proof[0]), proof[1:]
+		}
+		index /= 2
+	}
+	return len(proof) == 0 && node == root
+}
@@ -0,0 +1,152 @@
+package zinc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMerkleProof(t *testing.T) {
+	if root := newMerkleTree(nil).root(); root != sha256.Sum256(nil) {
+		t.Fatalf("want the hash of nothing as the root of no leaves; got %x", root)
+	}
+	for n := 1; n <= 33; n++ {
+		leaves := make([]merkleHash, n)
+		for i := range leaves {
+			leaves[i] = leafHash([]byte{byte(i)})
+		}
+		tree := newMerkleTree(leaves)
+		root := tree.root()
+		for level, nodes := range tree.levels {
+			for i, node := range nodes {
+				proof := tree.proof(level, i)
+				if !verifyProof(root, node, i, len(nodes), proof) {
+					t.Fatalf("%d leaves: proof of node %d at level %d does not verify", n, i, level)
+				}
+				if other := leafHash([]byte("other")); verifyProof(root, other, i, len(nodes), proof) {
+					t.Fatalf("%d leaves: proof verifies the wrong node", n)
+				}
+				if len(proof) > 0 && verifyProof(root, node, i, len(nodes), proof[:len(proof)-1]) {
+					t.Fatalf("%d leaves: short proof verifies", n)
+				}
+			}
+		}
+	}
+}
+
+func TestOfferHashBlocks(t *testing.T) {
+	for _, o := range []fileOffer{
+		{size: 1, chunkSize: defaultChunkSize},
+		{size: 300*defaultChunkSize + 17, chunkSize: defaultChunkSize},
+		{size: 1 << 40, chunkSize: defaultChunkSize},
+		{size: 1 << 30, chunkSize: maxProbedMTU - packetHeaderLen - fileChunkHeaderLen - sealOverhead},
+	} {
+		k := o.blockLeaves()
+		proof := 0
+		for w := o.hashBlocks(); w > 1; w = (w + 1) / 2 {
+			proof++
+		}
+		if k&(k-1) != 0 || int(k)*sha256.Size+proof*sha256.Size > int(o.chunkSize) {
+			t.Errorf("size %d: hash blocks of %d leaves and %d proof hashes don't fit chunks of %d bytes", o.size, k, proof, o.chunkSize)
+		}
+	}
+}
+
+// corruptConn flips a byte in the first copy of every chunk and hash block
+// whose index is a multiple of every, and fixes up the checksum of the
+// packet so the corruption gets past it.
+type corruptConn struct {
+	*net.UDPConn
+	sync.Mutex
+	every   uint32
+	corrupt map[uint32]int
+}
+
+func (c *corruptConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if len(b) > packetHeaderLen+fileChunkHeaderLen && PacketType(b[offType]) == FileChunk {
+		index := binary.BigEndian.Uint32(b[packetHeaderLen+8:])
+		c.Lock()
+		c.corrupt[index]++
+		first := c.corrupt[index] == 1
+		c.Unlock()
+		if first && index%c.every == 0 {
+			b = append([]byte(nil), b...)
+			b[len(b)-1] ^= 0xff
+			binary.BigEndian.PutUint32(b[offChecksum:], checksum(b))
+		}
+	}
+	return c.UDPConn.WriteToUDP(b, addr)
+}
+
+func TestSendFileCorruptChunks(t *testing.T) {
+	wire := &corruptConn{every: 7, corrupt: make(map[uint32]int)}
+	sender := startTestPeer(t, "sender", func(p *Peer) {
+		wire.UDPConn = p.lstn
+		p.wire = wire
+	})
+	receiver := startTestPeer(t, "receiver")
+	raddr := receiver.lstn.LocalAddr().(*net.UDPAddr)
+
+	want := make([]byte, 300*defaultChunkSize+17)
+	rand.Read(want)
+	name := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(name, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := sender.SendFile(ctx, name, raddr, nil); err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(receiver.ReceiveDir, "file"))
+	if err != nil {
+		t.Fatalf("reading recieved file: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("recieved file differs from sent file")
+	}
+
+	wire.Lock()
+	defer wire.Unlock()
+	for index, sent := range wire.corrupt {
+		if index%wire.every == 0 && sent < 2 {
+			t.Errorf("want corrupt chunk %d sent again", index)
+		}
+	}
+}
+
+func TestFinishCorrupt(t *testing.T) {
+	p := RandomPeer("receiver")
+	defer p.lstn.Close()
+	p.ReceiveDir = t.TempDir()
+
+	data := make([]byte, 3*defaultChunkSize)
+	rand.Read(data)
+	tree, err := hashChunks(bytes.NewReader(data), uint64(len(data)), defaultChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := fileOffer{id: 1, size: uint64(len(data)), chunkSize: defaultChunkSize, root: tree.root(), name: "file"}
+	in, err := p.accept(offer, &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0xff
+	if _, err := in.file.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.finish(); err != ErrTransferCorrupt {
+		t.Fatalf("want ErrTransferCorrupt; got %v", err)
+	}
+	if entries, _ := os.ReadDir(p.ReceiveDir); len(entries) != 0 {
+		t.Fatalf("want the corrupt file thrown away; got %d files", len(entries))
+	}
+}
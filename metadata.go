@@ -0,0 +1,213 @@
+package zinc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileMeta is the state of a file that is carried along with its content so
+// the file recieved by a peer looks just like the file that was sent.
+type FileMeta struct {
+	Mode       os.FileMode
+	Uid        uint32
+	Gid        uint32
+	User       string
+	Group      string
+	ModTime    time.Time
+	AccessTime time.Time
+
+	// Link is the target of a symbolic link, a symbolic link is transferred
+	// without any content.
+	Link string
+
+	// Xattrs are the extended attributes of the file.
+	Xattrs map[string][]byte
+}
+
+// ReadFileMeta returns the metadata of the file with the given name. The
+// metadata of a symbolic link describes the link itself and not its target.
+func ReadFileMeta(name string) (*FileMeta, error) {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	meta := &FileMeta{
+		Mode:       info.Mode(),
+		ModTime:    info.ModTime(),
+		AccessTime: info.ModTime(),
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if meta.Link, err = os.Readlink(name); err != nil {
+			return nil, err
+		}
+	}
+	if err := readSysMeta(name, info, meta); err != nil {
+		return nil, err
+	}
+	if u, err := user.LookupId(strconv.Itoa(int(meta.Uid))); err == nil {
+		meta.User = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(int(meta.Gid))); err == nil {
+		meta.Group = g.Name
+	}
+	return meta, nil
+}
+
+// Apply sets the metadata on the file with the given name. Attributes that
+// could not be applied don't stop the rest from being applied, they are
+// returned as a list describing what went wrong with each of them.
+//
+// The owner is only applied when owner is set, the file is left to whoever
+// recieves it otherwise. Owners are looked up by name first and fall back to
+// the numeric ids when the names don't exist on this system. The setuid and
+// setgid bits and the extended attributes outside the user namespace are only
+// set on a file that got the owner it was sent with. Times are not applied to
+// symbolic links.
+func (m *FileMeta) Apply(name string, owner bool) (unapplied []string) {
+	fail := func(attr string, err error) {
+		unapplied = append(unapplied, fmt.Sprintf("%s: %v", attr, err))
+	}
+
+	owned := false
+	if owner {
+		uid, gid := int(m.Uid), int(m.Gid)
+		if u, err := user.Lookup(m.User); m.User != "" && err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		if g, err := user.LookupGroup(m.Group); m.Group != "" && err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		if err := os.Lchown(name, uid, gid); err != nil {
+			fail("owner", err)
+		} else {
+			owned = true
+		}
+	}
+
+	if m.Link != "" {
+		return
+	}
+
+	// chown clears the setuid and setgid bits so the mode is set after it.
+	mode := m.Mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if !owned && mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		mode &^= os.ModeSetuid | os.ModeSetgid
+		unapplied = append(unapplied, "mode: setuid and setgid dropped on a file not owned as sent")
+	}
+	if err := os.Chmod(name, mode); err != nil {
+		fail("mode", err)
+	}
+
+	keys := make([]string, 0, len(m.Xattrs))
+	for k := range m.Xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// attributes outside the user namespace grant capabilities and
+		// security labels, they are only trusted along with the owner.
+		if !strings.HasPrefix(k, "user.") && !owned {
+			unapplied = append(unapplied, fmt.Sprintf("xattr %s: only user attributes are set on a file not owned as sent", k))
+			continue
+		}
+		if err := setXattr(name, k, m.Xattrs[k]); err != nil {
+			fail("xattr "+k, err)
+		}
+	}
+
+	if err := os.Chtimes(name, m.AccessTime, m.ModTime); err != nil {
+		fail("times", err)
+	}
+	return
+}
+
+func (m *FileMeta) marshal() []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, uint32(m.Mode))
+	binary.Write(b, binary.BigEndian, m.Uid)
+	binary.Write(b, binary.BigEndian, m.Gid)
+	binary.Write(b, binary.BigEndian, m.ModTime.UnixNano())
+	binary.Write(b, binary.BigEndian, m.AccessTime.UnixNano())
+	writeString(b, m.User)
+	writeString(b, m.Group)
+	writeString(b, m.Link)
+
+	keys := make([]string, 0, len(m.Xattrs))
+	for k := range m.Xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	binary.Write(b, binary.BigEndian, uint16(len(keys)))
+	for _, k := range keys {
+		writeString(b, k)
+		writeString(b, string(m.Xattrs[k]))
+	}
+	return b.Bytes()
+}
+
+func (m *FileMeta) unmarshal(data []byte) error {
+	r := bytes.NewReader(data)
+	var mode uint32
+	var mtime, atime int64
+	for _, v := range []interface{}{&mode, &m.Uid, &m.Gid, &mtime, &atime} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return ErrShortPacket
+		}
+	}
+	m.Mode = os.FileMode(mode)
+	m.ModTime = time.Unix(0, mtime)
+	m.AccessTime = time.Unix(0, atime)
+	for _, s := range []*string{&m.User, &m.Group, &m.Link} {
+		var err error
+		if *s, err = readString(r); err != nil {
+			return err
+		}
+	}
+
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return ErrShortPacket
+	}
+	if n > 0 {
+		m.Xattrs = make(map[string][]byte, n)
+	}
+	for i := 0; i < int(n); i++ {
+		k, err := readString(r)
+		if err != nil {
+			return err
+		}
+		v, err := readString(r)
+		if err != nil {
+			return err
+		}
+		m.Xattrs[k] = []byte(v)
+	}
+	return nil
+}
+
+// writeString writes s prefixed with its length to b.
+func writeString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+// readString reads a string written with writeString from r.
+func readString(r *bytes.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", ErrShortPacket
+	}
+	s := make([]byte, n)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", ErrShortPacket
+	}
+	return string(s), nil
+}
@@ -0,0 +1,80 @@
+package zinc
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileOwner returns the uid of the owner of the file described by info.
+func fileOwner(info os.FileInfo) (int, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), true
+	}
+	return 0, false
+}
+
+// readSysMeta fills in the parts of meta only the operating system knows
+// about.
+func readSysMeta(name string, info os.FileInfo, meta *FileMeta) error {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		meta.Uid, meta.Gid = st.Uid, st.Gid
+		meta.AccessTime = time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+	}
+	if meta.Link != "" {
+		return nil
+	}
+
+	xattrs, err := listXattrs(name)
+	if err != nil {
+		return err
+	}
+	for _, attr := range xattrs {
+		val, err := getXattr(name, attr)
+		if err != nil {
+			return err
+		}
+		if meta.Xattrs == nil {
+			meta.Xattrs = make(map[string][]byte)
+		}
+		meta.Xattrs[attr] = val
+	}
+	return nil
+}
+
+func listXattrs(name string) ([]string, error) {
+	sz, err := syscall.Listxattr(name, nil)
+	if err == syscall.ENOTSUP || sz == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, sz)
+	if sz, err = syscall.Listxattr(name, buf); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, attr := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(attr) > 0 {
+			names = append(names, string(attr))
+		}
+	}
+	return names, nil
+}
+
+func getXattr(name, attr string) ([]byte, error) {
+	sz, err := syscall.Getxattr(name, attr, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, sz)
+	if sz, err = syscall.Getxattr(name, attr, buf); err != nil {
+		return nil, err
+	}
+	return buf[:sz], nil
+}
+
+func setXattr(name, attr string, val []byte) error {
+	return syscall.Setxattr(name, attr, val, 0)
+}
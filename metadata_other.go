@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package zinc
+
+import (
+	"errors"
+	"os"
+)
+
+var errXattrUnsupported = errors.New("extended attributes not supported on this platform")
+
+// readSysMeta fills in the parts of meta only the operating system knows
+// about. Ownership and extended attributes are only read on linux.
+func readSysMeta(name string, info os.FileInfo, meta *FileMeta) error {
+	return nil
+}
+
+// fileOwner returns the uid of the owner of the file described by info, it is
+// only known on linux.
+func fileOwner(info os.FileInfo) (int, bool) {
+	return 0, false
+}
+
+func setXattr(name, attr string, val []byte) error {
+	return errXattrUnsupported
+}
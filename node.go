@@ -1,6 +1,10 @@
 package zinc
 
-import "time"
+import (
+	"fmt"
+	"sync"
+	"time"
+)
 
 type NodeStatus bool
 
@@ -9,6 +13,13 @@ const (
 	INACTIVE NodeStatus = false
 )
 
+func (s NodeStatus) String() string {
+	if s == ACTIVE {
+		return "ACTIVE"
+	}
+	return "INACTIVE"
+}
+
 type connection struct {
 	// if the connection is open
 	active bool
@@ -24,6 +35,16 @@ type Node struct {
 	*Peer
 	Status     NodeStatus `json:"status"`
 	connStatus connection
+
+	// local is the peer whose socket packets to the node are sent through.
+	local *Peer
+	mu    sync.Mutex
+
+	// the state of the node as far as the membership of its cluster knows.
+	state       memberState
+	incarnation uint32
+	suspected   time.Time
+	died        time.Time
 }
 
 func NewNode(p *Peer) *Node {
@@ -33,6 +54,60 @@ func NewNode(p *Peer) *Node {
 	}
 }
 
-func (n *Node) Send(b []byte) error {
+// setState updates the membership state of the node. Suspected nodes are
+// still active, dead nodes and nodes that left are not.
+func (n *Node) setState(state memberState, incarnation uint32) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if state == stateSuspect && n.state != stateSuspect {
+		n.suspected = time.Now()
+	}
+	if state == stateDead && n.state != stateDead {
+		n.died = time.Now()
+	}
+	n.state, n.incarnation = state, incarnation
+	n.Status = state < stateDead
+}
+
+func (n *Node) memberState() (memberState, uint32) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state, n.incarnation
+}
+
+// seen records that the node responded to a probe.
+func (n *Node) seen() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state < stateDead {
+		n.Status = ACTIVE
+	}
+	n.connStatus.lastUsed = time.Now()
+}
+
+// Send transmits packet to the node through the socket of the cluster the
+// node is a member of. The remote endpoint of the packet is ignored.
+func (n *Node) Send(packet Packet) error {
+	if n.local == nil {
+		return fmt.Errorf("node %s is not a member of a cluster", n.Id)
+	}
+	if n.LocalAddr == nil || !n.LocalAddr.IsValid() {
+		return fmt.Errorf("node %s has no address", n.Id)
+	}
+
+	err := n.local.SendToAddr(packet, n.LocalAddr.UDPAddr())
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		n.connStatus.active = false
+		return err
+	}
+	now := time.Now()
+	if !n.connStatus.active {
+		n.connStatus.timeOpened = now
+	}
+	n.connStatus.active = true
+	n.connStatus.lastUsed = now
 	return nil
 }
@@ -1,6 +1,10 @@
 package zinc
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"net"
 )
 
@@ -10,10 +14,16 @@ import (
 // of data that is in transit. The Packet is small and cannot be used to
 // transmit large amounts of data, but can be used to initiate the process to
 // send and recieve large amounts of data.
+//
+// The Id of a packet identifies the request the packet belongs to. Responses
+// carry the Id of the request they respond to so the requester can tell which
+// of its requests is being responded to. Packets that don't take part in a
+// request and response exchange have an Id of zero.
 type Packet interface {
 	Addr() *net.UDPAddr
 	Data() []byte
 	Type() PacketType
+	Id() uint32
 }
 
 //go:generate stringer -type=PacketType
@@ -21,45 +31,252 @@ type Packet interface {
 // help to decode bytes recieved through the connection
 type PacketType uint8
 
-// InternalHandlerFunc is an adapter to allow the definition of ordinary
-// functions that act on requests coming into the buffer.
-type InternalHandlerFunc func(Packet)
-
 const (
 	Error PacketType = iota
 	Ping
 	Pong
 	PeerInfo
+	FileOffer
+	FileChunk
+	FileAck
+	FileComplete
+	Ok
+	SendFile
+	Shutdown
+	PingReq
+	Gossip
+	Announce
+	Handshake
+	ListPeers
+	Status
+	Members
+	Join
+	Leave
+	BroadcastPing
+	Busy
+	PathProbe
+	Transfers
+	ResumeTransfer
+	CancelTransfer
+)
+
+// Every packet starts with a header of packetHeaderLen bytes:
+//
+//	magic    2 bytes  "zn", tells zinc packets from stray datagrams
+//	version  1 byte   the version of the header
+//	flags    1 byte
+//	type     1 byte
+//	id       4 bytes  the id of the request the packet belongs to
+//	seq      4 bytes  the sequence number of the reliable delivery layer
+//	length   2 bytes  the length of the data that follows the header
+//	checksum 4 bytes  CRC-32C of the header and the data
+//
+// Multi byte fields are big endian and the checksum is computed with the
+// checksum field zeroed. A packet with the flagGossip flag carries membership
+// gossip after its data: a two byte length followed by the gossip. The
+// gossip is not counted in the length of the packet but is covered by its
+// checksum, so it is only taken in once the packet checks out.
+//
+// The magic and the version stay where they are in every version of the
+// header, so a peer can always tell a packet of a version it does not know
+// from garbage. Such packets, and packets with flags the peer does not know,
+// are rejected with ErrUnknownVersion rather than misread: a peer talks only
+// to the peers that speak its version.
+
+// flags of the packet header.
+const (
+	// flagReliable marks a packet that must be acknowledged.
+	flagReliable uint8 = 1 << iota
+
+	// flagAck marks a packet that acknowledges a reliable packet.
+	flagAck
+
+	// flagSealed marks a packet that is encrypted with the keys of a session.
+	flagSealed
+
+	// flagGossip marks a packet that has gossip attached to its data.
+	flagGossip
+
+	// knownFlags are the flags of the version of the header.
+	knownFlags = flagReliable | flagAck | flagSealed | flagGossip
+)
+
+// offsets of the fields of the packet header.
+const (
+	offVersion  = 2
+	offFlags    = 3
+	offType     = 4
+	offId       = 5
+	offSeq      = 9
+	offLength   = 13
+	offChecksum = 15
 )
 
+const (
+	// packetVersion is the version of the packet header written by
+	// MarshalPacket.
+	packetVersion = 3
+
+	// packetHeaderLen is the number of bytes MarshalPacket adds in front of
+	// the data of a packet.
+	packetHeaderLen = 19
+
+	// maxDatagramSize is the largest payload a udp datagram can carry.
+	maxDatagramSize = 65507
+
+	// maxPacketData is the most data a packet can carry.
+	maxPacketData = maxDatagramSize - packetHeaderLen
+
+	// defaultMTU is the ethernet mtu less the ipv6 and udp headers. Datagrams
+	// larger than this risk getting fragmented or dropped along the way.
+	defaultMTU = 1452
+)
+
+var packetMagic = [2]byte{'z', 'n'}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 // requestWrapper implements a zinc package Packet and it represents any packet comming
 // into the wire. It store state information about the data and its sender to
 // aid in subsequent processing of the data.
 type requestWrapper struct {
-	addr *net.UDPAddr
-	typ  PacketType
-	data []byte
+	addr  *net.UDPAddr
+	typ   PacketType
+	id    uint32
+	flags uint8
+	seq   uint32
+	data  []byte
+
+	// gossip is the membership gossip attached to the packet.
+	gossip []byte
+}
+
+// NewPacket returns a packet of type typ carrying data that is to be sent to
+// addr.
+func NewPacket(typ PacketType, data []byte, addr *net.UDPAddr) Packet {
+	return &requestWrapper{typ: typ, data: data, addr: addr}
+}
+
+// responseTo returns a packet of type typ that responds to req. The response
+// is addressed to the sender of req and carries the id of req.
+func responseTo(req Packet, typ PacketType, data []byte) Packet {
+	return &requestWrapper{typ: typ, id: req.Id(), data: data, addr: req.Addr()}
 }
 
 func (r requestWrapper) Addr() *net.UDPAddr                   { return r.addr }
 func (r requestWrapper) Data() []byte                         { return r.data }
 func (r requestWrapper) Type() PacketType                     { return r.typ }
+func (r requestWrapper) Id() uint32                           { return r.id }
 func (r *requestWrapper) setRemoteEndPoint(addr *net.UDPAddr) { r.addr = addr }
 
+// sequenced is implemented by packets that carry the state of the reliable
+// delivery layer in their headers.
+type sequenced interface {
+	sequence() (flags uint8, seq uint32)
+}
+
+func (r requestWrapper) sequence() (uint8, uint32) { return r.flags, r.seq }
+
+var (
+	ErrShortPacket    = errors.New("packet too short")
+	ErrNotZinc        = errors.New("not a zinc packet")
+	ErrUnknownVersion = errors.New("unknown packet version")
+	ErrCorruptPacket  = errors.New("corrupt packet")
+	ErrPacketTooLarge = errors.New("packet too large")
+	ErrTrailingData   = errors.New("trailing data after packet")
+)
+
+// attachGossip returns a copy of the marshaled packet b with gossip attached
+// to the end of it and its checksum updated to cover the gossip.
+func attachGossip(b, gossip []byte) []byte {
+	out := make([]byte, len(b), len(b)+2+len(gossip))
+	copy(out, b)
+	out[offFlags] |= flagGossip
+	out = append(out, byte(len(gossip)>>8), byte(len(gossip)))
+	out = append(out, gossip...)
+	binary.BigEndian.PutUint32(out[offChecksum:], checksum(out))
+	return out
+}
+
 // MarshalPacket returns packet as a slice of bytes that can be send over wire.
 func MarshalPacket(p Packet) ([]byte, error) {
-	packet := make([]byte, 1+len(p.Data()))
-	packet[0] = byte(p.Type())
-	copy(packet[1:], p.Data())
+	if len(p.Data()) > maxPacketData {
+		return nil, fmt.Errorf("%w: %d bytes of %s data", ErrPacketTooLarge, len(p.Data()), p.Type())
+	}
+	packet := make([]byte, packetHeaderLen+len(p.Data()))
+	copy(packet, packetMagic[:])
+	packet[offVersion] = packetVersion
+	if s, ok := p.(sequenced); ok {
+		flags, seq := s.sequence()
+		// gossip is attached by attachGossip on the way out.
+		packet[offFlags] = flags &^ flagGossip
+		binary.BigEndian.PutUint32(packet[offSeq:], seq)
+	}
+	packet[offType] = byte(p.Type())
+	binary.BigEndian.PutUint32(packet[offId:], p.Id())
+	binary.BigEndian.PutUint16(packet[offLength:], uint16(len(p.Data())))
+	copy(packet[packetHeaderLen:], p.Data())
+	binary.BigEndian.PutUint32(packet[offChecksum:], checksum(packet))
 	return packet, nil
 }
 
-// Unmarshal turns an Packet of bytes into a Packet but without the remote
-// endpoint from which the packet came from
+// UnmarshalPacket turns a marshaled packet back into a Packet, without the
+// remote endpoint it came from. buf must hold exactly one packet and the
+// gossip attached to it, the data of the packet shares its memory with buf.
 func UnmarshalPacket(buf []byte) (Packet, error) {
+	if len(buf) < offFlags+1 {
+		return nil, ErrShortPacket
+	}
+	if buf[0] != packetMagic[0] || buf[1] != packetMagic[1] {
+		return nil, ErrNotZinc
+	}
+	if buf[offVersion] != packetVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnknownVersion, buf[offVersion])
+	}
+	if len(buf) < packetHeaderLen {
+		return nil, ErrShortPacket
+	}
+	length := int(binary.BigEndian.Uint16(buf[offLength:]))
+	end := packetHeaderLen + length
+	if len(buf) < end {
+		return nil, fmt.Errorf("%w: %d of %d data bytes", ErrShortPacket, len(buf)-packetHeaderLen, length)
+	}
+	var gossip []byte
+	if buf[offFlags]&flagGossip != 0 {
+		if len(buf) < end+2 {
+			return nil, fmt.Errorf("%w: missing gossip length", ErrShortPacket)
+		}
+		n := int(binary.BigEndian.Uint16(buf[end:]))
+		if len(buf) < end+2+n {
+			return nil, fmt.Errorf("%w: %d of %d gossip bytes", ErrShortPacket, len(buf)-end-2, n)
+		}
+		gossip, end = buf[end+2:end+2+n], end+2+n
+	}
+	if len(buf) > end {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTrailingData, len(buf)-end)
+	}
+	if sum := binary.BigEndian.Uint32(buf[offChecksum:]); sum != checksum(buf) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptPacket)
+	}
+	if flags := buf[offFlags]; flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("%w: flags %#x", ErrUnknownVersion, flags)
+	}
 	p := &requestWrapper{
-		typ:  PacketType(buf[0]),
-		data: buf[1:],
+		flags: buf[offFlags],
+		typ:   PacketType(buf[offType]),
+		id:    binary.BigEndian.Uint32(buf[offId:]),
+		seq:   binary.BigEndian.Uint32(buf[offSeq:]),
+		data:  buf[packetHeaderLen : packetHeaderLen+length],
+
+		gossip: gossip,
 	}
 	return p, nil
 }
+
+// checksum returns the checksum of the marshaled packet b, the checksum field
+// is taken to be zero.
+func checksum(b []byte) uint32 {
+	sum := crc32.Update(0, castagnoli, b[:offChecksum])
+	sum = crc32.Update(sum, castagnoli, make([]byte, 4))
+	return crc32.Update(sum, castagnoli, b[packetHeaderLen:])
+}
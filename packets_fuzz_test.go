@@ -0,0 +1,44 @@
+//go:build go1.18
+// +build go1.18
+
+package zinc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzUnmarshalPacket(f *testing.F) {
+	for _, p := range []Packet{
+		NewPacket(Ping, nil, nil),
+		NewPacket(FileChunk, []byte("some file data"), nil),
+		&requestWrapper{typ: Gossip, id: 42, flags: flagReliable | flagSealed, seq: 7, data: []byte{0}},
+	} {
+		b, err := MarshalPacket(p)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+		f.Add(attachGossip(b, []byte("gossip")))
+	}
+	f.Add([]byte{})
+	f.Add([]byte("zn"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		packet, err := UnmarshalPacket(b)
+		if err != nil {
+			return
+		}
+		// a packet that unmarshals marshals back to the same bytes.
+		again, err := MarshalPacket(packet)
+		if err != nil {
+			t.Fatalf("MarshalPacket: %v", err)
+		}
+		if req := packet.(*requestWrapper); req.flags&flagGossip != 0 {
+			again = attachGossip(again, req.gossip)
+		}
+		if !bytes.Equal(again, b) {
+			t.Fatalf("packet changed marshaling it again:\n% x\n% x", b, again)
+		}
+	})
+}
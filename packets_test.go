@@ -0,0 +1,101 @@
+package zinc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestMarshalPacket(t *testing.T) {
+	want := &requestWrapper{typ: FileChunk, id: 42, flags: flagReliable, seq: 7, data: []byte("chunk")}
+	b, err := MarshalPacket(want)
+	if err != nil {
+		t.Fatalf("MarshalPacket: %v", err)
+	}
+	if len(b) != packetHeaderLen+len(want.data) || !bytes.HasPrefix(b, []byte("zn")) {
+		t.Fatalf("unexpected packet % x", b)
+	}
+	packet, err := UnmarshalPacket(b)
+	if err != nil {
+		t.Fatalf("UnmarshalPacket: %v", err)
+	}
+	got := packet.(*requestWrapper)
+	if got.typ != want.typ || got.id != want.id || got.flags != want.flags || got.seq != want.seq ||
+		!bytes.Equal(got.data, want.data) {
+		t.Fatalf("want %+v; got %+v", want, got)
+	}
+
+	if _, err := MarshalPacket(NewPacket(FileChunk, make([]byte, maxPacketData+1), nil)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("want ErrPacketTooLarge; got %v", err)
+	}
+}
+
+func TestUnmarshalPacketErrors(t *testing.T) {
+	valid, err := MarshalPacket(NewPacket(Ping, []byte("hello"), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), valid...))
+	}
+
+	testCases := []struct {
+		name   string
+		packet []byte
+		want   error
+	}{
+		{"empty", nil, ErrShortPacket},
+		{"short header", valid[:packetHeaderLen-1], ErrShortPacket},
+		{"truncated data", valid[:len(valid)-1], ErrShortPacket},
+		{"trailing data", append(append([]byte(nil), valid...), 0), ErrTrailingData},
+		{"bad magic", edit(func(b []byte) []byte { b[0] = 'x'; return b }), ErrNotZinc},
+		{"old version", edit(func(b []byte) []byte { b[offVersion] = 2; return b }), ErrUnknownVersion},
+		{"new version", edit(func(b []byte) []byte { b[offVersion] = 4; return b }), ErrUnknownVersion},
+		{"flipped bit", edit(func(b []byte) []byte { b[len(b)-1] ^= 1; return b }), ErrCorruptPacket},
+		{"bad checksum", edit(func(b []byte) []byte { b[offChecksum] ^= 0xff; return b }), ErrCorruptPacket},
+		{"unknown flag", edit(func(b []byte) []byte {
+			b[offFlags] = 0x80
+			binary.BigEndian.PutUint32(b[offChecksum:], checksum(b))
+			return b
+		}), ErrUnknownVersion},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := UnmarshalPacket(tc.packet); !errors.Is(err, tc.want) {
+				t.Fatalf("want %v; got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestAttachGossip(t *testing.T) {
+	b, err := MarshalPacket(NewPacket(Ping, []byte("hello"), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withGossip := attachGossip(b, []byte("news"))
+	packet, err := UnmarshalPacket(withGossip)
+	if err != nil {
+		t.Fatalf("UnmarshalPacket: %v", err)
+	}
+	if req := packet.(*requestWrapper); string(req.data) != "hello" || string(req.gossip) != "news" {
+		t.Fatalf("want packet and gossip back; got %q and %q", req.data, req.gossip)
+	}
+	if packet, err = UnmarshalPacket(b); err != nil || packet.(*requestWrapper).gossip != nil {
+		t.Fatalf("want no gossip; got %v", err)
+	}
+
+	// the gossip is checked along with the packet
+	corrupt := append([]byte(nil), withGossip...)
+	corrupt[len(corrupt)-1] ^= 1
+	if _, err := UnmarshalPacket(corrupt); !errors.Is(err, ErrCorruptPacket) {
+		t.Fatalf("want ErrCorruptPacket for corrupt gossip; got %v", err)
+	}
+	if _, err := UnmarshalPacket(withGossip[:len(withGossip)-1]); !errors.Is(err, ErrShortPacket) {
+		t.Fatalf("want ErrShortPacket for truncated gossip; got %v", err)
+	}
+	if _, err := UnmarshalPacket(append(b, "news"...)); !errors.Is(err, ErrTrailingData) {
+		t.Fatalf("want ErrTrailingData for gossip without the flag; got %v", err)
+	}
+}
@@ -12,11 +12,33 @@ func _() {
 	_ = x[Ping-1]
 	_ = x[Pong-2]
 	_ = x[PeerInfo-3]
+	_ = x[FileOffer-4]
+	_ = x[FileChunk-5]
+	_ = x[FileAck-6]
+	_ = x[FileComplete-7]
+	_ = x[Ok-8]
+	_ = x[SendFile-9]
+	_ = x[Shutdown-10]
+	_ = x[PingReq-11]
+	_ = x[Gossip-12]
+	_ = x[Announce-13]
+	_ = x[Handshake-14]
+	_ = x[ListPeers-15]
+	_ = x[Status-16]
+	_ = x[Members-17]
+	_ = x[Join-18]
+	_ = x[Leave-19]
+	_ = x[BroadcastPing-20]
+	_ = x[Busy-21]
+	_ = x[PathProbe-22]
+	_ = x[Transfers-23]
+	_ = x[ResumeTransfer-24]
+	_ = x[CancelTransfer-25]
 }
 
-const _PacketType_name = "ErrorPingPongPeerInfo"
+const _PacketType_name = "ErrorPingPongPeerInfoFileOfferFileChunkFileAckFileCompleteOkSendFileShutdownPingReqGossipAnnounceHandshakeListPeersStatusMembersJoinLeaveBroadcastPingBusyPathProbeTransfersResumeTransferCancelTransfer"
 
-var _PacketType_index = [...]uint8{0, 5, 9, 13, 21}
+var _PacketType_index = [...]uint8{0, 5, 9, 13, 21, 30, 39, 46, 58, 60, 68, 76, 83, 89, 97, 106, 115, 121, 128, 132, 137, 150, 154, 163, 172, 186, 200}
 
 func (i PacketType) String() string {
 	if i >= PacketType(len(_PacketType_index)-1) {
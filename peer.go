@@ -2,18 +2,20 @@ package zinc
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
-	"os/signal"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 
 	"github.com/Joe-Degs/zinc/internal/config"
 	"github.com/Joe-Degs/zinc/internal/netutil"
 	"github.com/Joe-Degs/zinc/internal/pool"
+	"github.com/Joe-Degs/zinc/internal/registry"
 	"github.com/google/uuid"
 	"inet.af/netaddr"
 )
@@ -24,9 +26,66 @@ type Peer struct {
 	Id        uuid.UUID       `json:"id"`
 	Name      string          `json:"name,omitempty"`
 	LocalAddr *netaddr.IPPort `json:"-"`
-	lstn      *net.UDPConn
-	recv      chan Packet
-	handlers  map[PacketType]InternalHandlerFunc
+
+	// PublicKey is the key the peer authenticates itself with, it is empty
+	// for peers that don't encrypt their packets.
+	PublicKey ed25519.PublicKey `json:"public_key,omitempty"`
+
+	// ReceiveDir is the directory files recieved from other peers are saved
+	// in. The zinc directory in the systems temporary directory is used when
+	// it is empty.
+	ReceiveDir string `json:"-"`
+
+	// StateDir is the directory transfers are checkpointed in so they can
+	// be resumed after the peer stops. Transfers are not checkpointed when
+	// it is empty.
+	StateDir string `json:"-"`
+
+	// ControlPath is the path of the unix socket local tools use to manage
+	// the peer. The peer is only managed through the network when it is
+	// empty.
+	ControlPath string `json:"-"`
+
+	// MaxFileSize is the largest file the peer accepts from other peers,
+	// DefaultMaxFileSize when it is zero.
+	MaxFileSize int64 `json:"-"`
+
+	// PreserveOwner makes the peer give the files it recieves the owners
+	// they were sent with, they belong to the user running the peer
+	// otherwise.
+	PreserveOwner bool `json:"-"`
+
+	// HandlerTimeout is how long a handler gets to serve a packet, the
+	// DefaultHandlerTimeout when it is zero.
+	HandlerTimeout time.Duration `json:"-"`
+
+	// Workers is the number of packets the peer serves at a time and
+	// QueueSize the number of packets that wait for a worker. The defaults
+	// are used when they are zero.
+	Workers   int `json:"-"`
+	QueueSize int `json:"-"`
+
+	lstn        *net.UDPConn
+	wire        transport
+	sock        *socket
+	settings    *settings
+	logger      *Logger
+	recv        chan Packet
+	router      *router
+	workers     *workers
+	server      *server
+	control     map[PacketType]ControlHandlerFunc
+	transfers   *transfers
+	pending     *pending
+	reliability *reliability
+	paths       *paths
+	gossip      gossiper
+	secure      *security
+	registry    *registry.Registry
+	done        chan struct{}
+	stopOnce    *sync.Once
+	restart     *bool
+	started     time.Time
 }
 
 // Returns a peer with a random state, mostly good for testing
@@ -37,11 +96,10 @@ func RandomPeer(name string) *Peer {
 // PeerFromSpec returns a peer with the desired state passed to the function
 func PeerFromSpec(name string, addr string, uuid uuid.UUID) (*Peer, error) {
 	peer := &Peer{
-		Name:     name,
-		Id:       uuid,
-		recv:     make(chan Packet),
-		handlers: make(map[PacketType]InternalHandlerFunc),
+		Name: name,
+		Id:   uuid,
 	}
+	peer.initState()
 
 	var err error
 	if peer.LocalAddr, err = netutil.IPPortFromAddr(addr); err != nil {
@@ -54,11 +112,21 @@ func PeerFromSpec(name string, addr string, uuid uuid.UUID) (*Peer, error) {
 	return peer, nil
 }
 
-func NewPeer(config *config.PeerConfig) (*Peer, error) {
-	peer := &Peer{
-		recv:     make(chan Packet),
-		handlers: make(map[PacketType]InternalHandlerFunc),
+// remotePeer returns a peer that stands for another peer on the network. It
+// opens no sockets, packets meant for it are sent through the socket of a
+// local peer.
+func remotePeer(name string, addr string, id uuid.UUID) (*Peer, error) {
+	p := &Peer{Name: name, Id: id}
+	var err error
+	if p.LocalAddr, err = netutil.ResolveIPPort(addr); err != nil {
+		return nil, err
 	}
+	return p, nil
+}
+
+func NewPeer(config *config.PeerConfig) (*Peer, error) {
+	peer := &Peer{}
+	peer.initState()
 	if config == nil {
 		return peer, nil
 	}
@@ -68,8 +136,51 @@ func NewPeer(config *config.PeerConfig) (*Peer, error) {
 	return peer, nil
 }
 
+// initState allocates the state a peer needs to send and recieve packets.
+func (p *Peer) initState() {
+	p.recv = make(chan Packet)
+	p.router = newRouter()
+	p.workers = newWorkers()
+	p.control = make(map[PacketType]ControlHandlerFunc)
+	p.transfers = newTransfers()
+	p.pending = newPending()
+	p.reliability = newReliability()
+	p.paths = newPaths()
+	p.settings = new(settings)
+}
+
 func (p *Peer) init(config *config.PeerConfig) error {
+	p.settings.conf = config
 	p.Name = config.Name
+	p.ReceiveDir = config.ReceiveDir
+	p.StateDir = config.StateDir
+	p.MaxFileSize = config.MaxFileSize
+	p.PreserveOwner = config.PreserveOwner
+	p.ControlPath = config.Control
+	p.Workers = config.Workers
+	p.QueueSize = config.QueueSize
+	if config.Registry != "" {
+		reg, err := registry.Open(config.Registry)
+		if err != nil {
+			return err
+		}
+		p.registry = reg
+	}
+	if config.KeyFile != "" {
+		key, err := LoadKey(config.KeyFile)
+		if err != nil {
+			return err
+		}
+		trusted := make([]ed25519.PublicKey, 0, len(config.TrustedKeys))
+		for _, k := range config.TrustedKeys {
+			pub, err := DecodeKey(k)
+			if err != nil {
+				return fmt.Errorf("trusted key %q: %w", k, err)
+			}
+			trusted = append(trusted, pub)
+		}
+		p.Secure(key, trusted...)
+	}
 	if config.Id != "" {
 		id, err := uuid.Parse(config.Id)
 		if err != nil {
@@ -79,6 +190,11 @@ func (p *Peer) init(config *config.PeerConfig) error {
 	} else {
 		p.Id = uuid.New()
 	}
+	logger, err := configLogger(config)
+	if err != nil {
+		return err
+	}
+	p.SetLogger(logger)
 
 	conn, addr, err := config.GetConnAndIP()
 	if err != nil {
@@ -97,9 +213,11 @@ func peer(name string) (p *Peer) {
 		Id:   uuid.New(),
 		Name: name,
 	}
+	p.initState()
+	p.SetLogger(defaultLogger)
 	var err error
 	if p.lstn, err = netutil.ListenOnLocalRandomPort(); err != nil {
-		ZErrorf("%v", err)
+		p.Logger().Error("could not listen", F("error", err))
 		return p
 	}
 	if p.LocalAddr, err = netutil.IPPortFromAddr(p.lstn.LocalAddr().String()); err != nil {
@@ -111,13 +229,17 @@ func peer(name string) (p *Peer) {
 // Custom json marshaller for the peer type
 func (p *Peer) MarshalJSON() ([]byte, error) {
 	type PeerInfo Peer
+	var addr string
+	if p.LocalAddr != nil && p.LocalAddr.IsValid() {
+		addr = p.LocalAddr.String()
+	}
 	return json.Marshal(&struct {
 		Id   string `json:"id"`
 		Addr string `json:"addr,omitempty"`
 		*PeerInfo
 	}{
 		Id:       p.Id.String(),
-		Addr:     p.LocalAddr.String(),
+		Addr:     addr,
 		PeerInfo: (*PeerInfo)(p),
 	})
 }
@@ -138,7 +260,7 @@ func (p *Peer) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	if pi.Addr != "invalid IPPort" {
+	if pi.Addr != "" {
 		if p.LocalAddr, err = netutil.IPPortFromAddr(pi.Addr); err != nil {
 			return err
 		}
@@ -152,7 +274,7 @@ func (p Peer) String() string {
 	if p.Name != "" {
 		str.WriteString(" " + p.Name)
 	}
-	if p.LocalAddr.IsValid() {
+	if p.LocalAddr != nil && p.LocalAddr.IsValid() {
 		str.WriteString(" " + p.LocalAddr.String())
 	}
 	return str.String()
@@ -206,36 +328,98 @@ func (p *Peer) setListener() error {
 	return err
 }
 
+// conn returns the socket the peer sends and recieves packets through.
+func (p *Peer) conn() transport {
+	if p.sock != nil {
+		return p.sock.get()
+	}
+	if p.wire != nil {
+		return p.wire
+	}
+	return p.lstn
+}
+
+// write puts a marshaled packet on the wire. Membership gossip is attached to
+// the packet when there is room for it, and the packet is sealed when the
+// peer is secure. Packets that don't fit the path mtu of addr are refused,
+// path probes excepted.
+func (p *Peer) write(b []byte, addr *net.UDPAddr) error {
+	typ := PacketType(b[offType])
+	plaintext := p.secure != nil && typ == Handshake
+	mtu := defaultMTU
+	if pm, ok := p.paths.get(addr); ok {
+		mtu = pm.mtu
+		size := len(b)
+		if p.secure != nil && !plaintext {
+			size += sealOverhead
+		}
+		if typ != PathProbe && size > mtu {
+			return fmt.Errorf("%w: %d byte %s packet, path mtu of %s is %d", ErrExceedsPathMTU, size, typ, addr, mtu)
+		}
+	}
+	if p.gossip != nil && !plaintext && typ != PathProbe {
+		if g := p.gossip.piggyback(mtu - len(b) - 2 - sealOverhead); len(g) > 0 {
+			b = attachGossip(b, g)
+		}
+	}
+	if p.secure != nil {
+		var err error
+		if b, err = p.seal(b, addr); err != nil {
+			return err
+		}
+	}
+	if n, err := p.conn().WriteToUDP(b, addr); tooLarge(err) {
+		return fmt.Errorf("%w: %d byte %s packet to %s: %v", ErrExceedsPathMTU, len(b), typ, addr, err)
+	} else if err != nil {
+		return fmt.Errorf("could not send packet: %w", err)
+	} else if n < len(b) {
+		return fmt.Errorf("could not send all data, got: %d, sent: %d", len(b), n)
+	}
+	return nil
+}
+
 // Send transmits a packet containing the remote address it is being sent to.
-func (p Peer) Send(packet Packet) error { return p.SendToAddr(packet, nil) }
+func (p *Peer) Send(packet Packet) error { return p.SendToAddr(packet, nil) }
 
 // SendToAddr sends packet to their remote endpoints. If the packet already
 // contains its remote endpoint it just sends it, else it unmarshals the
-// packet and sends it to its remote address
-func (p Peer) SendToAddr(packet Packet, addr *net.UDPAddr) error {
-	write := func(b []byte, addr *net.UDPAddr) error {
-		if n, err := p.lstn.WriteToUDP(b, addr); err != nil {
-			return fmt.Errorf("could not send packet: %w", err)
-		} else if n < len(packet.Data()) {
-			return fmt.Errorf("could not send all data, got: %d, sent: %d", len(packet.Data()), n)
+// packet and sends it to its remote address. Packets of the types the peer
+// delivers reliably are retransmitted until the remote endpoint acknowledges
+// them, SendToAddr returns ErrNotAcknowledged if it never does.
+func (p *Peer) SendToAddr(packet Packet, addr *net.UDPAddr) error {
+	return p.send(context.Background(), packet, addr)
+}
+
+// send is SendToAddr with a context that limits how long reliable packets are
+// retransmitted for.
+func (p *Peer) send(ctx context.Context, packet Packet, addr *net.UDPAddr) error {
+	if addr == nil {
+		addr = packet.Addr()
+	}
+	if addr == nil {
+		return fmt.Errorf("specify remote endpoint to send packet")
+	}
+	if p.reliability != nil && p.reliability.reliable(packet.Type()) {
+		err := p.sendReliable(ctx, packet, addr)
+		if errors.Is(err, ErrNotAcknowledged) && p.secure != nil {
+			// the peer may have lost the session, handshake again next time.
+			p.secure.forget(addr)
 		}
-		return nil
+		return err
 	}
 	b, err := MarshalPacket(packet)
 	if err != nil {
 		return fmt.Errorf("Send(Packet): %w", err)
 	}
-	if addr != nil {
-		return write(b, addr)
-	} else if packet.Addr() != nil {
-		return write(b, packet.Addr())
-	}
-	return fmt.Errorf("specify remote endpoint to send packet")
+	return p.write(b, addr)
 }
 
 // StartServer starts the goroutines for recieving new packets and
-// determining what to do with the packets.
-func (p *Peer) StartServer(cl chan<- io.Closer) (context.CancelFunc, error) {
+// determining what to do with the packets. The returned function stops the
+// server right away, Shutdown stops it gracefully. StartServer leaves the
+// signals of the process alone, stopping the peer on a signal is up to the
+// program it runs in.
+func (p *Peer) StartServer() (context.CancelFunc, error) {
 	if p.lstn == nil {
 		if !p.LocalAddr.IsValid() {
 			return nil, fmt.Errorf("StartRequestReciever: %s", p.LocalAddr.String())
@@ -245,64 +429,133 @@ func (p *Peer) StartServer(cl chan<- io.Closer) (context.CancelFunc, error) {
 		}
 	}
 
-	go func() {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
-		<-sig
-		cl <- p.lstn
-	}()
-
+	if p.router == nil {
+		p.initState()
+	}
+	p.done, p.stopOnce, p.restart = make(chan struct{}), new(sync.Once), new(bool)
+	p.started = time.Now()
 	p.initInternalHandlers()
+	if err := p.restoreTransfers(); err != nil {
+		return nil, fmt.Errorf("restoring transfers: %w", err)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
+	srv := newServer(ctx, cancel)
+	p.server = srv
+	if p.ControlPath != "" {
+		conn, err := p.listenControl()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		p.initControlHandlers()
+		srv.control = make(chan struct{})
+		go p.serveControl(ctx, conn, srv.control)
+	}
 	ch := make(chan Packet)
-	go p.processRequests(ctx, ch)
-	go func(ctx context.Context) {
-		ZPrintf("%s listening on %s", p.Id, p.LocalAddr.String())
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				buffer := pool.GetBufferSized(500)
-				buf := buffer.Bytes()
-				n, raddr, err := p.lstn.ReadFromUDP(buf)
-				if err != nil {
-					ZErrorf("StartServer: %v", err)
+	p.startWorkers(ctx)
+	go p.processRequests(ctx, srv, ch)
+	p.sock = &socket{conn: p.conn(), done: ctx.Done(), listen: func(conn transport) {
+		go p.readPackets(ctx, conn, ch)
+	}}
+	p.dontFragment(p.sock.conn)
+	p.Logger().Info("listening", F("addr", p.LocalAddr))
+	p.sock.listen(p.sock.conn)
+	go p.resumeTransfers(ctx)
+
+	return cancel, nil
+}
+
+// readPackets reads the packets that arrive on conn and passes them on to
+// ch until ctx is done or conn is closed.
+func (p *Peer) readPackets(ctx context.Context, conn transport, ch chan<- Packet) {
+	// a read blocked on the socket is woken by a deadline when ctx is done.
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			buffer := pool.GetBufferSized(maxDatagramSize)
+			buf := buffer.Bytes()
+			n, raddr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				pool.PutBuffer(buffer)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					// the deadline was set when an earlier server of the
+					// socket stopped, it is of no concern to this one.
+					conn.SetReadDeadline(time.Time{})
 					continue
 				}
-				ch <- requestWrapper{
-					addr: raddr,
-					typ:  PacketType(buf[0]),
-					data: append(make([]byte, 0, n), buf[:n]...),
+				p.Logger().Error("reading packet", F("error", err))
+				continue
+			}
+			data := buf[:n]
+			sealed := n > offFlags && data[offFlags]&flagSealed != 0
+			if p.secure != nil {
+				if data, err = p.open(data, raddr); err != nil {
+					p.Logger().Warn("dropping packet", F("remote_addr", raddr), F("error", err))
+					pool.PutBuffer(buffer)
+					continue
 				}
-				pool.PutBuffer(buffer)
+			}
+			packet, err := UnmarshalPacket(append(make([]byte, 0, len(data)), data...))
+			pool.PutBuffer(buffer)
+			if err != nil {
+				p.Logger().Warn("invalid packet", F("remote_addr", raddr), F("error", err))
+				continue
+			}
+			req := packet.(*requestWrapper)
+			req.setRemoteEndPoint(raddr)
+			// the gossip of a secure peer must come from a peer it
+			// has a session with.
+			if p.gossip != nil && len(req.gossip) > 0 && (p.secure == nil || sealed) {
+				p.gossip.absorb(raddr, req.gossip)
+			}
+			select {
+			case ch <- req:
+			case <-ctx.Done():
+				return
 			}
 		}
-	}(ctx)
-
-	return cancel, nil
+	}
 }
 
 // processRequests is run as a goroutine to process a newly recieved packet
 // and determine where the packet is destined for.
-func (p *Peer) processRequests(ctx context.Context, ch <-chan Packet) {
+func (p *Peer) processRequests(ctx context.Context, srv *server, ch <-chan Packet) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case req := <-ch:
-			ZPrintf("Recieved '%s' request from %s", req.Type().String(), req.Addr().String())
-
-			if f, ok := p.handlers[req.Type()]; ok {
-				go f(req)
-			} else {
-				ZErrorf("no registered handler for packet type %s", req.Type().String())
-				go func() {
-					err := p.Send(ErrrorWithAddr(UnknownPacketType, req.Addr()))
-					if err != nil {
-						ZErrorf("sending error response failed: %s", err.Error())
-					}
-				}()
+			if p.recieveReliable(req) {
+				continue
+			}
+			p.Logger().Debug("recieved packet", F("packet_type", req.Type()), F("remote_addr", req.Addr()))
+
+			if p.pending.deliver(req) {
+				// only the peers that answer our own requests are
+				// remembered, unsolicited peer info is not trusted.
+				if req.Type() == PeerInfo && p.registry != nil {
+					go p.remember(req)
+				}
+				continue
+			}
+			// replies are sent off the read loop, a secure peer may
+			// have to handshake with the sender before they go out.
+			if srv.stopping() && !finishesWork(req.Type()) {
+				go p.refuse(req)
+				continue
+			}
+			if !p.workers.submit(req) {
+				go p.busy(req)
 			}
 		}
 	}
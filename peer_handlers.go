@@ -1,14 +1,24 @@
 package zinc
 
 import (
-	"fmt"
+	"context"
 	"net"
-	"os"
+	"time"
+
+	"github.com/Joe-Degs/zinc/internal/registry"
 )
 
 func (p *Peer) initInternalHandlers() {
-	ZPrintf("starting default internal request handlers...")
-	p.handlers[Ping] = p.pingRequestHandler
+	p.Logger().Debug("starting default internal request handlers")
+	p.handle(Ping, p.pingRequestHandler)
+	p.handle(FileOffer, p.fileOfferHandler)
+	p.handle(FileChunk, p.fileChunkHandler)
+	p.handle(FileAck, p.fileAckHandler)
+	p.handle(FileComplete, p.fileCompleteHandler)
+	p.handle(PathProbe, p.pathProbeHandler)
+	if p.secure != nil {
+		p.handle(Handshake, p.handshakeHandler)
+	}
 }
 
 func makeResponsePacket(typ PacketType, data []byte, addr *net.UDPAddr) Packet {
@@ -16,17 +26,214 @@ func makeResponsePacket(typ PacketType, data []byte, addr *net.UDPAddr) Packet {
 }
 
 // handle ping requests sent to peer
-func (p Peer) pingRequestHandler(packet Packet) {
-	// err := p.SendToAddr(UnImplementedEndPoint, packet.Addr())
-	data, err := p.MarshalJSON()
+func (p *Peer) pingRequestHandler(ctx context.Context, w ResponseWriter, packet Packet) {
+	data, err := p.info(p.MarshalBinary)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
+		p.Logger().Error("marshaling peer info", F("error", err))
+		return
+	}
+	// nothing is sent once the peer stops serving.
+	if ctx.Err() != nil {
 		return
 	}
-	resp := makeResponsePacket(PeerInfo, data, packet.Addr())
+	if err := w.Respond(PeerInfo, data); err != nil {
+		p.Logger().Error("failed to respond to ping request", F("remote_addr", packet.Addr()), F("error", err))
+	}
+}
 
-	err = p.Send(resp)
+// remember records the peer a PeerInfo packet describes in the registry.
+func (p *Peer) remember(packet Packet) {
+	var info Peer
+	if err := info.UnmarshalBinary(packet.Data()); err != nil {
+		p.Logger().Warn("invalid peer info", F("remote_addr", packet.Addr()), F("error", err))
+		return
+	}
+	err := p.registry.Update(info.Id.String(), func(r *registry.Record) {
+		if info.Name != "" {
+			r.Name = info.Name
+		}
+		if info.LocalAddr != nil && info.LocalAddr.IsValid() && !info.LocalAddr.IP().IsUnspecified() {
+			r.AddAddr(info.LocalAddr.String())
+		}
+		// the address the peer was heard from is the one known to work.
+		r.AddAddr(packet.Addr().String())
+		if len(info.PublicKey) > 0 {
+			r.PublicKey = EncodeKey(info.PublicKey)
+		}
+		r.LastSeen = time.Now()
+		r.Status = registry.Active
+	})
 	if err != nil {
-		ZErrorf("failed to respond to ping request: %s", err.Error())
+		p.Logger().Error("updating registry", F("error", err))
+	}
+}
+
+// handle offers of files from other peers
+func (p *Peer) fileOfferHandler(_ context.Context, _ ResponseWriter, packet Packet) {
+	var offer fileOffer
+	if err := offer.unmarshal(packet.Data()); err != nil {
+		p.Logger().Warn("invalid file offer", F("remote_addr", packet.Addr()), F("error", err))
+		return
+	}
+
+	p.transfers.Lock()
+	defer p.transfers.Unlock()
+	if in, ok := p.transfers.in[offer.id]; ok {
+		if !sameAddr(in.addr, packet.Addr()) {
+			p.Logger().Warn("ignoring offer of a transfer of another peer", F("file", offer.name), F("remote_addr", packet.Addr()))
+			return
+		}
+		// the sender of a restored transfer is back, it resumes the
+		// transfer unless it starts over.
+		in.Lock()
+		in.seen = time.Now()
+		if in.restored {
+			in.restored = false
+			if in.offer.size == offer.size && in.offer.chunkSize == offer.chunkSize && in.offer.root == offer.root {
+				p.Logger().Info("resuming file", F("file", offer.name), F("remote_addr", packet.Addr()))
+			} else {
+				in.abort()
+				in.done = true
+				p.transfers.remove(in.checkpoint())
+				delete(p.transfers.in, offer.id)
+			}
+		}
+		in.Unlock()
+	}
+	if _, ok := p.transfers.in[offer.id]; !ok {
+		if p.transfers.draining {
+			p.Logger().Info("rejecting file, peer is stopping", F("file", offer.name), F("remote_addr", packet.Addr()))
+			p.sendFileAck(fileAck{id: offer.id, status: ackRejected}, packet.Addr())
+			return
+		}
+		in, err := p.accept(offer, packet.Addr())
+		if err != nil {
+			p.Logger().Error("rejecting file", F("file", offer.name), F("remote_addr", packet.Addr()), F("error", err))
+			p.sendFileAck(fileAck{id: offer.id, status: ackRejected}, packet.Addr())
+			return
+		}
+		p.Logger().Info("recieving file", F("file", offer.name), F("size", offer.size), F("remote_addr", packet.Addr()))
+		p.transfers.in[offer.id] = in
+		p.checkpoint(in)
+		p.expireIdle(in, p.transfers.idle)
+	}
+	p.sendFileAck(fileAck{id: offer.id, status: ackAccepted}, packet.Addr())
+}
+
+// handle chunks of files being recieved
+func (p *Peer) fileChunkHandler(_ context.Context, _ ResponseWriter, packet Packet) {
+	var chunk fileChunk
+	if err := chunk.unmarshal(packet.Data()); err != nil {
+		p.Logger().Warn("invalid file chunk", F("remote_addr", packet.Addr()), F("error", err))
+		return
+	}
+	in, ok := p.transfers.incoming(chunk.id)
+	if !ok || !sameAddr(in.addr, packet.Addr()) {
+		return
+	}
+
+	in.Lock()
+	defer in.Unlock()
+	in.seen = time.Now()
+	if in.done || chunk.index >= uint32(len(in.have)) || in.have[chunk.index] {
+		return
+	}
+	if chunk.index >= in.offer.chunks() {
+		if err := in.addHashBlock(chunk.index-in.offer.chunks(), chunk.data); err != nil {
+			p.Logger().Warn("dropping hash block", F("block", chunk.index-in.offer.chunks()), F("remote_addr", packet.Addr()), F("error", err))
+		}
+		return
+	}
+	if want := in.chunkLen(chunk.index); int64(len(chunk.data)) != want {
+		p.Logger().Warn("file chunk has the wrong size", F("chunk", chunk.index), F("size", len(chunk.data)), F("want", want), F("remote_addr", packet.Addr()))
+		return
+	}
+	if in.hasLeaf(chunk.index) && leafHash(chunk.data) != in.leaves[chunk.index] {
+		p.Logger().Warn("dropping corrupt file chunk", F("chunk", chunk.index), F("remote_addr", packet.Addr()))
+		return
+	}
+	off := int64(chunk.index) * int64(in.offer.chunkSize)
+	if _, err := in.file.WriteAt(chunk.data, off); err != nil {
+		p.Logger().Error("writing file chunk", F("chunk", chunk.index), F("error", err))
+		return
+	}
+	in.have[chunk.index] = true
+	in.restored = false
+	if in.unsaved++; in.unsaved >= checkpointEvery {
+		p.checkpoint(in)
+	}
+}
+
+// handle acknowledgements of files being sent
+func (p *Peer) fileAckHandler(_ context.Context, _ ResponseWriter, packet Packet) {
+	var ack fileAck
+	if err := ack.unmarshal(packet.Data()); err != nil {
+		p.Logger().Warn("invalid file ack", F("remote_addr", packet.Addr()), F("error", err))
+		return
+	}
+	out, ok := p.transfers.outgoing(ack.id)
+	if !ok || !sameAddr(out.addr, packet.Addr()) {
+		return
+	}
+	select {
+	case out.acks <- ack:
+	default:
+	}
+}
+
+// handle the end of files being recieved
+func (p *Peer) fileCompleteHandler(_ context.Context, _ ResponseWriter, packet Packet) {
+	var complete fileComplete
+	if err := complete.unmarshal(packet.Data()); err != nil {
+		p.Logger().Warn("invalid file complete", F("remote_addr", packet.Addr()), F("error", err))
+		return
+	}
+	in, ok := p.transfers.incoming(complete.id)
+	if !ok {
+		p.sendFileAck(fileAck{id: complete.id, status: ackRejected}, packet.Addr())
+		return
+	}
+	if !sameAddr(in.addr, packet.Addr()) {
+		return
+	}
+
+	// the transfers are locked before a transfer, so in is unlocked before
+	// the transfer is dropped from them.
+	in.Lock()
+	in.seen = time.Now()
+	if !in.done {
+		in.restored = false
+		// the indices of the missing chunks fill at most one datagram
+		// on the path back to the sender.
+		if missing := in.missing((p.maxPayload(packet.Addr()) - fileAckHeaderLen) / 4); len(missing) > 0 {
+			if in.unsaved > 0 {
+				p.checkpoint(in)
+			}
+			in.Unlock()
+			p.sendFileAck(fileAck{id: complete.id, status: ackMissing, missing: missing}, packet.Addr())
+			return
+		}
+		cp := in.checkpoint()
+		err := in.finish()
+		p.transfers.remove(cp)
+		if err != nil {
+			in.Unlock()
+			p.Logger().Error("failed to save file", F("file", in.offer.name), F("error", err))
+			p.transfers.Lock()
+			if p.transfers.in[complete.id] == in {
+				delete(p.transfers.in, complete.id)
+			}
+			p.transfers.Unlock()
+			p.sendFileAck(fileAck{id: complete.id, status: ackRejected}, packet.Addr())
+			return
+		}
+		p.Logger().Info("recieved file", F("file", in.dest), F("remote_addr", packet.Addr()))
+		for _, attr := range in.unapplied {
+			p.Logger().Warn("could not apply file attribute", F("attribute", attr), F("file", in.dest))
+		}
+		p.transfers.forget(complete.id)
 	}
+	unapplied := in.unapplied
+	in.Unlock()
+	p.sendFileAck(fileAck{id: complete.id, status: ackDone, unapplied: unapplied}, packet.Addr())
 }
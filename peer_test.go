@@ -1,18 +1,21 @@
 package zinc
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/uuid"
 	"inet.af/netaddr"
 )
 
 func getIPPort(addr string) *netaddr.IPPort {
 	laddr, err := netaddr.ParseIPPort(addr)
 	if err != nil {
-		zlog.Panicln(err)
+		panic(err)
 	}
 	return &laddr
 }
@@ -28,7 +31,7 @@ func TestPeerJSON(t *testing.T) {
 			t.Fatalf("Json marshaling and unmarshaling anomaly: (-want +got):\n%s", diff)
 		}
 
-		if p.LocalAddr.IsValid() && p.LocalAddr.IP() != peer.LocalAddr.IP() {
+		if p.LocalAddr != nil && p.LocalAddr.IsValid() && p.LocalAddr.IP() != peer.LocalAddr.IP() {
 			t.Fatalf("IPPort mismatch: want %s; got %s", p.LocalAddr.IP(), p.LocalAddr.IP())
 		}
 	}
@@ -41,25 +44,25 @@ func TestPeerJSON(t *testing.T) {
 			name: "peer with all 3 fields set",
 			peer: Peer{
 				Name:      "jsonPeer1",
-				Id:        RandomUid(),
+				Id:        uuid.New(),
 				LocalAddr: getIPPort("192.168.43.101:6969"),
 			},
 		}, {
 			name: "peer without name",
 			peer: Peer{
-				Id:        RandomUid(),
+				Id:        uuid.New(),
 				LocalAddr: getIPPort("[::]:8869"),
 			},
 		}, {
 			name: "peer without local address",
 			peer: Peer{
-				Id:   RandomUid(),
+				Id:   uuid.New(),
 				Name: "jsonPeer2",
 			},
 		}, {
 			name: "peer without local address and name",
 			peer: Peer{
-				Id: RandomUid(),
+				Id: uuid.New(),
 			},
 		},
 	}
@@ -89,7 +92,7 @@ func TestPeerText(t *testing.T) {
 			t.Fatalf("Text marshaling and unmarshaling anomaly: (-want +got):\n%s", diff)
 		}
 
-		if p.LocalAddr.IsValid() && p.LocalAddr.IP() != peer.LocalAddr.IP() {
+		if p.LocalAddr != nil && p.LocalAddr.IsValid() && p.LocalAddr.IP() != peer.LocalAddr.IP() {
 			t.Fatalf("IPPort mismatch: want %s; got %s", p.LocalAddr.IP(), p.LocalAddr.IP())
 		}
 	}
@@ -102,24 +105,24 @@ func TestPeerText(t *testing.T) {
 			name: "peer with all 3 fields set",
 			peer: Peer{
 				Name:      "textPeer1",
-				Id:        RandomUid(),
+				Id:        uuid.New(),
 				LocalAddr: getIPPort("192.168.43.101:6969"),
 			},
 		}, {
 			name: "text with just name and id",
 			peer: Peer{
 				Name: "textPeer1",
-				Id:   RandomUid(),
+				Id:   uuid.New(),
 			},
 		}, {
 			name: "peer without name and id",
 			peer: Peer{
-				Id: RandomUid(),
+				Id: uuid.New(),
 			},
 		}, {
 			name: "peer with just id and ipport",
 			peer: Peer{
-				Id:        RandomUid(),
+				Id:        uuid.New(),
 				LocalAddr: getIPPort("[1b20:485b:12a5:024c:551e:e040:04e0:f9c0]:6969"),
 			},
 		},
@@ -137,3 +140,69 @@ func TestPeerText(t *testing.T) {
 	}
 
 }
+
+func TestPeerBinary(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name string
+		peer Peer
+	}{
+		{
+			name: "peer with all fields set",
+			peer: Peer{
+				Name:      "binaryPeer1",
+				Id:        uuid.New(),
+				LocalAddr: getIPPort("192.168.43.101:6969"),
+				PublicKey: pub,
+			},
+		}, {
+			name: "peer with ipv6 address",
+			peer: Peer{
+				Id:        uuid.New(),
+				LocalAddr: getIPPort("[1b20:485b:12a5:024c:551e:e040:04e0:f9c0]:6969"),
+			},
+		}, {
+			name: "peer with just id",
+			peer: Peer{
+				Id: uuid.New(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.peer.MarshalBinary()
+			if err != nil {
+				t.Fatalf("failed to marshal peer to binary: %v", err)
+			}
+			peer := &Peer{}
+			if err := peer.UnmarshalBinary(b); err != nil {
+				t.Fatalf("failed to unmarshal binary: %v", err)
+			}
+			if diff := cmp.Diff(tc.peer, *peer, cmpopts.IgnoreUnexported(netaddr.IPPort{}, Peer{})); diff != "" {
+				t.Fatalf("Binary marshaling and unmarshaling anomaly: (-want +got):\n%s", diff)
+			}
+			if tc.peer.LocalAddr != nil && *tc.peer.LocalAddr != *peer.LocalAddr {
+				t.Fatalf("IPPort mismatch: want %s; got %s", tc.peer.LocalAddr, peer.LocalAddr)
+			}
+		})
+	}
+
+	// fields of later versions are skipped
+	p := Peer{Id: uuid.New(), Name: "newer"}
+	b, _ := p.MarshalBinary()
+	b = append(b, 0x7f, 0, 3, 'n', 'e', 'w')
+	var got Peer
+	if err := got.UnmarshalBinary(b); err != nil || got.Name != "newer" {
+		t.Fatalf("want unknown field skipped; got %v, %v", got, err)
+	}
+
+	for _, b := range [][]byte{nil, {2}, {peerInfoVersion}, {peerInfoVersion, tagId, 0, 16, 1}} {
+		if err := new(Peer).UnmarshalBinary(b); !errors.Is(err, ErrInvalidPeerInfo) {
+			t.Errorf("want ErrInvalidPeerInfo unmarshaling % x; got %v", b, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package zinc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+	"inet.af/netaddr"
+)
+
+// The PeerInfo packets peers send each other carry the peer info in a compact
+// binary encoding, json is only used to show peer info to people. The encoding
+// goes with the version of the packet header, packets of other versions never
+// get this far. The peer info starts with its own version followed by fields,
+// each a tag byte, a two byte length and the value. Fields with tags a peer
+// does not know are skipped, so later versions can add fields that older peers
+// ignore.
+
+// peerInfoVersion is the version of the peer info written by MarshalBinary.
+const peerInfoVersion = 1
+
+// tags of the fields of the peer info.
+const (
+	tagId byte = iota + 1
+	tagName
+	tagAddr
+	tagPublicKey
+)
+
+var ErrInvalidPeerInfo = errors.New("invalid peer info")
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+func (p *Peer) MarshalBinary() ([]byte, error) {
+	b := new(bytes.Buffer)
+	b.WriteByte(peerInfoVersion)
+	writeField(b, tagId, p.Id[:])
+	if p.Name != "" {
+		writeField(b, tagName, []byte(p.Name))
+	}
+	if p.LocalAddr != nil && p.LocalAddr.IsValid() {
+		ip, err := p.LocalAddr.IP().MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, p.LocalAddr.Port())
+		writeField(b, tagAddr, append(ip, port...))
+	}
+	if len(p.PublicKey) > 0 {
+		writeField(b, tagPublicKey, p.PublicKey)
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+func (p *Peer) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	version, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPeerInfo, ErrShortPacket)
+	}
+	if version != peerInfoVersion {
+		return fmt.Errorf("%w: unknown version %d", ErrInvalidPeerInfo, version)
+	}
+	var sawId bool
+	for r.Len() > 0 {
+		tag, value, err := readField(r)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPeerInfo, err)
+		}
+		switch tag {
+		case tagId:
+			if p.Id, err = uuid.FromBytes(value); err != nil {
+				return fmt.Errorf("%w: id: %v", ErrInvalidPeerInfo, err)
+			}
+			sawId = true
+		case tagName:
+			p.Name = string(value)
+		case tagAddr:
+			if len(value) < 2 {
+				return fmt.Errorf("%w: addr: %v", ErrInvalidPeerInfo, ErrShortPacket)
+			}
+			var ip netaddr.IP
+			if err := ip.UnmarshalBinary(value[:len(value)-2]); err != nil || !ip.IsValid() {
+				return fmt.Errorf("%w: addr: invalid ip % x", ErrInvalidPeerInfo, value[:len(value)-2])
+			}
+			addr := netaddr.IPPortFrom(ip, binary.BigEndian.Uint16(value[len(value)-2:]))
+			p.LocalAddr = &addr
+		case tagPublicKey:
+			if len(value) != ed25519.PublicKeySize {
+				return fmt.Errorf("%w: invalid public key length %d", ErrInvalidPeerInfo, len(value))
+			}
+			p.PublicKey = append(ed25519.PublicKey(nil), value...)
+		}
+	}
+	if !sawId {
+		return fmt.Errorf("%w: missing id", ErrInvalidPeerInfo)
+	}
+	return nil
+}
+
+func writeField(b *bytes.Buffer, tag byte, value []byte) {
+	b.WriteByte(tag)
+	binary.Write(b, binary.BigEndian, uint16(len(value)))
+	b.Write(value)
+}
+
+func readField(r *bytes.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, ErrShortPacket
+	}
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return 0, nil, ErrShortPacket
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, ErrShortPacket
+	}
+	return tag, value, nil
+}
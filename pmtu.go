@@ -0,0 +1,257 @@
+package zinc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The largest datagram that reaches another peer whole depends on the links
+// between the two. Where the operating system lets it, the peer sends its
+// datagrams with the don't fragment bit set and finds the largest datagram a
+// path carries by probing it: PathProbe packets of different sizes are sent
+// along the path and the largest one that is answered is the path mtu of the
+// path. Datagrams that don't fit the path mtu of their path are refused with
+// ErrExceedsPathMTU instead of being dropped along the way. Where the bit
+// can't be set datagrams are fragmented, probing them tells nothing, and
+// every path is assumed to carry defaultMTU.
+
+const (
+	// minMTU is the ipv6 minimum mtu less the ipv6 and udp headers. Every
+	// path is expected to carry datagrams this large.
+	minMTU = 1232
+
+	// maxProbedMTU is the jumbo frame mtu less the ipv4 and udp headers.
+	// Paths are not probed past it, the few that carry larger datagrams are
+	// taken to carry this much.
+	maxProbedMTU = 8972
+
+	// pathProbeTimeout is how long a peer waits for the answer to a
+	// PathProbe and pathProbeTries the number of times a size is probed
+	// before the path is taken not to carry it.
+	pathProbeTimeout = 300 * time.Millisecond
+	pathProbeTries   = 2
+
+	// pathMTUTTL is how long a path mtu is trusted before it is probed
+	// again.
+	pathMTUTTL = 10 * time.Minute
+)
+
+var (
+	ErrExceedsPathMTU  = errors.New("packet exceeds path mtu")
+	ErrPathProbeFailed = errors.New("path mtu probe not answered")
+	errNoDontFragment  = errors.New("don't fragment bit not supported on this platform")
+)
+
+// pathMTU is the largest datagram known to reach an address.
+type pathMTU struct {
+	mtu    int
+	probed time.Time
+}
+
+// paths remembers the path mtu of the addresses a peer sends to.
+type paths struct {
+	sync.Mutex
+
+	// df is set when the datagrams of the peer are sent with the don't
+	// fragment bit set.
+	df   bool
+	mtus map[string]pathMTU
+
+	// probing holds the addresses whose paths are being probed in the
+	// background.
+	probing map[string]bool
+}
+
+func newPaths() *paths {
+	return &paths{mtus: make(map[string]pathMTU), probing: make(map[string]bool)}
+}
+
+func (ps *paths) set(addr *net.UDPAddr, mtu int) {
+	ps.Lock()
+	ps.mtus[addr.String()] = pathMTU{mtu: mtu, probed: time.Now()}
+	ps.Unlock()
+}
+
+func (ps *paths) get(addr *net.UDPAddr) (pathMTU, bool) {
+	ps.Lock()
+	defer ps.Unlock()
+	pm, ok := ps.mtus[addr.String()]
+	return pm, ok
+}
+
+// claim reports whether the path to addr is due to be probed and nobody else
+// is probing it. The caller probes the path and calls release when done.
+func (ps *paths) claim(addr *net.UDPAddr) bool {
+	ps.Lock()
+	defer ps.Unlock()
+	key := addr.String()
+	if pm, ok := ps.mtus[key]; ps.probing[key] || ok && time.Since(pm.probed) < pathMTUTTL {
+		return false
+	}
+	ps.probing[key] = true
+	return true
+}
+
+func (ps *paths) release(addr *net.UDPAddr) {
+	ps.Lock()
+	delete(ps.probing, addr.String())
+	ps.Unlock()
+}
+
+// mtu returns the path mtu of addr, defaultMTU when it was never probed.
+func (ps *paths) mtu(addr *net.UDPAddr) int {
+	if pm, ok := ps.get(addr); ok {
+		return pm.mtu
+	}
+	return defaultMTU
+}
+
+// dontFragment sets the don't fragment bit on the datagrams sent through
+// conn. Paths are only probed when it is set.
+func (p *Peer) dontFragment(conn transport) {
+	err := errNoDontFragment
+	if sc, ok := conn.(syscall.Conn); ok {
+		err = setDontFragment(sc)
+	}
+	p.paths.Lock()
+	p.paths.df = err == nil
+	p.paths.Unlock()
+	if err != nil {
+		p.Logger().Debug("paths are not probed", F("error", err))
+	}
+}
+
+// PathMTU returns the largest datagram that reaches addr whole. The path to
+// addr is probed when it was never probed or was probed too long ago.
+func (p *Peer) PathMTU(ctx context.Context, addr *net.UDPAddr) (int, error) {
+	if pm, ok := p.paths.get(addr); ok && time.Since(pm.probed) < pathMTUTTL {
+		return pm.mtu, nil
+	}
+	return p.ProbePath(ctx, addr)
+}
+
+// ProbePath finds the largest datagram that reaches the peer at addr whole
+// and remembers it as the path mtu of addr. The peer must have its server
+// running to recieve the answers to its probes.
+func (p *Peer) ProbePath(ctx context.Context, addr *net.UDPAddr) (int, error) {
+	p.paths.Lock()
+	df := p.paths.df
+	p.paths.Unlock()
+	if !df {
+		p.paths.set(addr, defaultMTU)
+		return defaultMTU, nil
+	}
+
+	if ok, err := p.probePath(ctx, addr, minMTU); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, fmt.Errorf("probing path to %s: %w", addr, ErrPathProbeFailed)
+	}
+	// the path carries lo, the largest size it carries is between lo and hi.
+	lo, hi := minMTU, maxProbedMTU
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		ok, err := p.probePath(ctx, addr, mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	p.paths.set(addr, lo)
+	p.Logger().Debug("probed path", F("remote_addr", addr), F("mtu", lo))
+	return lo, nil
+}
+
+// probePath reports whether a datagram of size bytes reaches addr. Only the
+// errors that are not about the size of the datagram are returned.
+func (p *Peer) probePath(ctx context.Context, addr *net.UDPAddr, size int) (bool, error) {
+	n := size - packetHeaderLen
+	if p.secure != nil {
+		n -= sealOverhead
+	}
+	probe := NewPacket(PathProbe, make([]byte, n), addr)
+	for i := 0; i < pathProbeTries; i++ {
+		pctx, cancel := context.WithTimeout(ctx, pathProbeTimeout)
+		resp, err := p.Request(pctx, probe)
+		cancel()
+		switch {
+		case err == nil:
+			return resp.Type() == PathProbe, nil
+		case errors.Is(err, ErrExceedsPathMTU):
+			// the datagram does not fit the link it leaves through.
+			return false, nil
+		case ctx.Err() != nil:
+			return false, ctx.Err()
+		case !errors.Is(err, context.DeadlineExceeded):
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// maxPayload is the most data a packet sent to addr carries without being
+// dropped for exceeding the path mtu of addr.
+func (p *Peer) maxPayload(addr *net.UDPAddr) int {
+	n := p.paths.mtu(addr) - packetHeaderLen
+	if p.secure != nil {
+		n -= sealOverhead
+	}
+	return n
+}
+
+// MaxPayload returns the most data a packet sent to the node carries, as far
+// as the path mtu of the node is known. Packets carrying more are refused by
+// Send with ErrExceedsPathMTU.
+func (n *Node) MaxPayload() int {
+	if n.local == nil || n.LocalAddr == nil || !n.LocalAddr.IsValid() {
+		return defaultMTU - packetHeaderLen - sealOverhead
+	}
+	return n.local.maxPayload(n.LocalAddr.UDPAddr())
+}
+
+// ProbePath probes the path to the node, see Peer.ProbePath.
+func (n *Node) ProbePath(ctx context.Context) (int, error) {
+	if n.local == nil {
+		return 0, fmt.Errorf("node %s is not a member of a cluster", n.Id)
+	}
+	if n.LocalAddr == nil || !n.LocalAddr.IsValid() {
+		return 0, fmt.Errorf("node %s has no address", n.Id)
+	}
+	return n.local.ProbePath(ctx, n.LocalAddr.UDPAddr())
+}
+
+// refreshPath probes the path to the member n in the background when its path
+// mtu is not known or was found too long ago.
+func (c *Cluster) refreshPath(ctx context.Context, n *Node) {
+	addr := n.LocalAddr.UDPAddr()
+	if !c.paths.claim(addr) {
+		return
+	}
+	go func() {
+		defer c.paths.release(addr)
+		if _, err := c.ProbePath(ctx, addr); err != nil && ctx.Err() == nil {
+			c.Logger().Debug("probing path failed", append(memberFields(n), F("error", err))...)
+		}
+	}()
+}
+
+// pathProbeHandler answers path mtu probes with an empty PathProbe. Gossip is
+// not attached to probes or their answers, so the probes don't use up the
+// times events are gossiped. Answers that arrive too late are dropped.
+func (p *Peer) pathProbeHandler(ctx context.Context, w ResponseWriter, packet Packet) {
+	if len(packet.Data()) == 0 {
+		return
+	}
+	if err := w.Respond(PathProbe, nil); err != nil {
+		p.Logger().Error("answering path probe failed", F("remote_addr", packet.Addr()), F("error", err))
+	}
+}
@@ -0,0 +1,35 @@
+package zinc
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setDontFragment makes the kernel set the don't fragment bit on the
+// datagrams sent through c. The probe mode leaves the path mtu to the peer:
+// the kernel only refuses datagrams that don't fit the interface they leave
+// through.
+func setDontFragment(c syscall.Conn) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var err4, err6 error
+	if err := rc.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+	}); err != nil {
+		return err
+	}
+	// only one of them applies to sockets that are not dual stack.
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+// tooLarge reports whether err is the kernel refusing a datagram that does
+// not fit the interface it leaves through.
+func tooLarge(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
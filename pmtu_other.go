@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package zinc
+
+import "syscall"
+
+func setDontFragment(c syscall.Conn) error {
+	return errNoDontFragment
+}
+
+func tooLarge(err error) bool {
+	return false
+}
@@ -0,0 +1,146 @@
+package zinc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// narrowConn is a transport whose link carries datagrams of up to link bytes
+// and whose path drops those larger than path bytes.
+type narrowConn struct {
+	*net.UDPConn
+	link, path int
+}
+
+func (c *narrowConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if len(b) > c.link {
+		return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", syscall.EMSGSIZE)}
+	}
+	if len(b) > c.path {
+		return len(b), nil
+	}
+	return c.UDPConn.WriteToUDP(b, addr)
+}
+
+func TestProbePath(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("paths are only probed on linux")
+	}
+	const mtu = 1300
+	receiver := startTestPeer(t, "receiver", func(p *Peer) {
+		p.HandleFunc(echoPacket, echo)
+	})
+	sender := startTestPeer(t, "sender", func(p *Peer) {
+		p.wire = &narrowConn{UDPConn: p.lstn, link: 1500, path: mtu}
+	})
+	raddr := receiver.lstn.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	got, err := sender.ProbePath(ctx, raddr)
+	if err != nil {
+		t.Fatalf("ProbePath: %v", err)
+	}
+	if got != mtu {
+		t.Fatalf("want path mtu %d; got %d", mtu, got)
+	}
+	if got := sender.maxPayload(raddr); got != mtu-packetHeaderLen {
+		t.Fatalf("want max payload %d; got %d", mtu-packetHeaderLen, got)
+	}
+
+	data := make([]byte, mtu-packetHeaderLen)
+	if resp := request(t, sender, receiver, echoPacket, data); !bytes.Equal(resp.Data(), data) {
+		t.Fatalf("want echo of %d bytes; got %d", len(data), len(resp.Data()))
+	}
+	err = sender.Send(NewPacket(echoPacket, append(data, 0), raddr))
+	if !errors.Is(err, ErrExceedsPathMTU) {
+		t.Fatalf("want ErrExceedsPathMTU sending past the path mtu; got %v", err)
+	}
+
+	// the chunks of a file fit the path, chunks of the default size don't.
+	name := filepath.Join(t.TempDir(), "narrow")
+	want := make([]byte, 5*defaultChunkSize+3)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	if err := os.WriteFile(name, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.SendFile(ctx, name, raddr, &TransferOptions{NoMetadata: true}); err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(receiver.ReceiveDir, "narrow"))
+	if err != nil || !bytes.Equal(b, want) {
+		t.Fatalf("want the file recieved whole; got %d bytes, %v", len(b), err)
+	}
+}
+
+func TestProbePathUnanswered(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("paths are only probed on linux")
+	}
+	sender := startTestPeer(t, "sender")
+	other := RandomPeer("silent")
+	defer other.lstn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := sender.ProbePath(ctx, other.lstn.LocalAddr().(*net.UDPAddr)); !errors.Is(err, ErrPathProbeFailed) {
+		t.Fatalf("want ErrPathProbeFailed probing a peer that is not serving; got %v", err)
+	}
+}
+
+// bigConn drops the first drop datagrams written to it that are larger than
+// size bytes, the chunks of a file being sent even when they are sealed.
+type bigConn struct {
+	*net.UDPConn
+	size int
+	drop int32
+}
+
+func (c *bigConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if len(b) > c.size && atomic.AddInt32(&c.drop, -1) >= 0 {
+		return len(b), nil
+	}
+	return c.UDPConn.WriteToUDP(b, addr)
+}
+
+func TestSecureTransferFullAck(t *testing.T) {
+	senderKey, receiverKey := testKey(t), testKey(t)
+	sender := startTestPeer(t, "sender", secure(senderKey, receiverKey), func(p *Peer) {
+		p.wire = &bigConn{UDPConn: p.lstn, size: 1000, drop: 600}
+	})
+	receiver := startTestPeer(t, "receiver", secure(receiverKey, senderKey))
+	receiver.paths.set(sender.LocalAddr.UDPAddr(), defaultMTU)
+
+	// more chunks go missing than the indices of a sealed ack fit in the
+	// path back to the sender
+	want := make([]byte, 1000*defaultChunkSize)
+	rand.Read(want)
+	name := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(name, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := sender.SendFile(ctx, name, receiver.LocalAddr.UDPAddr(), nil); err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(receiver.ReceiveDir, "file"))
+	if err != nil {
+		t.Fatalf("reading recieved file: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("recieved file differs from sent file")
+	}
+}
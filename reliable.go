@@ -0,0 +1,221 @@
+package zinc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Packets of the types a peer marks as reliable are numbered and sent with
+// the flagReliable flag set. The receiver of such a packet acknowledges it by
+// sending back a packet with the flagAck flag and the same sequence number,
+// and drops copies of the packet it has already seen. The sender retransmits
+// the packet with exponential backoff until it is acknowledged or it runs out
+// of retransmissions. Sequence numbers start at a random number in every
+// process, so the packets of a peer that restarts on the same address are not
+// taken for copies of the ones it sent before.
+
+const (
+	// retransmitTimeout is how long to wait for the first acknowledgement of
+	// a packet, the wait doubles after every retransmission.
+	retransmitTimeout = 200 * time.Millisecond
+
+	// maxRetransmits is the number of times a packet is retransmitted before
+	// the sender gives up on it.
+	maxRetransmits = 5
+
+	// dedupWindow is how long a receiver remembers the sequence numbers of
+	// the packets it has seen. It must outlast all the retransmissions of a
+	// packet.
+	dedupWindow = 30 * time.Second
+)
+
+var ErrNotAcknowledged = errors.New("packet not acknowledged by peer")
+
+// defaultReliableTypes are the packet types that are delivered reliably
+// unless a peer says otherwise. Transfers have their own acknowledgements so
+// their packets are not part of the set.
+var defaultReliableTypes = []PacketType{Error, Ping, Pong, PeerInfo, Handshake}
+
+// transport is the socket a peer sends and recieves its packets through.
+type transport interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// seqKey identifies a packet of the reliable delivery layer.
+type seqKey struct {
+	addr string
+	seq  uint32
+}
+
+// reliability is the state of the reliable delivery layer of a peer.
+type reliability struct {
+	sync.Mutex
+	types     map[PacketType]bool
+	seq       uint32
+	timeout   time.Duration
+	unacked   map[seqKey]chan struct{}
+	seen      map[seqKey]time.Time
+	lastPrune time.Time
+}
+
+func newReliability() *reliability {
+	r := &reliability{
+		types:   make(map[PacketType]bool),
+		timeout: retransmitTimeout,
+		unacked: make(map[seqKey]chan struct{}),
+		seen:    make(map[seqKey]time.Time),
+	}
+	var seq [4]byte
+	if _, err := rand.Read(seq[:]); err == nil {
+		r.seq = binary.BigEndian.Uint32(seq[:])
+	}
+	for _, typ := range defaultReliableTypes {
+		r.types[typ] = true
+	}
+	return r
+}
+
+// SetReliable turns reliable delivery of packets of type typ on or off.
+func (p *Peer) SetReliable(typ PacketType, reliable bool) {
+	p.reliability.Lock()
+	defer p.reliability.Unlock()
+	p.reliability.types[typ] = reliable
+}
+
+func (r *reliability) reliable(typ PacketType) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.types[typ]
+}
+
+// track numbers a packet sent to addr and returns its sequence number and
+// the channel that is closed when the packet is acknowledged.
+func (r *reliability) track(addr *net.UDPAddr) (uint32, chan struct{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.seq++
+	if r.seq == 0 {
+		r.seq++
+	}
+	acked := make(chan struct{})
+	r.unacked[seqKey{addr.String(), r.seq}] = acked
+	return r.seq, acked
+}
+
+func (r *reliability) untrack(addr *net.UDPAddr, seq uint32) {
+	r.Lock()
+	delete(r.unacked, seqKey{addr.String(), seq})
+	r.Unlock()
+}
+
+// ack marks the packet acknowledged by packet as delivered.
+func (r *reliability) ack(packet Packet, seq uint32) {
+	key := seqKey{packet.Addr().String(), seq}
+	r.Lock()
+	defer r.Unlock()
+	if acked, ok := r.unacked[key]; ok {
+		close(acked)
+		delete(r.unacked, key)
+	}
+}
+
+// duplicate reports whether a reliable packet has been seen before and
+// remembers it if it hasn't.
+func (r *reliability) duplicate(packet Packet, seq uint32) bool {
+	now := time.Now()
+	key := seqKey{packet.Addr().String(), seq}
+	r.Lock()
+	defer r.Unlock()
+	if now.Sub(r.lastPrune) > dedupWindow {
+		for k, t := range r.seen {
+			if now.Sub(t) > dedupWindow {
+				delete(r.seen, k)
+			}
+		}
+		r.lastPrune = now
+	}
+	if _, ok := r.seen[key]; ok {
+		return true
+	}
+	r.seen[key] = now
+	return false
+}
+
+// sendReliable sends packet to addr and retransmits it until the packet is
+// acknowledged or ctx is done.
+func (p *Peer) sendReliable(ctx context.Context, packet Packet, addr *net.UDPAddr) error {
+	seq, acked := p.reliability.track(addr)
+	defer p.reliability.untrack(addr, seq)
+
+	b, err := MarshalPacket(&requestWrapper{
+		typ:   packet.Type(),
+		id:    packet.Id(),
+		flags: flagReliable,
+		seq:   seq,
+		data:  packet.Data(),
+	})
+	if err != nil {
+		return err
+	}
+
+	timeout := p.reliability.timeout
+	for i := 0; i <= maxRetransmits; i++ {
+		if err := p.write(b, addr); err != nil {
+			return err
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case <-acked:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+			timeout *= 2
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	return ErrNotAcknowledged
+}
+
+// recieveReliable handles the reliable delivery layer of an incoming packet.
+// It reports whether the packet is done with, either because it only carried
+// an acknowledgement or because it is a copy of a packet that has already
+// been handled.
+func (p *Peer) recieveReliable(packet Packet) bool {
+	s, ok := packet.(sequenced)
+	if !ok {
+		return false
+	}
+	flags, seq := s.sequence()
+	switch {
+	case flags&flagAck != 0:
+		p.reliability.ack(packet, seq)
+		return true
+	case flags&flagReliable != 0:
+		go p.acknowledge(packet, seq)
+		return p.reliability.duplicate(packet, seq)
+	}
+	return false
+}
+
+// acknowledge tells the sender of a reliable packet that it arrived. It is
+// run off the read loop since writing to a secure peer may need a handshake.
+func (p *Peer) acknowledge(packet Packet, seq uint32) {
+	ack, err := MarshalPacket(&requestWrapper{typ: packet.Type(), flags: flagAck, seq: seq})
+	if err == nil {
+		err = p.write(ack, packet.Addr())
+	}
+	if err != nil {
+		p.Logger().Error("could not acknowledge packet", F("packet_type", packet.Type()), F("remote_addr", packet.Addr()), F("error", err))
+	}
+}
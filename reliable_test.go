@@ -0,0 +1,129 @@
+package zinc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lossyConn is a transport that drops and duplicates the packets written to
+// it.
+type lossyConn struct {
+	*net.UDPConn
+	sync.Mutex
+	writes int
+
+	// drop reports whether the nth write is dropped.
+	drop func(n int) bool
+
+	// dup is the number of extra copies of every packet that goes through.
+	dup int
+}
+
+func (c *lossyConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	c.Lock()
+	c.writes++
+	n := c.writes
+	c.Unlock()
+	if c.drop != nil && c.drop(n) {
+		return len(b), nil
+	}
+	for i := 0; i < c.dup; i++ {
+		c.UDPConn.WriteToUDP(b, addr)
+	}
+	return c.UDPConn.WriteToUDP(b, addr)
+}
+
+func TestReliableRetransmit(t *testing.T) {
+	// both sides lose the first two packets they send.
+	lossy := func(p *Peer) {
+		p.wire = &lossyConn{UDPConn: p.lstn, drop: func(n int) bool { return n <= 2 }}
+	}
+	requester := startTestPeer(t, "requester", lossy)
+	responder := startTestPeer(t, "responder", lossy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	raddr := responder.lstn.LocalAddr().(*net.UDPAddr)
+	resp, err := requester.Request(ctx, NewPacket(Ping, nil, raddr))
+	if err != nil {
+		t.Fatalf("Request over lossy transport: %v", err)
+	}
+	if resp.Type() != PeerInfo {
+		t.Fatalf("want %s response; got %s", PeerInfo, resp.Type())
+	}
+}
+
+func TestReliableDuplicates(t *testing.T) {
+	const testPacket PacketType = 0xf0
+	var handled int32
+	sender := startTestPeer(t, "sender", func(p *Peer) {
+		p.wire = &lossyConn{UDPConn: p.lstn, dup: 3}
+		p.SetReliable(testPacket, true)
+	})
+	receiver := startTestPeer(t, "receiver", func(p *Peer) {
+		p.HandleFunc(testPacket, func(context.Context, ResponseWriter, Packet) { atomic.AddInt32(&handled, 1) })
+	})
+
+	raddr := receiver.lstn.LocalAddr().(*net.UDPAddr)
+	for i := 0; i < 5; i++ {
+		if err := sender.Send(NewPacket(testPacket, []byte{byte(i)}, raddr)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&handled); n != 5 {
+		t.Fatalf("want 5 packets handled; got %d", n)
+	}
+}
+
+func TestReliableGivesUp(t *testing.T) {
+	sender := startTestPeer(t, "sender", func(p *Peer) {
+		p.wire = &lossyConn{UDPConn: p.lstn, drop: func(int) bool { return true }}
+		p.reliability.timeout = 10 * time.Millisecond
+	})
+	receiver := startTestPeer(t, "receiver")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	raddr := receiver.lstn.LocalAddr().(*net.UDPAddr)
+	if err := sender.send(ctx, NewPacket(Ping, nil, raddr), nil); !errors.Is(err, ErrNotAcknowledged) {
+		t.Fatalf("want %v; got %v", ErrNotAcknowledged, err)
+	}
+}
+
+func TestReliableRestart(t *testing.T) {
+	responder := startTestPeer(t, "responder")
+	raddr := responder.lstn.LocalAddr().(*net.UDPAddr)
+	requester := startTestPeer(t, "requester")
+	laddr := requester.lstn.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := requester.Request(ctx, NewPacket(Ping, nil, raddr)); err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+
+	// the requester restarts on the same address, its packets are not taken
+	// for the ones it sent before
+	sctx, scancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	requester.Shutdown(sctx)
+	scancel()
+	restarted := startTestPeer(t, "requester", func(p *Peer) {
+		p.lstn.Close()
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			t.Fatalf("listening on %s again: %v", laddr, err)
+		}
+		p.lstn = conn
+	})
+	rctx, rcancel := context.WithTimeout(ctx, time.Second)
+	defer rcancel()
+	if _, err := restarted.Request(rctx, NewPacket(Ping, nil, raddr)); err != nil {
+		t.Fatalf("Request after restart: %v", err)
+	}
+}
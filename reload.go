@@ -0,0 +1,300 @@
+package zinc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Joe-Degs/zinc/internal/config"
+	"github.com/Joe-Degs/zinc/internal/netutil"
+	"github.com/google/uuid"
+)
+
+// A running peer is reloaded with a new config without stopping it. The
+// settings that can change on the fly are applied and the rest are reported
+// as needing a restart. A peer moved to a new address keeps reading its old
+// socket for a while after it starts using the new one, so the responses to
+// packets sent before the move still find their way back.
+
+// rebindGrace is how long the old socket of a peer stays open after the peer
+// moves to another address.
+const rebindGrace = 5 * time.Second
+
+var ErrNotRunning = errors.New("peer is not running")
+
+// socket holds the socket of a running peer so it can be swapped for a socket
+// on another address.
+type socket struct {
+	mu   sync.RWMutex
+	conn transport
+
+	// listen starts reading the packets that arrive on a socket.
+	listen func(conn transport)
+
+	// done is closed when the peer stops serving.
+	done <-chan struct{}
+}
+
+func (s *socket) get() transport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conn
+}
+
+// swap makes conn the socket of the peer and returns the old socket.
+func (s *socket) swap(conn transport) transport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.conn
+	s.conn = conn
+	return old
+}
+
+// settings is the config a peer was loaded with. It also guards the Name and
+// LocalAddr of the peer, which change when the peer is reloaded.
+type settings struct {
+	sync.RWMutex
+	conf *config.PeerConfig
+}
+
+// info returns the peer info of the peer marshaled with marshal.
+func (p *Peer) info(marshal func() ([]byte, error)) ([]byte, error) {
+	p.settings.RLock()
+	defer p.settings.RUnlock()
+	return marshal()
+}
+
+// A ConfigChange is a setting that differs between a running peer and the
+// config it is reloaded with.
+type ConfigChange struct {
+	Setting string
+	Old     string
+	New     string
+
+	// Restart is set for the settings that take effect after a restart.
+	Restart bool
+}
+
+func (c ConfigChange) String() string {
+	var s string
+	switch {
+	case c.Old == "":
+		s = fmt.Sprintf("%s: added %s", c.Setting, c.New)
+	case c.New == "":
+		s = fmt.Sprintf("%s: removed %s", c.Setting, c.Old)
+	default:
+		s = fmt.Sprintf("%s: %s -> %s", c.Setting, c.Old, c.New)
+	}
+	if c.Restart {
+		s += " (restart needed)"
+	}
+	return s
+}
+
+// Reload applies conf to the running peer and reports what changed. The name,
+// address and log level of the peer change on the fly, everything else is
+// reported as needing a restart. Nothing is applied when an error is returned.
+func (p *Peer) Reload(conf *config.PeerConfig) ([]ConfigChange, error) {
+	if p.sock == nil {
+		return nil, ErrNotRunning
+	}
+	p.settings.Lock()
+	defer p.settings.Unlock()
+
+	old := p.settings.conf
+	if old == nil {
+		old = &config.PeerConfig{Name: p.Name, Addr: p.LocalAddr.String(), Id: p.Id.String()}
+	}
+	level := LevelInfo
+	if conf.LogLevel != "" {
+		var err error
+		if level, err = ParseLevel(conf.LogLevel); err != nil {
+			return nil, err
+		}
+	}
+
+	var changes []ConfigChange
+	if conf.Addr != old.Addr {
+		conn, addr, err := netutil.ConnAndAddr(conf.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("moving to %s: %w", conf.Addr, err)
+		}
+		changes = append(changes, ConfigChange{Setting: "addr", Old: p.LocalAddr.String(), New: addr.String()})
+		p.rebind(conn)
+		p.LocalAddr = addr
+	}
+	if conf.Name != p.Name {
+		changes = append(changes, ConfigChange{Setting: "name", Old: p.Name, New: conf.Name})
+		p.Name = conf.Name
+	}
+	if level != p.Logger().Level() {
+		changes = append(changes, ConfigChange{Setting: "log_level", Old: p.Logger().Level().String(), New: level.String()})
+		p.Logger().SetLevel(level)
+	}
+
+	for _, s := range []struct {
+		setting  string
+		old, new string
+	}{
+		{"id", old.Id, conf.Id},
+		{"receive_dir", old.ReceiveDir, conf.ReceiveDir},
+		{"control", old.Control, conf.Control},
+		{"state_dir", old.StateDir, conf.StateDir},
+		{"registry", old.Registry, conf.Registry},
+		{"key_file", old.KeyFile, conf.KeyFile},
+		{"log_format", old.LogFormat, conf.LogFormat},
+		{"log_file", old.LogFile, conf.LogFile},
+		{"trusted_keys", strings.Join(old.TrustedKeys, ","), strings.Join(conf.TrustedKeys, ",")},
+		{"max_file_size", countString(old.MaxFileSize), countString(conf.MaxFileSize)},
+		{"preserve_owner", strconv.FormatBool(old.PreserveOwner), strconv.FormatBool(conf.PreserveOwner)},
+		{"workers", countString(int64(old.Workers)), countString(int64(conf.Workers))},
+		{"queue_size", countString(int64(old.QueueSize)), countString(int64(conf.QueueSize))},
+	} {
+		if s.old != s.new {
+			changes = append(changes, ConfigChange{Setting: s.setting, Old: s.old, New: s.new, Restart: true})
+		}
+	}
+	p.settings.conf = conf
+	return changes, nil
+}
+
+// rebind makes conn the socket of the peer. The old socket is read until the
+// grace period is over, conn is closed when the peer stops serving. A secure
+// peer renews its sessions from the new address.
+func (p *Peer) rebind(conn transport) {
+	old := p.sock.swap(conn)
+	p.dontFragment(conn)
+	p.sock.listen(conn)
+	if p.secure != nil {
+		p.rehandshake()
+	}
+	time.AfterFunc(rebindGrace, func() {
+		old.Close()
+	})
+	go func() {
+		<-p.sock.done
+		conn.Close()
+	}()
+}
+
+// Reload applies conf to the running cluster and reports what changed. On top
+// of what a peer changes on the fly, the peers of the cluster config are added
+// to and removed from the members. The members hear of a new name or address
+// of the cluster through its gossip.
+func (c *Cluster) Reload(conf *config.ClusterConfig) ([]ConfigChange, error) {
+	changes, err := c.Peer.Reload(conf.PeerConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		if change.Setting == "name" || change.Setting == "addr" {
+			c.membership.Lock()
+			c.membership.incarnation++
+			c.membership.Unlock()
+			c.membership.enqueue(c.self(stateAlive))
+			break
+		}
+	}
+
+	c.mu.Lock()
+	seeds := make(map[string]string)
+	for _, peer := range conf.Peers {
+		if peer.Addr == "" {
+			continue
+		}
+		if id, ok := c.seeds[peer.Addr]; ok {
+			seeds[peer.Addr] = id
+			continue
+		}
+		n, err := c.addSeed(peer)
+		if err != nil {
+			c.Logger().Warn("skipping cluster member", F("member", peer.Name), F("error", err))
+			continue
+		}
+		if n == nil {
+			continue
+		}
+		seeds[peer.Addr] = n.Id.String()
+		changes = append(changes, ConfigChange{Setting: "peers", New: n.String()})
+	}
+	for addr, id := range c.seeds {
+		if _, ok := seeds[addr]; ok {
+			continue
+		}
+		n, ok := c.nodes[id]
+		if !ok {
+			continue
+		}
+		// the member is not taken back on old news about it.
+		_, inc := n.memberState()
+		c.membership.Lock()
+		c.membership.gone[n.Id] = inc
+		c.membership.Unlock()
+		delete(c.nodes, id)
+		changes = append(changes, ConfigChange{Setting: "peers", Old: n.String()})
+	}
+	c.seeds = seeds
+	c.membershipChanged()
+	c.mu.Unlock()
+
+	if !reflect.DeepEqual(c.discoveryConf, conf.Discovery) {
+		changes = append(changes, ConfigChange{
+			Setting: "discovery",
+			Old:     discoveryString(c.discoveryConf),
+			New:     discoveryString(conf.Discovery),
+			Restart: true,
+		})
+	}
+	return changes, nil
+}
+
+// addSeed adds a peer of the cluster config to the members, it returns nil
+// for the cluster itself. A peer that is already a member is left as it is.
+// c.mu must be held.
+func (c *Cluster) addSeed(peer *config.PeerConfig) (*Node, error) {
+	var id uuid.UUID
+	if peer.Id != "" {
+		var err error
+		if id, err = uuid.Parse(peer.Id); err != nil {
+			return nil, err
+		}
+	} else {
+		id = uuid.New()
+	}
+	if id == c.Id {
+		return nil, nil
+	}
+	if n, ok := c.nodes[id.String()]; ok {
+		return n, nil
+	}
+	p, err := remotePeer(peer.Name, peer.Addr, id)
+	if err != nil {
+		return nil, err
+	}
+	n := c.newNode(p)
+	c.nodes[id.String()] = n
+	return n, nil
+}
+
+// countString returns n as a setting, a count of zero is the default.
+func countString(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func discoveryString(conf *config.DiscoveryConfig) string {
+	if conf == nil || !conf.Enabled {
+		return "disabled"
+	}
+	group := conf.Group
+	if group == "" {
+		group = DefaultDiscoveryGroup
+	}
+	return fmt.Sprintf("cluster %q on %s", conf.ClusterId, group)
+}
@@ -0,0 +1,160 @@
+package zinc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Joe-Degs/zinc/internal/config"
+)
+
+// freeAddr returns a local address nobody is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestPeerReload(t *testing.T) {
+	conf := &config.PeerConfig{Name: "kofi", Addr: "127.0.0.1:0"}
+	p, err := NewPeer(conf)
+	if err != nil {
+		t.Fatalf("NewPeer: %v", err)
+	}
+	cancel, err := p.StartServer()
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	defer func() {
+		cancel()
+		p.lstn.Close()
+	}()
+	pinger := startTestPeer(t, "pinger")
+
+	addr := freeAddr(t)
+	changes, err := p.Reload(&config.PeerConfig{Name: "messi", Addr: addr, ReceiveDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	want := map[string]bool{"addr": false, "name": false, "receive_dir": true}
+	if len(changes) != len(want) {
+		t.Fatalf("want %d changes; got %v", len(want), changes)
+	}
+	for _, c := range changes {
+		if restart, ok := want[c.Setting]; !ok || restart != c.Restart {
+			t.Fatalf("unexpected change %s", c)
+		}
+	}
+
+	ctx, cancelReq := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelReq()
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	resp, err := pinger.Request(ctx, NewPacket(Ping, nil, raddr))
+	if err != nil {
+		t.Fatalf("ping on new address: %v", err)
+	}
+	var info Peer
+	if err := info.UnmarshalBinary(resp.Data()); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "messi" || info.LocalAddr.String() != addr {
+		t.Fatalf("want messi on %s; got %s on %s", addr, info.Name, info.LocalAddr)
+	}
+
+	if changes, err := p.Reload(&config.PeerConfig{Name: "messi", Addr: addr, ReceiveDir: conf.ReceiveDir}); err != nil || len(changes) != 1 {
+		t.Fatalf("want only receive_dir to change back; got %v, %v", changes, err)
+	}
+	if _, err := p.Reload(&config.PeerConfig{Name: "oskee", Addr: "127.0.0.1:http"}); err == nil {
+		t.Fatalf("want error moving to an invalid address")
+	}
+	if p.Name != "messi" {
+		t.Fatalf("want nothing applied after a failed reload; got name %s", p.Name)
+	}
+
+	changes, err = p.Reload(&config.PeerConfig{Name: "messi", Addr: addr, ReceiveDir: conf.ReceiveDir, LogLevel: "debug"})
+	if err != nil || len(changes) != 1 || changes[0].Setting != "log_level" || changes[0].Restart {
+		t.Fatalf("want the log level changed on the fly; got %v, %v", changes, err)
+	}
+	if p.Logger().Level() != LevelDebug {
+		t.Fatalf("want log level %s; got %s", LevelDebug, p.Logger().Level())
+	}
+}
+
+func TestSecureReload(t *testing.T) {
+	kofiKey, messiKey := testKey(t), testKey(t)
+	kofi := startTestPeer(t, "kofi", secure(kofiKey, messiKey))
+	messi := startTestPeer(t, "messi", secure(messiKey, kofiKey))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := kofi.Request(ctx, NewPacket(Ping, nil, messi.LocalAddr.UDPAddr())); err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+
+	addr := freeAddr(t)
+	if _, err := kofi.Reload(&config.PeerConfig{Name: "kofi", Addr: addr, ReceiveDir: kofi.ReceiveDir}); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	// messi only knows the session of kofi on its old address, kofi has
+	// to bring a new one along when it moves.
+	for _, pair := range [][2]*Peer{{kofi, messi}, {messi, kofi}} {
+		from, to := pair[0], pair[1]
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := from.Request(ctx, NewPacket(Ping, nil, to.LocalAddr.UDPAddr()))
+		cancel()
+		if err != nil {
+			t.Fatalf("%s pinging %s after the move: %v", from.Name, to.Name, err)
+		}
+	}
+}
+
+func TestClusterReload(t *testing.T) {
+	kofi, _ := startTestCluster(t, "kofi")
+	messi, _ := startTestCluster(t, "messi")
+	oskee, _ := startTestCluster(t, "oskee")
+
+	seed := func(c *Cluster) *config.PeerConfig {
+		return &config.PeerConfig{Name: c.Name, Id: c.Id.String(), Addr: c.LocalAddr.String()}
+	}
+	conf := &config.ClusterConfig{
+		PeerConfig: &config.PeerConfig{Name: "oskee", Addr: oskee.settings.conf.Addr},
+		Peers:      []*config.PeerConfig{seed(kofi), seed(messi)},
+	}
+	changes, err := oskee.Reload(conf)
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("want kofi and messi added; got %v", changes)
+	}
+	waitFor(t, "kofi and messi to be members", func() bool {
+		for _, c := range []*Cluster{kofi, messi} {
+			if status, ok := memberStatus(oskee, c.Id); !ok || status != ACTIVE {
+				return false
+			}
+		}
+		return true
+	})
+
+	conf.Name = "renamed"
+	conf.Peers = conf.Peers[1:]
+	if changes, err = oskee.Reload(conf); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("want a new name and kofi removed; got %v", changes)
+	}
+	if _, ok := memberStatus(oskee, kofi.Id); ok {
+		t.Fatalf("want kofi removed from the members")
+	}
+	waitFor(t, "messi to hear of the new name", func() bool {
+		n := messi.FindById(oskee.Id.String())
+		return n != nil && n.Name == "renamed"
+	})
+}
@@ -0,0 +1,112 @@
+package zinc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// newRequestId returns a random non zero id for a request. A zero id marks a
+// packet that is not waiting for a response. The ids are hard to guess so
+// responses cannot easily be forged for requests of the peer.
+func newRequestId() uint32 {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			continue
+		}
+		if id := binary.BigEndian.Uint32(b[:]); id != 0 {
+			return id
+		}
+	}
+}
+
+// pendingRequest is a request waiting for its response.
+type pendingRequest struct {
+	addr *net.UDPAddr
+	resp chan Packet
+}
+
+// pending keeps track of the requests of a peer that are waiting for
+// responses.
+type pending struct {
+	sync.Mutex
+	requests map[uint32]*pendingRequest
+}
+
+func newPending() *pending {
+	return &pending{requests: make(map[uint32]*pendingRequest)}
+}
+
+func (pd *pending) add(id uint32, addr *net.UDPAddr) *pendingRequest {
+	pr := &pendingRequest{addr: addr, resp: make(chan Packet, 1)}
+	pd.Lock()
+	pd.requests[id] = pr
+	pd.Unlock()
+	return pr
+}
+
+func (pd *pending) remove(id uint32) {
+	pd.Lock()
+	delete(pd.requests, id)
+	pd.Unlock()
+}
+
+// deliver hands packet to the request it responds to. It reports whether
+// there was a request waiting for the packet. A response must come from the
+// address the request was sent to.
+func (pd *pending) deliver(packet Packet) bool {
+	if packet.Id() == 0 {
+		return false
+	}
+	pd.Lock()
+	pr, ok := pd.requests[packet.Id()]
+	if ok && sameAddr(pr.addr, packet.Addr()) {
+		delete(pd.requests, packet.Id())
+	} else {
+		ok = false
+	}
+	pd.Unlock()
+	if ok {
+		pr.resp <- packet
+	}
+	return ok
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// Request sends packet to its remote endpoint and blocks until the response
+// to the packet arrives or ctx is done. The peer must have its server running
+// to recieve the response.
+func (p *Peer) Request(ctx context.Context, packet Packet) (Packet, error) {
+	if packet.Addr() == nil {
+		return nil, fmt.Errorf("Request: specify remote endpoint to send packet")
+	}
+
+	req := &requestWrapper{
+		typ:  packet.Type(),
+		id:   newRequestId(),
+		data: packet.Data(),
+		addr: packet.Addr(),
+	}
+	pr := p.pending.add(req.id, req.addr)
+	defer p.pending.remove(req.id)
+
+	if err := p.send(ctx, req, nil); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-pr.resp:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
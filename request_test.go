@@ -0,0 +1,103 @@
+package zinc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Joe-Degs/zinc/internal/netutil"
+	"github.com/Joe-Degs/zinc/internal/registry"
+)
+
+func TestRequest(t *testing.T) {
+	requester := startTestPeer(t, "requester")
+	responder := startTestPeer(t, "responder")
+	raddr := responder.lstn.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := requester.Request(ctx, NewPacket(Ping, nil, raddr))
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	if resp.Type() != PeerInfo || resp.Id() == 0 {
+		t.Fatalf("want %s response with an id; got %s with id %d", PeerInfo, resp.Type(), resp.Id())
+	}
+
+	resp, err = requester.Request(ctx, NewPacket(PacketType(0xfe), nil, raddr))
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	if resp.Type() != Error {
+		t.Fatalf("want %s response for unknown packet type; got %s", Error, resp.Type())
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	requester := startTestPeer(t, "requester")
+	// nobody reads from this socket so the request is never responded to.
+	silent, err := netutil.ListenOnLocalRandomPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = requester.Request(ctx, NewPacket(Ping, nil, silent.LocalAddr().(*net.UDPAddr)))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("want %v; got %v", context.DeadlineExceeded, err)
+	}
+	if n := len(requester.pending.requests); n != 0 {
+		t.Fatalf("want no pending requests after timeout; got %d", n)
+	}
+}
+
+func TestRegistryRemembersPeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	reg, err := registry.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asker := startTestPeer(t, "asker", func(p *Peer) { p.registry = reg })
+	kofi := startTestPeer(t, "kofi")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := asker.Request(ctx, NewPacket(Ping, nil, kofi.LocalAddr.UDPAddr())); err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+
+	var rec *registry.Record
+	deadline := time.Now().Add(5 * time.Second)
+	for rec == nil || rec.Status != registry.Active {
+		if time.Now().After(deadline) {
+			t.Fatalf("want kofi in the registry; got %+v, %v", rec, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		rec, err = reg.Get(kofi.Id.String())
+	}
+	if rec.Name != "kofi" || len(rec.Addrs) == 0 || rec.Addrs[0] != kofi.LocalAddr.String() {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+
+	// peer info nobody asked for is not remembered
+	intruder := startTestPeer(t, "intruder")
+	info, err := intruder.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := intruder.Send(NewPacket(PeerInfo, info, asker.LocalAddr.UDPAddr())); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := asker.Request(ctx, NewPacket(Ping, nil, kofi.LocalAddr.UDPAddr())); err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := reg.Get(intruder.Id.String()); !errors.Is(err, registry.ErrNotFound) {
+		t.Fatalf("want unsolicited peer info ignored; got %v", err)
+	}
+}
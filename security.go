@@ -0,0 +1,559 @@
+package zinc
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// A secure peer only talks to peers whose long-term keys it trusts. Before
+// two secure peers exchange packets they run a handshake:
+//
+//	initiator -> responder: Handshake{static key, ephemeral key, signature}
+//	responder -> initiator: Handshake{static key, ephemeral key, signature}
+//
+// Each side signs its ephemeral key and the time with its static key, the
+// responder also signs the ephemeral key of the initiator so its response
+// can't be replayed. The responder turns down hellos that are too old or that
+// it has seen before, so they can't be replayed either. A handshake with a
+// peer the responder already has a session with only replaces the session
+// once the initiator seals a packet with the new one.
+// The session keys are derived from the Diffie-Hellman of the ephemeral keys,
+// one for each direction. Every packet after the handshake is sealed with
+// ChaCha20-Poly1305, only the version and the flags of its header are left in
+// the clear. Handshake packets are the only plaintext packets a secure peer
+// accepts.
+//
+// A session is dropped when a reliable packet sent with it is never
+// acknowledged, the next packet to the peer starts a new handshake. That is
+// how a peer that restarted and lost its sessions is reached again.
+
+const (
+	// handshakeTimeout is how long to wait for the response to a handshake.
+	handshakeTimeout = 3 * time.Second
+
+	// sealTagLen is the length of the authentication tag of a sealed packet.
+	sealTagLen = 16
+
+	// sealOverhead is the number of bytes sealing adds to a packet, the
+	// counter and the authentication tag.
+	sealOverhead = 8 + sealTagLen
+
+	// sealedHeaderLen is the number of bytes a sealed packet starts with in
+	// the clear: the magic, version and flags of the packet and the counter
+	// the packet was sealed with.
+	sealedHeaderLen = offType + 8
+
+	// helloMaxAge is how far the time in a hello may be off from the clock
+	// of the responder.
+	helloMaxAge = time.Minute
+
+	handshakeLen = ed25519.PublicKeySize + curve25519.PointSize + 8 + ed25519.SignatureSize
+)
+
+var (
+	ErrUntrustedKey     = errors.New("peer key is not trusted")
+	ErrHandshakeFailed  = errors.New("handshake failed")
+	ErrNoSession        = errors.New("no session with peer")
+	ErrInvalidSignature = errors.New("invalid handshake signature")
+	ErrStaleHello       = errors.New("stale or replayed handshake")
+)
+
+// session holds the keys of a handshake with a peer.
+type session struct {
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	counter uint64
+	mu      sync.Mutex
+	window  replayWindow
+
+	// prev is the session this one replaced. When two peers handshake with
+	// each other at the same time they can end up sending with different
+	// sessions, so packets are opened with the previous session too.
+	prev *session
+}
+
+// replayWindow remembers the counters of the last 64 packets opened by a
+// session.
+type replayWindow struct {
+	max  uint64
+	seen uint64
+}
+
+// accept reports whether the counter n has not been seen before and marks it
+// as seen.
+func (w *replayWindow) accept(n uint64) bool {
+	switch {
+	case n > w.max:
+		if shift := n - w.max; shift < 64 {
+			w.seen = w.seen<<shift | 1
+		} else {
+			w.seen = 1
+		}
+		w.max = n
+		return true
+	case w.max-n >= 64:
+		return false
+	default:
+		bit := uint64(1) << (w.max - n)
+		if w.seen&bit != 0 {
+			return false
+		}
+		w.seen |= bit
+		return true
+	}
+}
+
+// security is the identity of a secure peer and its sessions with other
+// peers.
+type security struct {
+	key     ed25519.PrivateKey
+	trusted map[string]bool
+
+	sync.Mutex
+	sessions   map[string]*session
+	handshakes map[string]*handshakeCall
+
+	// pending are the sessions of handshakes that wait for the initiator to
+	// use them before they replace the session with the peer.
+	pending map[string]*session
+
+	// hellos are the ephemeral keys of the hellos seen in the last
+	// helloMaxAge, a hello with one of them is a replay.
+	hellos map[string]time.Time
+}
+
+// handshakeCall is a handshake in progress that other senders wait on.
+type handshakeCall struct {
+	done chan struct{}
+	ss   *session
+	err  error
+}
+
+// Secure makes the peer authenticate itself with key and only talk to the
+// peers whose public keys are trusted. All the packets the peer sends after
+// a handshake are encrypted. It must be called before the server of the peer
+// is started.
+func (p *Peer) Secure(key ed25519.PrivateKey, trusted ...ed25519.PublicKey) {
+	s := &security{
+		key:        key,
+		trusted:    make(map[string]bool),
+		sessions:   make(map[string]*session),
+		handshakes: make(map[string]*handshakeCall),
+		pending:    make(map[string]*session),
+		hellos:     make(map[string]time.Time),
+	}
+	for _, k := range trusted {
+		s.trusted[string(k)] = true
+	}
+	p.secure = s
+	p.PublicKey = key.Public().(ed25519.PublicKey)
+}
+
+func (s *security) session(addr *net.UDPAddr) *session {
+	s.Lock()
+	defer s.Unlock()
+	return s.sessions[addr.String()]
+}
+
+// store makes ss the session with the peer at addr. s must be locked.
+func (s *security) store(addr *net.UDPAddr, ss *session) {
+	if old, ok := s.sessions[addr.String()]; ok {
+		old.prev = nil
+		ss.prev = old
+	}
+	s.sessions[addr.String()] = ss
+	delete(s.pending, addr.String())
+}
+
+// confirm makes the pending session ss the session with the peer at addr now
+// that the peer used it.
+func (s *security) confirm(addr *net.UDPAddr, ss *session) {
+	s.Lock()
+	defer s.Unlock()
+	if s.pending[addr.String()] == ss {
+		s.store(addr, ss)
+	}
+}
+
+func (s *security) forget(addr *net.UDPAddr) {
+	s.Lock()
+	delete(s.sessions, addr.String())
+	delete(s.pending, addr.String())
+	s.Unlock()
+}
+
+// seal encrypts the marshaled packet b with the session.
+func (ss *session) seal(b []byte) []byte {
+	ss.mu.Lock()
+	ss.counter++
+	n := ss.counter
+	ss.mu.Unlock()
+
+	out := make([]byte, sealedHeaderLen, len(b)+sealOverhead)
+	copy(out, b[:offType])
+	out[offFlags] |= flagSealed
+	binary.BigEndian.PutUint64(out[offType:], n)
+	return ss.send.Seal(out, nonce(n), b[offType:], out[:sealedHeaderLen])
+}
+
+// open decrypts a sealed packet and returns it marshaled.
+func (ss *session) open(b []byte) ([]byte, error) {
+	if len(b) < sealedHeaderLen+sealTagLen {
+		return nil, ErrShortPacket
+	}
+	n := binary.BigEndian.Uint64(b[offType:sealedHeaderLen])
+	plain, err := ss.recv.Open(nil, nonce(n), b[sealedHeaderLen:], b[:sealedHeaderLen])
+	if err != nil {
+		return nil, err
+	}
+	ss.mu.Lock()
+	fresh := ss.window.accept(n)
+	ss.mu.Unlock()
+	if !fresh {
+		return nil, errors.New("replayed packet")
+	}
+	out := append(make([]byte, 0, offType+len(plain)), b[:offType]...)
+	out[offFlags] &^= flagSealed
+	return append(out, plain...), nil
+}
+
+func nonce(n uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+// seal returns the marshaled packet b ready to be sent to addr, handshaking
+// with addr first when there is no session with it.
+func (p *Peer) seal(b []byte, addr *net.UDPAddr) ([]byte, error) {
+	if PacketType(b[offType]) == Handshake {
+		return b, nil
+	}
+	ss := p.secure.session(addr)
+	if ss == nil {
+		var err error
+		if ss, err = p.handshake(addr, false); err != nil {
+			return nil, err
+		}
+	}
+	return ss.seal(b), nil
+}
+
+// open returns the marshaled packet in the datagram b recieved from addr.
+// Plaintext packets other than handshakes are rejected, and so are plaintext
+// handshakes with flags other than those of the reliable delivery layer.
+func (p *Peer) open(b []byte, addr *net.UDPAddr) ([]byte, error) {
+	if len(b) < packetHeaderLen {
+		return nil, ErrShortPacket
+	}
+	if b[offFlags]&flagSealed == 0 {
+		if PacketType(b[offType]) != Handshake {
+			return nil, fmt.Errorf("plaintext %s packet rejected", PacketType(b[offType]))
+		}
+		if flags := b[offFlags] &^ (flagReliable | flagAck); flags != 0 {
+			return nil, fmt.Errorf("plaintext handshake with flags %#x rejected", flags)
+		}
+		return b, nil
+	}
+	p.secure.Lock()
+	ss := p.secure.sessions[addr.String()]
+	pending := p.secure.pending[addr.String()]
+	var prev *session
+	if ss != nil {
+		prev = ss.prev
+	}
+	p.secure.Unlock()
+	if ss == nil && pending == nil {
+		return nil, ErrNoSession
+	}
+	packet, err := []byte(nil), ErrNoSession
+	if ss != nil {
+		packet, err = ss.open(b)
+		if err != nil && prev != nil {
+			if packet, perr := prev.open(b); perr == nil {
+				return packet, nil
+			}
+		}
+	}
+	if err != nil && pending != nil {
+		if packet, perr := pending.open(b); perr == nil {
+			p.secure.confirm(addr, pending)
+			return packet, nil
+		}
+	}
+	return packet, err
+}
+
+// handshake establishes a session with the peer at addr, an existing session
+// is only renewed when renew is set. Concurrent senders to the same peer share
+// a single handshake.
+func (p *Peer) handshake(addr *net.UDPAddr, renew bool) (*session, error) {
+	s := p.secure
+	key := addr.String()
+	s.Lock()
+	if ss, ok := s.sessions[key]; ok && !renew {
+		s.Unlock()
+		return ss, nil
+	}
+	call, inProgress := s.handshakes[key]
+	if !inProgress {
+		call = &handshakeCall{done: make(chan struct{})}
+		s.handshakes[key] = call
+	}
+	s.Unlock()
+
+	if inProgress {
+		<-call.done
+		return call.ss, call.err
+	}
+
+	ss, err := p.initiate(addr)
+	if err != nil {
+		err = fmt.Errorf("%w with %s: %v", ErrHandshakeFailed, addr, err)
+	}
+	s.Lock()
+	if err == nil {
+		s.store(addr, ss)
+	}
+	delete(s.handshakes, key)
+	s.Unlock()
+	call.ss, call.err = ss, err
+	close(call.done)
+	return ss, err
+}
+
+// rehandshake renews the sessions with all the peers the peer has sessions
+// with. Peers know their sessions by the address of the other side, a peer
+// that moved to another address has to handshake with them again.
+func (p *Peer) rehandshake() {
+	p.secure.Lock()
+	addrs := make([]*net.UDPAddr, 0, len(p.secure.sessions))
+	for key := range p.secure.sessions {
+		if addr, err := net.ResolveUDPAddr("udp", key); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	p.secure.Unlock()
+	for _, addr := range addrs {
+		go func(addr *net.UDPAddr) {
+			if _, err := p.handshake(addr, true); err != nil {
+				p.Logger().Warn("renewing session failed", F("remote_addr", addr), F("error", err))
+			}
+		}(addr)
+	}
+}
+
+// initiate runs the initiator side of a handshake with the peer at addr.
+func (p *Peer) initiate(addr *net.UDPAddr) (*session, error) {
+	eph, ephPub, err := ephemeralKey()
+	if err != nil {
+		return nil, err
+	}
+	hello := p.secure.hello(ephPub, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	resp, err := p.Request(ctx, NewPacket(Handshake, hello, addr))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type() != Handshake {
+		return nil, fmt.Errorf("unexpected %s response", resp.Type())
+	}
+	peerEph, err := p.secure.verify(resp.Data(), ephPub)
+	if err != nil {
+		return nil, err
+	}
+	return newSession(eph, peerEph, ephPub, peerEph, true)
+}
+
+// handshakeHandler runs the responder side of a handshake.
+func (p *Peer) handshakeHandler(_ context.Context, w ResponseWriter, req Packet) {
+	peerEph, err := p.secure.verify(req.Data(), nil)
+	if err != nil {
+		p.Logger().Warn("handshake failed", F("remote_addr", req.Addr()), F("error", err))
+		return
+	}
+	eph, ephPub, err := ephemeralKey()
+	if err != nil {
+		p.Logger().Warn("handshake failed", F("remote_addr", req.Addr()), F("error", err))
+		return
+	}
+	ss, err := newSession(eph, peerEph, peerEph, ephPub, false)
+	if err != nil {
+		p.Logger().Warn("handshake failed", F("remote_addr", req.Addr()), F("error", err))
+		return
+	}
+
+	// a new handshake replaces the session of a peer that lost it, but only
+	// once the peer shows it has the new session too.
+	p.secure.Lock()
+	if _, ok := p.secure.sessions[req.Addr().String()]; ok {
+		p.secure.pending[req.Addr().String()] = ss
+	} else {
+		p.secure.store(req.Addr(), ss)
+	}
+	p.secure.Unlock()
+
+	if err := w.Respond(Handshake, p.secure.hello(ephPub, peerEph)); err != nil {
+		p.Logger().Error("failed to respond to handshake", F("remote_addr", req.Addr()), F("error", err))
+	}
+}
+
+// hello returns the handshake message announcing the ephemeral key eph. The
+// ephemeral key of the initiator is signed along in responses.
+func (s *security) hello(eph, initiator []byte) []byte {
+	b := new(bytes.Buffer)
+	b.Write(s.key.Public().(ed25519.PublicKey))
+	b.Write(eph)
+	binary.Write(b, binary.BigEndian, time.Now().Unix())
+	signed := b.Bytes()[ed25519.PublicKeySize:]
+	b.Write(ed25519.Sign(s.key, append(append([]byte{}, signed...), initiator...)))
+	return b.Bytes()
+}
+
+// verify checks the handshake message of a peer and returns the ephemeral key
+// in it. The hellos of initiators, verified with a nil initiator, must be
+// recent and seen for the first time.
+func (s *security) verify(data, initiator []byte) ([]byte, error) {
+	if len(data) != handshakeLen {
+		return nil, ErrShortPacket
+	}
+	pub := ed25519.PublicKey(data[:ed25519.PublicKeySize])
+	signed := data[ed25519.PublicKeySize : handshakeLen-ed25519.SignatureSize]
+	eph := signed[:curve25519.PointSize]
+	sig := data[handshakeLen-ed25519.SignatureSize:]
+	if !s.trusted[string(pub)] {
+		return nil, fmt.Errorf("%w: %s", ErrUntrustedKey, EncodeKey(pub))
+	}
+	if !ed25519.Verify(pub, append(append([]byte{}, signed...), initiator...), sig) {
+		return nil, ErrInvalidSignature
+	}
+	if initiator == nil {
+		at := time.Unix(int64(binary.BigEndian.Uint64(signed[curve25519.PointSize:])), 0)
+		if err := s.fresh(eph, at); err != nil {
+			return nil, err
+		}
+	}
+	return eph, nil
+}
+
+// fresh reports an error when a hello with the ephemeral key eph sent at at
+// is too old or has been seen before, and remembers it otherwise.
+func (s *security) fresh(eph []byte, at time.Time) error {
+	now := time.Now()
+	if d := now.Sub(at); d > helloMaxAge || d < -helloMaxAge {
+		return ErrStaleHello
+	}
+	s.Lock()
+	defer s.Unlock()
+	for k, seen := range s.hellos {
+		if now.Sub(seen) > 2*helloMaxAge {
+			delete(s.hellos, k)
+		}
+	}
+	if _, ok := s.hellos[string(eph)]; ok {
+		return ErrStaleHello
+	}
+	s.hellos[string(eph)] = now
+	return nil
+}
+
+func ephemeralKey() (priv, pub []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	return priv, pub, err
+}
+
+// newSession derives the keys of a session from the ephemeral keys of a
+// handshake.
+func newSession(eph, peerEph, initEph, respEph []byte, initiator bool) (*session, error) {
+	shared, err := curve25519.X25519(eph, peerEph)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte{}, initEph...), respEph...)
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("zinc session")), keys); err != nil {
+		return nil, err
+	}
+	toResp, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+	toInit, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, err
+	}
+	if initiator {
+		return &session{send: toResp, recv: toInit}, nil
+	}
+	return &session{send: toInit, recv: toResp}, nil
+}
+
+// EncodeKey returns the text form of a public key used in configuration
+// files.
+func EncodeKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// DecodeKey parses a public key encoded with EncodeKey.
+func DecodeKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key length %d", len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// LoadKey reads the private key of a peer from the file with the given name.
+// A new key is generated and saved to the file when it does not exist.
+func LoadKey(name string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		seed := base64.StdEncoding.EncodeToString(key.Seed())
+		if err := os.WriteFile(name, []byte(seed+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", name, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("key file %s: invalid key length %d", name, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
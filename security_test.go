@@ -0,0 +1,183 @@
+package zinc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func secure(key ed25519.PrivateKey, trusted ...ed25519.PrivateKey) func(*Peer) {
+	return func(p *Peer) {
+		pubs := make([]ed25519.PublicKey, len(trusted))
+		for i, k := range trusted {
+			pubs[i] = k.Public().(ed25519.PublicKey)
+		}
+		p.Secure(key, pubs...)
+	}
+}
+
+func TestSecurePeers(t *testing.T) {
+	kofiKey, messiKey, oskeeKey := testKey(t), testKey(t), testKey(t)
+	kofi := startTestPeer(t, "kofi", secure(kofiKey, messiKey))
+	messi := startTestPeer(t, "messi", secure(messiKey, kofiKey))
+	oskee := startTestPeer(t, "oskee", secure(oskeeKey, kofiKey))
+	plain := startTestPeer(t, "plain")
+
+	// both peers handshaking with each other at the same time must still
+	// end up talking.
+	var wg sync.WaitGroup
+	for _, pair := range [][2]*Peer{{kofi, messi}, {messi, kofi}, {kofi, messi}, {messi, kofi}} {
+		wg.Add(1)
+		go func(from, to *Peer) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := from.Request(ctx, NewPacket(Ping, nil, to.LocalAddr.UDPAddr()))
+			if err != nil {
+				t.Errorf("%s pinging %s: %v", from.Name, to.Name, err)
+				return
+			}
+			if resp.Type() != PeerInfo {
+				t.Errorf("%s pinging %s: want PeerInfo; got %s", from.Name, to.Name, resp.Type())
+			}
+		}(pair[0], pair[1])
+	}
+	wg.Wait()
+
+	// a transfer fills whole datagrams, they must still fit once sealed
+	name := filepath.Join(t.TempDir(), "secret")
+	want := make([]byte, 10*defaultChunkSize+5)
+	rand.Read(want)
+	if err := os.WriteFile(name, want, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sendCtx, sendCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer sendCancel()
+	if _, err := kofi.SendFile(sendCtx, name, messi.LocalAddr.UDPAddr(), nil); err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(messi.ReceiveDir, "secret")); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("want secret file recieved intact; got %d bytes, %v", len(got), err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// oskee trusts kofi but kofi does not trust oskee
+	if _, err := oskee.Request(ctx, NewPacket(Ping, nil, kofi.LocalAddr.UDPAddr())); !errors.Is(err, ErrHandshakeFailed) {
+		t.Errorf("want untrusted peer to fail the handshake; got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := plain.Request(ctx, NewPacket(Ping, nil, kofi.LocalAddr.UDPAddr())); err == nil {
+		t.Errorf("want plaintext ping to a secure peer to go unanswered")
+	}
+}
+
+func TestHandshakeReplay(t *testing.T) {
+	kofiKey, messiKey := testKey(t), testKey(t)
+	kofi := startTestPeer(t, "kofi", secure(kofiKey, messiKey))
+	messi := startTestPeer(t, "messi", secure(messiKey, kofiKey))
+	kofiAddr, messiAddr := kofi.LocalAddr.UDPAddr(), messi.LocalAddr.UDPAddr()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := messi.Request(ctx, NewPacket(Ping, nil, kofiAddr)); err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	established := kofi.secure.session(messiAddr)
+
+	_, eph, err := ephemeralKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := messi.secure.hello(eph, nil)
+	if _, err := kofi.secure.verify(hello, nil); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if _, err := kofi.secure.verify(hello, nil); !errors.Is(err, ErrStaleHello) {
+		t.Fatalf("want a replayed hello turned down; got %v", err)
+	}
+	stale := append([]byte{}, hello[:ed25519.PublicKeySize+len(eph)]...)
+	stale = append(stale, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(stale[len(stale)-8:], uint64(time.Now().Add(-2*helloMaxAge).Unix()))
+	stale = append(stale, ed25519.Sign(messiKey, stale[ed25519.PublicKeySize:])...)
+	if _, err := kofi.secure.verify(stale, nil); !errors.Is(err, ErrStaleHello) {
+		t.Fatalf("want an old hello turned down; got %v", err)
+	}
+
+	// a handshake nobody follows up on leaves the session as it is
+	_, eph, err = ephemeralKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := messi.Request(ctx, NewPacket(Handshake, messi.secure.hello(eph, nil), kofiAddr)); err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	if kofi.secure.session(messiAddr) != established {
+		t.Fatal("want the session kept until the new one is used")
+	}
+	if _, err := messi.Request(ctx, NewPacket(Ping, nil, kofiAddr)); err != nil {
+		t.Fatalf("Request with the old session: %v", err)
+	}
+
+	// a peer that lost its session handshakes again and the new session
+	// takes over once it is used
+	messi.secure.forget(kofiAddr)
+	if _, err := messi.Request(ctx, NewPacket(Ping, nil, kofiAddr)); err != nil {
+		t.Fatalf("Request after losing the session: %v", err)
+	}
+	if ss := kofi.secure.session(messiAddr); ss == established || ss == nil {
+		t.Fatal("want the new session to replace the old one")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, tc := range []struct {
+		n    uint64
+		want bool
+	}{
+		{1, true}, {3, true}, {2, true}, {3, false}, {100, true}, {36, false}, {37, true}, {37, false}, {2, false},
+	} {
+		if got := w.accept(tc.n); got != tc.want {
+			t.Errorf("accept(%d): want %v; got %v", tc.n, tc.want, got)
+		}
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "zinc.key")
+	key, err := LoadKey(name)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	again, err := LoadKey(name)
+	if err != nil {
+		t.Fatalf("loading key: %v", err)
+	}
+	if !key.Equal(again) {
+		t.Fatalf("loaded key differs from generated key")
+	}
+	pub, err := DecodeKey(EncodeKey(key.Public().(ed25519.PublicKey)))
+	if err != nil || !pub.Equal(key.Public()) {
+		t.Fatalf("want public key to round trip; got %v, %v", pub, err)
+	}
+}
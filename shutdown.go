@@ -0,0 +1,149 @@
+package zinc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A peer is shut down in steps so the work it has taken on is not cut short.
+// It first stops taking on new work: packets that would start new work are
+// answered with a ShuttingDown error, while the packets of the transfers in
+// flight and the responses to the requests of the peer still get through.
+// Once the transfers are done and the handlers have returned, the peer stops
+// serving and closes its sockets. The transfers that are cut short are
+// checkpointed so they can be resumed.
+
+// server is the state of a running peer.
+type server struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// control is closed once the control socket is closed, it is nil when
+	// the peer has no control socket.
+	control chan struct{}
+
+	// down is set once the peer starts shutting down.
+	down int32
+
+	mu       sync.Mutex
+	shutdown bool
+	finished chan struct{}
+	err      error
+}
+
+func newServer(ctx context.Context, cancel context.CancelFunc) *server {
+	return &server{ctx: ctx, cancel: cancel, finished: make(chan struct{})}
+}
+
+func (s *server) stopping() bool {
+	return atomic.LoadInt32(&s.down) == 1
+}
+
+// Shutdown stops the peer gracefully. It stops taking on new work, waits for
+// the transfers in flight and the handlers that are running to finish, then
+// stops serving and closes the sockets of the peer. The peer stops anyway once
+// ctx is done, and the error of ctx is returned along with what was cut short.
+// Calling Shutdown again waits for the first call to finish and returns its
+// result.
+func (p *Peer) Shutdown(ctx context.Context) error {
+	srv := p.server
+	if srv == nil {
+		return ErrNotRunning
+	}
+	srv.mu.Lock()
+	first := !srv.shutdown
+	srv.shutdown = true
+	srv.mu.Unlock()
+	if first {
+		srv.err = p.shutdown(ctx, srv)
+		close(srv.finished)
+		return srv.err
+	}
+	select {
+	case <-srv.finished:
+		return srv.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Peer) shutdown(ctx context.Context, srv *server) error {
+	p.Logger().Info("shutting down")
+	atomic.StoreInt32(&srv.down, 1)
+	p.stop(false)
+
+	var err error
+	if err = p.transfers.drain(ctx); err != nil {
+		err = fmt.Errorf("%d transfers abandoned: %w", p.transfers.active(), err)
+	} else if err = p.workers.drain(ctx); err != nil {
+		err = fmt.Errorf("handlers cut short: %w", err)
+	}
+	p.checkpointTransfers()
+	srv.cancel()
+	if srv.control != nil {
+		select {
+		case <-srv.control:
+		case <-ctx.Done():
+		}
+	}
+	if cerr := p.closeSockets(); cerr != nil && err == nil {
+		err = cerr
+	}
+	p.Logger().Info("shut down")
+	return err
+}
+
+// closeSockets closes the sockets of the peer.
+func (p *Peer) closeSockets() error {
+	var err error
+	for _, conn := range []transport{p.sock.get(), p.lstn} {
+		if cerr := conn.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// finishesWork reports whether packets of type typ are still served while the
+// peer shuts down. They belong to transfers in flight, new offers are
+// rejected by their handler.
+func finishesWork(typ PacketType) bool {
+	switch typ {
+	case FileOffer, FileChunk, FileAck, FileComplete:
+		return true
+	}
+	return false
+}
+
+// refuse tells the sender of req that the peer is shutting down.
+func (p *Peer) refuse(req Packet) {
+	p.Logger().Debug("refusing packet, peer is shutting down", F("packet_type", req.Type()), F("remote_addr", req.Addr()))
+	if isTrouble(req.Type()) {
+		return
+	}
+	if err := p.Send(responseTo(req, Error, ShuttingDown.Data())); err != nil {
+		p.Logger().Error("sending error response failed", F("remote_addr", req.Addr()), F("error", err))
+	}
+}
+
+// drain waits until no packet is queued or being served, or ctx is done.
+func (w *workers) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for {
+		st := w.stats()
+		if st.Queued == 0 && st.Running == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
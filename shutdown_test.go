@@ -0,0 +1,79 @@
+package zinc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	server := startTestPeer(t, "server", func(p *Peer) {
+		p.HandleFunc(echoPacket, func(ctx context.Context, w ResponseWriter, packet Packet) {
+			<-release
+		})
+	})
+	if err := RandomPeer("idle").Shutdown(context.Background()); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("want ErrNotRunning shutting down a peer that never started; got %v", err)
+	}
+	client := startTestPeer(t, "client")
+	raddr := server.lstn.LocalAddr().(*net.UDPAddr)
+	client.Send(NewPacket(echoPacket, nil, raddr))
+	waitFor(t, "a packet to be served", func() bool { return server.WorkerStats().Running == 1 })
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- server.Shutdown(ctx)
+	}()
+	<-server.Done()
+
+	// no new work is taken on while the handler finishes
+	if resp := request(t, client, server, Ping, nil); resp.Type() != Error || string(resp.Data()) != string(ShuttingDown.Data()) {
+		t.Fatalf("want shutting down error; got %s %q", resp.Type(), resp.Data())
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown did not wait for the handler: %v", err)
+	default:
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := server.lstn.WriteToUDP([]byte{0}, raddr); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("want the socket closed; got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	cancelled := make(chan struct{})
+	server := startTestPeer(t, "server", func(p *Peer) {
+		p.HandleFunc(echoPacket, func(ctx context.Context, w ResponseWriter, packet Packet) {
+			<-ctx.Done()
+			close(cancelled)
+		})
+	})
+	client := startTestPeer(t, "client")
+	client.Send(NewPacket(echoPacket, nil, server.lstn.LocalAddr().(*net.UDPAddr)))
+	waitFor(t, "a packet to be served", func() bool { return server.WorkerStats().Running == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the shutdown cut short; got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("want the handler cancelled")
+	}
+	if again := server.Shutdown(context.Background()); again != err {
+		t.Fatalf("want the result of the first shutdown; got %v", again)
+	}
+}
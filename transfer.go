@@ -0,0 +1,1004 @@
+package zinc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A file is transferred in chunks small enough to fit in a single datagram
+// along the path to the receiver. The sender offers the file to the receiver
+// with a FileOffer packet and once the offer is accepted with a FileAck, the
+// hash blocks of the file and every chunk of it are sent as FileChunk packets.
+// Hash blocks are numbered after the chunks of the file. When the sender runs
+// out of chunks to send it sends a FileComplete packet, the receiver then
+// responds with a FileAck listing the chunks it is still missing or with a
+// FileAck saying it is done with the file. Chunks that don't match their hash
+// are dropped and so asked for again. The sender retransmits the missing
+// chunks until the receiver is done.
+
+const (
+	// fileChunkHeaderLen is the size of the transfer id and chunk index that
+	// prefix the data of every FileChunk packet.
+	fileChunkHeaderLen = 12
+
+	// defaultChunkSize is the largest chunk of a file that fits into a
+	// datagram of defaultMTU bytes, even when the datagram is sealed. It is
+	// used when the path mtu to the receiver can't be found.
+	defaultChunkSize = defaultMTU - packetHeaderLen - fileChunkHeaderLen - sealOverhead
+
+	// fileAckHeaderLen is the length of a FileAck without the indices of
+	// the missing chunks and the unapplied attributes: the transfer id, the
+	// status and the number of missing chunks.
+	fileAckHeaderLen = 11
+
+	// transferTimeout is how long a sender waits for a FileAck before it
+	// retransmits its last packet.
+	transferTimeout = time.Second
+
+	// transferRetries is the number of consecutive timeouts after which a
+	// sender gives up on a transfer.
+	transferRetries = 5
+
+	// transferLinger is how long the receiver remembers a finished transfer
+	// so it can answer retransmitted FileComplete packets.
+	transferLinger = 30 * time.Second
+
+	// transferIdle is how long a receiver waits to hear from the sender of
+	// a transfer before it gives up on the transfer.
+	transferIdle = 10 * time.Minute
+
+	// minChunkSize is the chunk size of a transfer over a path of minMTU
+	// bytes, offers of smaller chunks are rejected.
+	minChunkSize = minMTU - packetHeaderLen - fileChunkHeaderLen - sealOverhead
+
+	// DefaultMaxFileSize is the largest file a peer accepts when its
+	// MaxFileSize is zero.
+	DefaultMaxFileSize = 16 << 30
+
+	// drainPoll is how often a stopping peer checks if its transfers are
+	// done.
+	drainPoll = 50 * time.Millisecond
+)
+
+// ackStatus is the state of a transfer reported by a FileAck.
+type ackStatus uint8
+
+const (
+	ackAccepted ackStatus = iota
+	ackMissing
+	ackDone
+	ackRejected
+)
+
+var (
+	ErrTransferRejected  = errors.New("transfer rejected by peer")
+	ErrTransferTimeout   = errors.New("transfer timed out waiting for peer")
+	ErrTransferCancelled = errors.New("transfer cancelled")
+	ErrTransferCorrupt   = errors.New("recieved file does not match the merkle root of the sent file")
+)
+
+// TransferOptions changes how a file is sent to another peer.
+type TransferOptions struct {
+	// NoMetadata sends just the content of the file. The remote peer creates
+	// the file with its own defaults and symbolic links are followed.
+	NoMetadata bool
+}
+
+// TransferReport describes a transfer that went through.
+type TransferReport struct {
+	Name string
+	Size int64
+
+	// Unapplied lists the attributes of the file the remote peer could not
+	// set on its copy of the file, along with the reason why.
+	Unapplied []string
+}
+
+// fileOffer announces a file to the receiver. The merkle root of the chunks
+// of the file lets the receiver check every chunk and the file it puts
+// together.
+type fileOffer struct {
+	id        uint64
+	size      uint64
+	chunkSize uint32
+	root      merkleHash
+	name      string
+	meta      *FileMeta
+}
+
+func (o fileOffer) chunks() uint32 {
+	return uint32(o.chunks64())
+}
+
+func (o fileOffer) chunks64() uint64 {
+	if o.size == 0 {
+		return 0
+	}
+	n := o.size / uint64(o.chunkSize)
+	if o.size%uint64(o.chunkSize) != 0 {
+		n++
+	}
+	return n
+}
+
+// blockLeaves is the number of leaves in a hash block. It is the largest
+// power of two that fits in a chunk along with the longest proof a block of
+// the file can need.
+func (o fileOffer) blockLeaves() uint32 {
+	proof := bits.Len32(o.chunks()) * sha256.Size
+	k := uint32(1)
+	for int(2*k)*sha256.Size+proof <= int(o.chunkSize) {
+		k *= 2
+	}
+	return k
+}
+
+// hashBlocks is the number of hash blocks of the file.
+func (o fileOffer) hashBlocks() uint32 {
+	k := uint64(o.blockLeaves())
+	return uint32((uint64(o.chunks()) + k - 1) / k)
+}
+
+// pieces is the number of FileChunk packets it takes to send the file, its
+// chunks followed by its hash blocks.
+func (o fileOffer) pieces() uint32 {
+	return o.chunks() + o.hashBlocks()
+}
+
+// fileOfferLen is the size of the fixed fields of a marshaled offer.
+const fileOfferLen = 20 + sha256.Size + 2
+
+func (o fileOffer) marshal() []byte {
+	b := make([]byte, fileOfferLen+len(o.name)+1)
+	binary.BigEndian.PutUint64(b[0:], o.id)
+	binary.BigEndian.PutUint64(b[8:], o.size)
+	binary.BigEndian.PutUint32(b[16:], o.chunkSize)
+	copy(b[20:], o.root[:])
+	binary.BigEndian.PutUint16(b[fileOfferLen-2:], uint16(len(o.name)))
+	copy(b[fileOfferLen:], o.name)
+	if o.meta != nil {
+		b[fileOfferLen+len(o.name)] = 1
+		b = append(b, o.meta.marshal()...)
+	}
+	return b
+}
+
+func (o *fileOffer) unmarshal(b []byte) error {
+	if len(b) < fileOfferLen {
+		return ErrShortPacket
+	}
+	o.id = binary.BigEndian.Uint64(b[0:])
+	o.size = binary.BigEndian.Uint64(b[8:])
+	o.chunkSize = binary.BigEndian.Uint32(b[16:])
+	copy(o.root[:], b[20:])
+	n := int(binary.BigEndian.Uint16(b[fileOfferLen-2:]))
+	if len(b) < fileOfferLen+n+1 {
+		return ErrShortPacket
+	}
+	o.name = string(b[fileOfferLen : fileOfferLen+n])
+	if err := o.check(); err != nil {
+		return err
+	}
+	if b[fileOfferLen+n] == 1 {
+		o.meta = new(FileMeta)
+		return o.meta.unmarshal(b[fileOfferLen+n+1:])
+	}
+	return nil
+}
+
+// check reports offers whose chunks don't fit in a packet or can't be
+// numbered.
+func (o fileOffer) check() error {
+	if o.chunkSize < minChunkSize || o.chunkSize > maxPacketData-fileChunkHeaderLen {
+		return fmt.Errorf("invalid chunk size %d", o.chunkSize)
+	}
+	chunks := o.chunks64()
+	if chunks >= 1<<32 || chunks+uint64(o.hashBlocks()) >= 1<<32 {
+		return fmt.Errorf("%d byte file has too many chunks of %d bytes", o.size, o.chunkSize)
+	}
+	return nil
+}
+
+// fileChunk is a piece of the file at position index*chunkSize, or the hash
+// block index-chunks when index is past the chunks of the file. A hash block
+// holds its leaves followed by its proof.
+type fileChunk struct {
+	id    uint64
+	index uint32
+	data  []byte
+}
+
+func (c fileChunk) marshal() []byte {
+	b := make([]byte, fileChunkHeaderLen+len(c.data))
+	binary.BigEndian.PutUint64(b[0:], c.id)
+	binary.BigEndian.PutUint32(b[8:], c.index)
+	copy(b[fileChunkHeaderLen:], c.data)
+	return b
+}
+
+func (c *fileChunk) unmarshal(b []byte) error {
+	if len(b) < fileChunkHeaderLen {
+		return ErrShortPacket
+	}
+	c.id = binary.BigEndian.Uint64(b[0:])
+	c.index = binary.BigEndian.Uint32(b[8:])
+	c.data = b[fileChunkHeaderLen:]
+	return nil
+}
+
+// fileAck reports the state of a transfer to the sender.
+type fileAck struct {
+	id        uint64
+	status    ackStatus
+	missing   []uint32
+	unapplied []string
+}
+
+func (a fileAck) marshal() []byte {
+	b := make([]byte, fileAckHeaderLen+4*len(a.missing))
+	binary.BigEndian.PutUint64(b[0:], a.id)
+	b[8] = byte(a.status)
+	binary.BigEndian.PutUint16(b[9:], uint16(len(a.missing)))
+	for i, idx := range a.missing {
+		binary.BigEndian.PutUint32(b[fileAckHeaderLen+4*i:], idx)
+	}
+	if len(a.unapplied) == 0 {
+		return b
+	}
+	buf := bytes.NewBuffer(b)
+	binary.Write(buf, binary.BigEndian, uint16(len(a.unapplied)))
+	for _, attr := range a.unapplied {
+		writeString(buf, attr)
+	}
+	return buf.Bytes()
+}
+
+func (a *fileAck) unmarshal(b []byte) error {
+	if len(b) < fileAckHeaderLen {
+		return ErrShortPacket
+	}
+	a.id = binary.BigEndian.Uint64(b[0:])
+	a.status = ackStatus(b[8])
+	n := int(binary.BigEndian.Uint16(b[9:]))
+	if len(b) < fileAckHeaderLen+4*n {
+		return ErrShortPacket
+	}
+	a.missing = make([]uint32, n)
+	for i := range a.missing {
+		a.missing[i] = binary.BigEndian.Uint32(b[fileAckHeaderLen+4*i:])
+	}
+	if len(b) == fileAckHeaderLen+4*n {
+		return nil
+	}
+
+	r := bytes.NewReader(b[fileAckHeaderLen+4*n:])
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return ErrShortPacket
+	}
+	a.unapplied = make([]string, count)
+	for i := range a.unapplied {
+		var err error
+		if a.unapplied[i], err = readString(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileComplete tells the receiver that all chunks of a file have been sent.
+type fileComplete struct {
+	id uint64
+}
+
+func (c fileComplete) marshal() []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, c.id)
+	return b
+}
+
+func (c *fileComplete) unmarshal(b []byte) error {
+	if len(b) < 8 {
+		return ErrShortPacket
+	}
+	c.id = binary.BigEndian.Uint64(b)
+	return nil
+}
+
+// outgoing is the sending side of a transfer.
+type outgoing struct {
+	offer fileOffer
+	addr  *net.UDPAddr
+	acks  chan fileAck
+	tree  *merkleTree
+
+	// path is the absolute path of the file being sent.
+	path       string
+	noMetadata bool
+
+	// cancel stops the transfer, cancelled is set when it was stopped by
+	// CancelTransfer. transfers.mu guards cancelled.
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// incoming is the receiving side of a transfer.
+type incoming struct {
+	sync.Mutex
+	offer fileOffer
+	addr  *net.UDPAddr
+	file  *os.File
+	dest  string
+	have  []bool
+	done  bool
+
+	// leaves are the leaves of the merkle tree of the file, the leaves of
+	// a chunk are known once the chunk has its hash block.
+	leaves []merkleHash
+
+	// restored is set for transfers picked up from a checkpoint whose
+	// sender has not been heard from since, unsaved is the number of
+	// chunks recieved since the last checkpoint.
+	restored bool
+	unsaved  int
+
+	// seen is when the sender of the transfer was last heard from.
+	seen time.Time
+
+	// unapplied are the attributes of the file that could not be set, the
+	// owner of the file is only set when owner is.
+	unapplied []string
+	owner     bool
+}
+
+// missing returns the indices of at most max chunks that have not been
+// recieved yet, the hash blocks first.
+func (in *incoming) missing(max int) []uint32 {
+	var m []uint32
+	chunks := int(in.offer.chunks())
+	for j := range in.have {
+		// the hash blocks come after the chunks
+		i := (j + chunks) % len(in.have)
+		if !in.have[i] {
+			m = append(m, uint32(i))
+			if len(m) == max {
+				break
+			}
+		}
+	}
+	return m
+}
+
+// hasLeaf reports whether the leaf of chunk idx is known.
+func (in *incoming) hasLeaf(idx uint32) bool {
+	return in.have[in.offer.chunks()+idx/in.offer.blockLeaves()]
+}
+
+// addHashBlock checks the hash block idx against the merkle root and takes in
+// its leaves. The chunks of the block that are already on disk are checked
+// against their leaves, those that don't match are recieved again.
+func (in *incoming) addHashBlock(idx uint32, data []byte) error {
+	k, chunks := in.offer.blockLeaves(), in.offer.chunks()
+	lo := idx * k
+	hi := lo + k
+	if hi > chunks {
+		hi = chunks
+	}
+	n := int(hi-lo) * sha256.Size
+	if len(data) < n || (len(data)-n)%sha256.Size != 0 {
+		return fmt.Errorf("hash block of %d bytes for %d leaves", len(data), hi-lo)
+	}
+	leaves := make([]merkleHash, hi-lo)
+	for i := range leaves {
+		copy(leaves[i][:], data[i*sha256.Size:])
+	}
+	proof := make([]merkleHash, (len(data)-n)/sha256.Size)
+	for i := range proof {
+		copy(proof[i][:], data[n+i*sha256.Size:])
+	}
+	if !verifyProof(in.offer.root, newMerkleTree(leaves).root(), int(idx), int(in.offer.hashBlocks()), proof) {
+		return errors.New("hash block does not match the merkle root")
+	}
+	copy(in.leaves[lo:hi], leaves)
+	in.have[chunks+idx] = true
+
+	buf := make([]byte, in.offer.chunkSize)
+	for i := lo; i < hi; i++ {
+		if !in.have[i] {
+			continue
+		}
+		chunk := buf[:in.chunkLen(i)]
+		if _, err := in.file.ReadAt(chunk, int64(i)*int64(in.offer.chunkSize)); err != nil || leafHash(chunk) != in.leaves[i] {
+			in.have[i] = false
+		}
+	}
+	return nil
+}
+
+// chunkLen is the size of chunk idx of the file.
+func (in *incoming) chunkLen(idx uint32) int64 {
+	n := int64(in.offer.size) - int64(idx)*int64(in.offer.chunkSize)
+	if n > int64(in.offer.chunkSize) {
+		n = int64(in.offer.chunkSize)
+	}
+	return n
+}
+
+// transfers keeps track of the transfers a peer is taking part in.
+type transfers struct {
+	sync.Mutex
+	out map[uint64]*outgoing
+	in  map[uint64]*incoming
+
+	// interrupted are the checkpoints of the files that were being sent
+	// when the peer stopped or the receiver stopped responding.
+	interrupted map[uint64]*checkpoint
+
+	// dir is the directory the transfers are checkpointed in, transfers
+	// are not checkpointed when it is empty.
+	dir string
+
+	// draining is set when the peer is stopping, new offers are rejected.
+	draining bool
+
+	// idle is how long an incoming transfer waits for its sender.
+	idle time.Duration
+}
+
+func newTransfers() *transfers {
+	return &transfers{
+		out:         make(map[uint64]*outgoing),
+		in:          make(map[uint64]*incoming),
+		interrupted: make(map[uint64]*checkpoint),
+		idle:        transferIdle,
+	}
+}
+
+func (t *transfers) outgoing(id uint64) (*outgoing, bool) {
+	t.Lock()
+	defer t.Unlock()
+	o, ok := t.out[id]
+	return o, ok
+}
+
+func (t *transfers) incoming(id uint64) (*incoming, bool) {
+	t.Lock()
+	defer t.Unlock()
+	in, ok := t.in[id]
+	return in, ok
+}
+
+// SendFile transfers the file with the given name to the peer listening on
+// addr. The peer must have its server running to recieve the responses of the
+// remote peer. SendFile blocks until the remote peer has the whole file, the
+// remote peer stops responding or ctx is done. The metadata of the file is
+// sent along with it unless opts says otherwise, a nil opts uses the defaults.
+// Transfers that don't go through are resumed with ResumeTransfer when the
+// peer has a StateDir.
+func (p *Peer) SendFile(ctx context.Context, name string, addr *net.UDPAddr, opts *TransferOptions) (*TransferReport, error) {
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	file, offer, err := readOffer(path, opts.NoMetadata)
+	if err != nil {
+		return nil, err
+	}
+	if file != nil {
+		defer file.Close()
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("could not make transfer id: %w", err)
+	}
+	offer.id = binary.BigEndian.Uint64(id[:])
+	offer.chunkSize = uint32(defaultChunkSize)
+	if mtu, err := p.PathMTU(ctx, addr); err == nil {
+		offer.chunkSize = uint32(mtu - packetHeaderLen - fileChunkHeaderLen - sealOverhead)
+	} else if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else {
+		p.Logger().Warn("path mtu unknown, sending chunks of the default size", F("remote_addr", addr), F("error", err))
+	}
+	tree, err := hashChunks(file, offer.size, offer.chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	offer.root = tree.root()
+
+	out := &outgoing{
+		offer:      offer,
+		addr:       addr,
+		acks:       make(chan fileAck, 1),
+		tree:       tree,
+		path:       path,
+		noMetadata: opts.NoMetadata,
+	}
+	return p.runTransfer(ctx, out, file, false)
+}
+
+// readOffer opens the file at path and describes it in an offer without an
+// id, a chunk size or a merkle root. The file is nil for symbolic links sent
+// as links.
+func readOffer(path string, noMetadata bool) (*os.File, fileOffer, error) {
+	offer := fileOffer{name: filepath.Base(path)}
+	if !noMetadata {
+		var err error
+		if offer.meta, err = ReadFileMeta(path); err != nil {
+			return nil, offer, err
+		}
+		if offer.meta.Link != "" {
+			return nil, offer, nil
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, offer, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, offer, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, offer, fmt.Errorf("SendFile: %s is not a regular file", path)
+	}
+	offer.size = uint64(info.Size())
+	return file, offer, nil
+}
+
+// runTransfer sends the file of out to its receiver. The transfer is
+// checkpointed while it runs and the checkpoint is kept when the transfer does
+// not go through, so it can be resumed. A resumed transfer asks the receiver
+// for the chunks it is missing instead of sending them all.
+func (p *Peer) runTransfer(ctx context.Context, out *outgoing, file *os.File, resume bool) (*TransferReport, error) {
+	data := out.offer.marshal()
+	if len(data) > defaultMTU-packetHeaderLen {
+		return nil, fmt.Errorf("SendFile: offer for %s is too large (%d bytes), try sending without metadata", out.path, len(data))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	out.cancel = cancel
+	id := out.offer.id
+	p.transfers.Lock()
+	if _, ok := p.transfers.out[id]; ok {
+		p.transfers.Unlock()
+		return nil, fmt.Errorf("transfer %016x is already running", id)
+	}
+	p.transfers.out[id] = out
+	delete(p.transfers.interrupted, id)
+	p.transfers.Unlock()
+
+	cp := out.checkpoint()
+	if err := p.transfers.save(cp); err != nil {
+		p.Logger().Warn("checkpointing transfer failed", F("file", out.offer.name), F("error", err))
+	}
+	report, err := p.sendOffered(ctx, out, file, resume)
+
+	p.transfers.Lock()
+	delete(p.transfers.out, id)
+	cancelled := out.cancelled
+	if err != nil && !cancelled && !errors.Is(err, ErrTransferRejected) && p.transfers.dir != "" {
+		p.transfers.interrupted[id] = cp
+	} else {
+		p.transfers.remove(cp)
+	}
+	p.transfers.Unlock()
+	if cancelled {
+		return nil, ErrTransferCancelled
+	}
+	return report, err
+}
+
+// sendOffered offers the file of out to its receiver and sends it the chunks
+// it asks for until it has them all.
+func (p *Peer) sendOffered(ctx context.Context, out *outgoing, file *os.File, resume bool) (*TransferReport, error) {
+	addr := out.addr
+	offer := makeResponsePacket(FileOffer, out.offer.marshal(), addr)
+	ack, err := p.exchange(ctx, out, offer)
+	if err != nil {
+		return nil, err
+	}
+	if ack.status == ackRejected {
+		return nil, ErrTransferRejected
+	}
+
+	// the hash blocks go first so the receiver can check the chunks as
+	// they arrive.
+	var missing []uint32
+	if !resume {
+		chunks, pieces := out.offer.chunks(), out.offer.pieces()
+		for i := chunks; i < pieces; i++ {
+			missing = append(missing, i)
+		}
+		for i := uint32(0); i < chunks; i++ {
+			missing = append(missing, i)
+		}
+	}
+	complete := makeResponsePacket(FileComplete, fileComplete{out.offer.id}.marshal(), addr)
+	for {
+		if err := p.sendChunks(file, out, missing); err != nil {
+			return nil, err
+		}
+		ack, err := p.exchange(ctx, out, complete)
+		if err != nil {
+			return nil, err
+		}
+		switch ack.status {
+		case ackDone:
+			return &TransferReport{
+				Name:      out.offer.name,
+				Size:      int64(out.offer.size),
+				Unapplied: ack.unapplied,
+			}, nil
+		case ackRejected:
+			return nil, ErrTransferRejected
+		case ackMissing:
+			missing = ack.missing
+		}
+	}
+}
+
+// exchange sends packet and waits for the next FileAck of the transfer,
+// retransmitting the packet whenever the wait times out.
+func (p *Peer) exchange(ctx context.Context, out *outgoing, packet Packet) (fileAck, error) {
+	for i := 0; i < transferRetries; i++ {
+		if err := p.Send(packet); err != nil {
+			return fileAck{}, err
+		}
+		if ack, ok, err := out.wait(ctx, packet.Type() == FileOffer); ok || err != nil {
+			return ack, err
+		}
+	}
+	return fileAck{}, ErrTransferTimeout
+}
+
+// wait blocks until a FileAck arrives for the transfer or the wait times out.
+// Late acks for the offer carry no information about the chunks of the file
+// and are skipped unless offer is set.
+func (out *outgoing) wait(ctx context.Context, offer bool) (fileAck, bool, error) {
+	timer := time.NewTimer(transferTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case ack := <-out.acks:
+			if ack.status == ackAccepted && !offer {
+				continue
+			}
+			return ack, true, nil
+		case <-timer.C:
+			return fileAck{}, false, nil
+		case <-ctx.Done():
+			return fileAck{}, false, ctx.Err()
+		}
+	}
+}
+
+// sendChunks sends the chunks and hash blocks of out with the given indices
+// to its receiver, the chunks are read from file.
+func (p *Peer) sendChunks(file *os.File, out *outgoing, indices []uint32) error {
+	offer := out.offer
+	buf := make([]byte, offer.chunkSize)
+	for _, idx := range indices {
+		chunk := fileChunk{id: offer.id, index: idx}
+		switch {
+		case idx >= offer.pieces():
+			continue
+		case idx >= offer.chunks():
+			chunk.data = out.hashBlock(idx - offer.chunks())
+		default:
+			n, err := file.ReadAt(buf, int64(idx)*int64(offer.chunkSize))
+			if n == 0 && err != nil {
+				return fmt.Errorf("reading chunk %d: %w", idx, err)
+			}
+			chunk.data = buf[:n]
+		}
+		if err := p.Send(makeResponsePacket(FileChunk, chunk.marshal(), out.addr)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashBlock returns the leaves of hash block idx followed by their proof.
+func (out *outgoing) hashBlock(idx uint32) []byte {
+	k := out.offer.blockLeaves()
+	leaves := out.tree.levels[0][idx*k:]
+	if uint32(len(leaves)) > k {
+		leaves = leaves[:k]
+	}
+	proof := out.tree.proof(bits.TrailingZeros32(k), int(idx))
+	b := make([]byte, 0, (len(leaves)+len(proof))*sha256.Size)
+	for _, h := range append(leaves[:len(leaves):len(leaves)], proof...) {
+		b = append(b, h[:]...)
+	}
+	return b
+}
+
+// sendFileAck responds to the sender of a transfer.
+func (p *Peer) sendFileAck(ack fileAck, addr *net.UDPAddr) {
+	if err := p.Send(makeResponsePacket(FileAck, ack.marshal(), addr)); err != nil {
+		p.Logger().Error("failed to send file ack", F("remote_addr", addr), F("error", err))
+	}
+}
+
+// maxChunkSize is the largest chunk that reaches the peer from addr, as far
+// as the path mtu of addr is known.
+func (p *Peer) maxChunkSize(addr *net.UDPAddr) int {
+	p.paths.Lock()
+	df := p.paths.df
+	p.paths.Unlock()
+	if _, ok := p.paths.get(addr); ok && df {
+		return p.maxPayload(addr) - fileChunkHeaderLen
+	}
+	n := maxProbedMTU - packetHeaderLen - fileChunkHeaderLen
+	if p.secure != nil {
+		n -= sealOverhead
+	}
+	return n
+}
+
+// accept creates the receiving side of the transfer described by offer.
+// Offers of files larger than the MaxFileSize of the peer or of chunks that
+// don't fit the path from addr are rejected.
+func (p *Peer) accept(offer fileOffer, addr *net.UDPAddr) (*incoming, error) {
+	max := p.MaxFileSize
+	if max == 0 {
+		max = DefaultMaxFileSize
+	}
+	if offer.size > uint64(max) {
+		return nil, fmt.Errorf("%d byte file is larger than the %d bytes allowed", offer.size, max)
+	}
+	if n := p.maxChunkSize(addr); int(offer.chunkSize) > n {
+		return nil, fmt.Errorf("chunks of %d bytes exceed the %d bytes the path carries", offer.chunkSize, n)
+	}
+	name := filepath.Base(filepath.Clean("/" + offer.name))
+	if name == "/" || name == "." {
+		return nil, fmt.Errorf("invalid file name %q", offer.name)
+	}
+	dir := p.ReceiveDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "zinc")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, ".zinc-"+name+"-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(int64(offer.size)); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &incoming{
+		offer: offer,
+		addr:  addr,
+		file:  file,
+		dest:  filepath.Join(dir, name),
+		have:  make([]bool, offer.pieces()),
+		seen:  time.Now(),
+		owner: p.PreserveOwner,
+
+		leaves: make([]merkleHash, offer.chunks()),
+	}, nil
+}
+
+// finish checks the merkle root of the fully recieved file against the root
+// of the offer and moves the file into its destination. The metadata of the
+// file is applied before the file is moved so the file never shows up without
+// it.
+func (in *incoming) finish() error {
+	tree, err := hashChunks(in.file, in.offer.size, in.offer.chunkSize)
+	if err != nil {
+		in.abort()
+		return err
+	}
+	if tree.root() != in.offer.root {
+		in.abort()
+		return ErrTransferCorrupt
+	}
+	if err := in.file.Sync(); err != nil {
+		in.abort()
+		return err
+	}
+	if err := in.file.Close(); err != nil {
+		os.Remove(in.file.Name())
+		return err
+	}
+
+	tmp := in.file.Name()
+	if meta := in.offer.meta; meta != nil {
+		if meta.Link != "" {
+			os.Remove(tmp)
+			if err := os.Symlink(meta.Link, tmp); err != nil {
+				return err
+			}
+		}
+		in.unapplied = meta.Apply(tmp, in.owner)
+	}
+	if err := os.Rename(tmp, in.dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	in.done = true
+	return nil
+}
+
+// abort throws away the partially recieved file.
+func (in *incoming) abort() {
+	in.file.Close()
+	os.Remove(in.file.Name())
+}
+
+// TransferStatus describes a transfer in flight.
+type TransferStatus struct {
+	Id        uint64 `json:"id"`
+	Name      string `json:"name"`
+	Peer      string `json:"peer"`
+	Direction string `json:"direction"`
+	Size      uint64 `json:"size"`
+
+	// Recieved is the number of bytes recieved so far, it is only known
+	// for incoming transfers.
+	Recieved uint64 `json:"recieved,omitempty"`
+
+	// State is active for the transfers that are going on and interrupted
+	// for those waiting to be resumed.
+	State string `json:"state"`
+}
+
+// states of transfers.
+const (
+	transferActive      = "active"
+	transferInterrupted = "interrupted"
+)
+
+// status returns the transfers in flight.
+func (t *transfers) status() []TransferStatus {
+	t.Lock()
+	defer t.Unlock()
+	status := []TransferStatus{}
+	for _, out := range t.out {
+		status = append(status, TransferStatus{
+			Id:        out.offer.id,
+			Name:      out.offer.name,
+			Peer:      out.addr.String(),
+			Direction: "send",
+			Size:      out.offer.size,
+			State:     transferActive,
+		})
+	}
+	for _, cp := range t.interrupted {
+		status = append(status, TransferStatus{
+			Id:        cp.Id,
+			Name:      cp.Name,
+			Peer:      cp.Peer,
+			Direction: "send",
+			Size:      cp.Size,
+			State:     transferInterrupted,
+		})
+	}
+	for _, in := range t.in {
+		in.Lock()
+		if !in.done {
+			var got uint64
+			for _, ok := range in.have[:in.offer.chunks()] {
+				if ok {
+					got += uint64(in.offer.chunkSize)
+				}
+			}
+			if got > in.offer.size {
+				got = in.offer.size
+			}
+			state := transferActive
+			if in.restored {
+				state = transferInterrupted
+			}
+			status = append(status, TransferStatus{
+				Id:        in.offer.id,
+				Name:      in.offer.name,
+				Peer:      in.addr.String(),
+				Direction: "recieve",
+				Size:      in.offer.size,
+				Recieved:  got,
+				State:     state,
+			})
+		}
+		in.Unlock()
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Id < status[j].Id })
+	return status
+}
+
+// active returns the number of transfers in flight, the interrupted ones
+// left out.
+func (t *transfers) active() int {
+	var n int
+	for _, st := range t.status() {
+		if st.State == transferActive {
+			n++
+		}
+	}
+	return n
+}
+
+// drain stops new transfers from being accepted and waits for the transfers
+// in flight to finish or for ctx to be done.
+func (t *transfers) drain(ctx context.Context) error {
+	t.Lock()
+	t.draining = true
+	t.Unlock()
+
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for t.active() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// expireIdle aborts the incoming transfer in once its sender has not been
+// heard from for the idle time of the transfers, so the partial files of
+// senders that went away don't pile up.
+func (p *Peer) expireIdle(in *incoming, after time.Duration) {
+	t := p.transfers
+	time.AfterFunc(after, func() {
+		in.Lock()
+		left := t.idle - time.Since(in.seen)
+		expired := !in.done && left <= 0
+		if expired {
+			in.abort()
+			in.done = true
+			t.remove(in.checkpoint())
+		}
+		done := in.done
+		in.Unlock()
+
+		switch {
+		case expired:
+			t.Lock()
+			if t.in[in.offer.id] == in {
+				delete(t.in, in.offer.id)
+			}
+			t.Unlock()
+			p.Logger().Warn("gave up on idle transfer", F("file", in.offer.name), F("remote_addr", in.addr))
+		case !done:
+			p.expireIdle(in, left)
+		}
+	})
+}
+
+// forget removes a transfer from the table of incoming transfers after it has
+// lingered for a while.
+func (t *transfers) forget(id uint64) {
+	time.AfterFunc(transferLinger, func() {
+		t.Lock()
+		delete(t.in, id)
+		t.Unlock()
+	})
+}
@@ -0,0 +1,311 @@
+package zinc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// startTestPeer starts a peer listening on a random local port. The setup
+// functions are run on the peer before its server is started.
+func startTestPeer(t *testing.T, name string, setup ...func(*Peer)) *Peer {
+	t.Helper()
+	p := RandomPeer(name)
+	if p.lstn == nil {
+		t.Fatalf("could not start peer %s", name)
+	}
+	p.ReceiveDir = t.TempDir()
+	for _, f := range setup {
+		f(p)
+	}
+	cancel, err := p.StartServer()
+	if err != nil {
+		t.Fatalf("failed to start peer %s: %v", name, err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		p.lstn.Close()
+	})
+	return p
+}
+
+func TestSendFile(t *testing.T) {
+	sender := startTestPeer(t, "sender")
+	receiver := startTestPeer(t, "receiver")
+	raddr := receiver.lstn.LocalAddr().(*net.UDPAddr)
+
+	testCases := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "single-chunk", size: 100},
+		{name: "exact-chunks", size: 4 * defaultChunkSize},
+		{name: "many-chunks", size: 300*defaultChunkSize + 17},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			want := make([]byte, tc.size)
+			rand.Read(want)
+			name := filepath.Join(t.TempDir(), tc.name)
+			if err := os.WriteFile(name, want, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if _, err := sender.SendFile(ctx, name, raddr, nil); err != nil {
+				t.Fatalf("SendFile: %v", err)
+			}
+
+			got, err := os.ReadFile(filepath.Join(receiver.ReceiveDir, tc.name))
+			if err != nil {
+				t.Fatalf("reading recieved file: %v", err)
+			}
+			if !bytes.Equal(want, got) {
+				t.Fatalf("recieved file differs from sent file: want %d bytes; got %d bytes", len(want), len(got))
+			}
+		})
+	}
+}
+
+func TestSendFileMetadata(t *testing.T) {
+	sender := startTestPeer(t, "sender")
+	receiver := startTestPeer(t, "receiver")
+	raddr := receiver.lstn.LocalAddr().(*net.UDPAddr)
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "script.sh")
+	if err := os.WriteFile(name, []byte("#!/bin/sh\necho zinc\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2021, time.December, 25, 10, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("script.sh", link); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, n := range []string{name, link} {
+		if _, err := sender.SendFile(ctx, n, raddr, nil); err != nil {
+			t.Fatalf("SendFile(%s): %v", n, err)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(receiver.ReceiveDir, "script.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("want mode %v; got %v", os.FileMode(0750), info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("want mtime %v; got %v", mtime, info.ModTime())
+	}
+	target, err := os.Readlink(filepath.Join(receiver.ReceiveDir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "script.sh" {
+		t.Errorf("want link to %q; got %q", "script.sh", target)
+	}
+
+	// without metadata the link is followed and the file gets default state
+	if err := os.Remove(filepath.Join(receiver.ReceiveDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.SendFile(ctx, link, raddr, &TransferOptions{NoMetadata: true}); err != nil {
+		t.Fatalf("SendFile without metadata: %v", err)
+	}
+	info, err = os.Lstat(filepath.Join(receiver.ReceiveDir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() || info.ModTime().Equal(mtime) {
+		t.Errorf("want a regular file with a fresh mtime; got mode %v mtime %v", info.Mode(), info.ModTime())
+	}
+}
+
+func TestFileMetaMarshal(t *testing.T) {
+	want := &FileMeta{
+		Mode:       0640 | os.ModeSetgid,
+		Uid:        1000,
+		Gid:        100,
+		User:       "joe",
+		Group:      "users",
+		ModTime:    time.Unix(1643328000, 12),
+		AccessTime: time.Unix(1643328100, 0),
+		Link:       "../target",
+		Xattrs:     map[string][]byte{"user.zinc": []byte("yes"), "user.empty": {}},
+	}
+	got := new(FileMeta)
+	if err := got.unmarshal(want.marshal()); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("metadata mismatch (-want +got):\n%s", diff)
+	}
+	if err := got.unmarshal(want.marshal()[:30]); err == nil {
+		t.Fatalf("want error unmarshaling truncated metadata")
+	}
+}
+
+func TestFileMetaApply(t *testing.T) {
+	if os.Getuid() < 0 {
+		t.Skip("no file owners on this system")
+	}
+	name := filepath.Join(t.TempDir(), "suid")
+	if err := os.WriteFile(name, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	meta := &FileMeta{
+		Mode:   0755 | os.ModeSetuid | os.ModeSetgid,
+		Uid:    uint32(os.Getuid()),
+		Gid:    uint32(os.Getgid()),
+		Xattrs: map[string][]byte{"security.capability": {1}},
+	}
+	for _, tc := range []struct {
+		owner bool
+		want  os.FileMode
+	}{
+		{false, 0755},
+		{true, 0755 | os.ModeSetuid | os.ModeSetgid},
+	} {
+		skipped := false
+		for _, u := range meta.Apply(name, tc.owner) {
+			skipped = skipped || strings.Contains(u, "only user attributes")
+		}
+		if skipped == tc.owner {
+			t.Errorf("owner %v: want security.capability skipped %v", tc.owner, !tc.owner)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid); got != tc.want {
+			t.Errorf("owner %v: want mode %v; got %v", tc.owner, tc.want, got)
+		}
+	}
+}
+
+func TestFileAckMissing(t *testing.T) {
+	in := &incoming{have: make([]bool, 10)}
+	for i := range in.have {
+		in.have[i] = i%3 != 0
+	}
+	ack := fileAck{id: 7, status: ackMissing, missing: in.missing(3)}
+
+	var got fileAck
+	if err := got.unmarshal(ack.marshal()); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got.id != ack.id || got.status != ack.status {
+		t.Fatalf("want ack %+v; got %+v", ack, got)
+	}
+	want := []uint32{0, 3, 6}
+	if len(got.missing) != len(want) {
+		t.Fatalf("want missing %v; got %v", want, got.missing)
+	}
+	for i := range want {
+		if got.missing[i] != want[i] {
+			t.Fatalf("want missing %v; got %v", want, got.missing)
+		}
+	}
+}
+
+func TestFileOfferLimits(t *testing.T) {
+	for _, o := range []fileOffer{
+		{size: 100, chunkSize: minChunkSize - 1},
+		{size: 100, chunkSize: maxPacketData},
+		{size: 1<<63 + 1, chunkSize: minChunkSize},
+		{size: ^uint64(0), chunkSize: defaultChunkSize},
+	} {
+		var got fileOffer
+		if err := got.unmarshal(o.marshal()); err == nil {
+			t.Errorf("want offer of %d bytes in chunks of %d rejected", o.size, o.chunkSize)
+		}
+	}
+
+	sender := startTestPeer(t, "sender")
+	receiver := startTestPeer(t, "receiver", func(p *Peer) { p.MaxFileSize = 1000 })
+	raddr := receiver.lstn.LocalAddr().(*net.UDPAddr)
+	name := filepath.Join(t.TempDir(), "big")
+	if err := os.WriteFile(name, make([]byte, 1001), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := sender.SendFile(ctx, name, raddr, nil); !errors.Is(err, ErrTransferRejected) {
+		t.Fatalf("want a file over the limit rejected; got %v", err)
+	}
+	if _, err := receiver.accept(fileOffer{size: 10, chunkSize: 60000, name: "f"}, raddr); err == nil {
+		t.Fatal("want chunks larger than the path rejected")
+	}
+}
+
+func TestTransferOtherSender(t *testing.T) {
+	p := RandomPeer("receiver")
+	defer p.lstn.Close()
+	p.ReceiveDir = t.TempDir()
+	sender := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	intruder := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+
+	data := []byte("the real data")
+	tree, err := hashChunks(bytes.NewReader(data), uint64(len(data)), defaultChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := fileOffer{id: 7, size: uint64(len(data)), chunkSize: defaultChunkSize, root: tree.root(), name: "file"}
+	ctx := context.Background()
+	p.fileOfferHandler(ctx, nil, NewPacket(FileOffer, offer.marshal(), sender))
+	in, ok := p.transfers.incoming(offer.id)
+	if !ok {
+		t.Fatal("offer was not accepted")
+	}
+
+	// packets of the transfer from anyone but the sender are ignored
+	p.fileOfferHandler(ctx, nil, NewPacket(FileOffer, offer.marshal(), intruder))
+	chunk := fileChunk{id: offer.id, index: 0, data: []byte("forged stuff!")}
+	p.fileChunkHandler(ctx, nil, NewPacket(FileChunk, chunk.marshal(), intruder))
+	p.fileCompleteHandler(ctx, nil, NewPacket(FileComplete, fileComplete{offer.id}.marshal(), intruder))
+	in.Lock()
+	defer in.Unlock()
+	if in.have[0] || in.done || !sameAddr(in.addr, sender) {
+		t.Fatalf("transfer was touched by another peer")
+	}
+}
+
+func TestTransferIdle(t *testing.T) {
+	p := RandomPeer("receiver")
+	defer p.lstn.Close()
+	p.ReceiveDir = t.TempDir()
+	p.transfers.idle = 50 * time.Millisecond
+	sender := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	offer := fileOffer{id: 7, size: 100, chunkSize: defaultChunkSize, name: "file"}
+	p.fileOfferHandler(context.Background(), nil, NewPacket(FileOffer, offer.marshal(), sender))
+	if _, ok := p.transfers.incoming(offer.id); !ok {
+		t.Fatal("offer was not accepted")
+	}
+	waitFor(t, "the idle transfer to be dropped", func() bool {
+		_, ok := p.transfers.incoming(offer.id)
+		return !ok
+	})
+	if entries, _ := os.ReadDir(p.ReceiveDir); len(entries) != 0 {
+		t.Fatalf("want the partial file removed; got %d files", len(entries))
+	}
+}
@@ -0,0 +1,181 @@
+package zinc
+
+import (
+	"context"
+	"sync"
+)
+
+// The packets a peer receives are served by a fixed number of workers that
+// take them off a bounded queue. A packet that arrives while the queue is full,
+// or while as many packets of its type as its type is allowed are queued or
+// being served, is dropped and its sender gets a Busy packet back so it can
+// try again later.
+
+const (
+	// DefaultWorkers is the number of packets a peer serves at a time
+	// unless it is told otherwise.
+	DefaultWorkers = 16
+
+	// DefaultQueueSize is the number of packets that wait for a worker
+	// unless the peer is told otherwise.
+	DefaultQueueSize = 256
+)
+
+// WorkerStats are the counters of the workers of a peer.
+type WorkerStats struct {
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queue_size"`
+
+	// Queued is the number of packets waiting for a worker and Running the
+	// number of packets being served.
+	Queued  int `json:"queued"`
+	Running int `json:"running"`
+
+	Served  uint64 `json:"served"`
+	Dropped uint64 `json:"dropped"`
+
+	// DroppedByType is the number of packets of each type that were
+	// dropped.
+	DroppedByType map[string]uint64 `json:"dropped_by_type,omitempty"`
+}
+
+// workers hands the packets of a peer to the goroutines serving them.
+type workers struct {
+	sync.Mutex
+	queue   chan Packet
+	size    int
+	running int
+	served  uint64
+
+	// limits is the number of packets of a type that can be queued or
+	// served at a time, inflight the number of them that are.
+	limits   map[PacketType]int
+	inflight map[PacketType]int
+	dropped  map[PacketType]uint64
+}
+
+func newWorkers() *workers {
+	return &workers{
+		limits:   make(map[PacketType]int),
+		inflight: make(map[PacketType]int),
+		dropped:  make(map[PacketType]uint64),
+	}
+}
+
+// SetConcurrency limits the packets of type typ that are queued or served at a
+// time to n, the packets over the limit are dropped. A limit of zero or less
+// removes the limit.
+func (p *Peer) SetConcurrency(typ PacketType, n int) {
+	p.workers.Lock()
+	defer p.workers.Unlock()
+	if n <= 0 {
+		delete(p.workers.limits, typ)
+		return
+	}
+	p.workers.limits[typ] = n
+}
+
+// WorkerStats returns the counters of the workers of the peer.
+func (p *Peer) WorkerStats() WorkerStats {
+	return p.workers.stats()
+}
+
+// startWorkers starts the workers of the peer, they stop when ctx is done.
+func (p *Peer) startWorkers(ctx context.Context) {
+	n, size := p.Workers, p.QueueSize
+	if n <= 0 {
+		n = DefaultWorkers
+	}
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	w := p.workers
+	w.Lock()
+	w.queue, w.size = make(chan Packet, size), n
+	w.running = 0
+	w.inflight = make(map[PacketType]int)
+	queue := w.queue
+	w.Unlock()
+
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case req := <-queue:
+					w.begin()
+					p.serve(ctx, req)
+					w.end(req.Type())
+				}
+			}
+		}()
+	}
+}
+
+// submit queues req for a worker. It reports whether there was room for req.
+func (w *workers) submit(req Packet) bool {
+	w.Lock()
+	defer w.Unlock()
+	typ := req.Type()
+	if limit, ok := w.limits[typ]; ok && w.inflight[typ] >= limit {
+		w.dropped[typ]++
+		return false
+	}
+	select {
+	case w.queue <- req:
+		w.inflight[typ]++
+		return true
+	default:
+		w.dropped[typ]++
+		return false
+	}
+}
+
+func (w *workers) begin() {
+	w.Lock()
+	w.running++
+	w.Unlock()
+}
+
+func (w *workers) end(typ PacketType) {
+	w.Lock()
+	w.running--
+	w.served++
+	// the counts start over when the peer is started again.
+	if w.inflight[typ] > 0 {
+		w.inflight[typ]--
+	}
+	w.Unlock()
+}
+
+func (w *workers) stats() WorkerStats {
+	w.Lock()
+	defer w.Unlock()
+	st := WorkerStats{
+		Workers:   w.size,
+		QueueSize: cap(w.queue),
+		Queued:    len(w.queue),
+		Running:   w.running,
+		Served:    w.served,
+	}
+	for typ, n := range w.dropped {
+		if st.DroppedByType == nil {
+			st.DroppedByType = make(map[string]uint64)
+		}
+		st.DroppedByType[typ.String()] = n
+		st.Dropped += n
+	}
+	return st
+}
+
+// busy tells the sender of req that it was dropped.
+func (p *Peer) busy(req Packet) {
+	p.Logger().Debug("dropping packet, peer is busy", F("packet_type", req.Type()), F("remote_addr", req.Addr()))
+	if isTrouble(req.Type()) {
+		return
+	}
+	if err := p.Send(responseTo(req, Busy, nil)); err != nil {
+		p.Logger().Error("sending busy response failed", F("remote_addr", req.Addr()), F("error", err))
+	}
+}
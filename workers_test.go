@@ -0,0 +1,58 @@
+package zinc
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestWorkersBusy(t *testing.T) {
+	release := make(chan struct{})
+	block := func(ctx context.Context, w ResponseWriter, packet Packet) {
+		<-release
+	}
+	server := startTestPeer(t, "server", func(p *Peer) {
+		p.Workers, p.QueueSize = 1, 1
+		p.HandleFunc(echoPacket, block)
+	})
+	client := startTestPeer(t, "client")
+	raddr := server.lstn.LocalAddr().(*net.UDPAddr)
+
+	// one packet is served and one waits, the next finds no room
+	client.Send(NewPacket(echoPacket, nil, raddr))
+	waitFor(t, "a packet to be served", func() bool { return server.WorkerStats().Running == 1 })
+	client.Send(NewPacket(echoPacket, nil, raddr))
+	waitFor(t, "a packet to be queued", func() bool { return server.WorkerStats().Queued == 1 })
+	if resp := request(t, client, server, echoPacket, nil); resp.Type() != Busy {
+		t.Fatalf("want %s; got %s", Busy, resp.Type())
+	}
+
+	close(release)
+	waitFor(t, "the packets to be served", func() bool { return server.WorkerStats().Served == 2 })
+	st := server.WorkerStats()
+	if st.Workers != 1 || st.QueueSize != 1 || st.Dropped != 1 || st.DroppedByType[echoPacket.String()] != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestWorkersConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	server := startTestPeer(t, "server", func(p *Peer) {
+		p.HandleFunc(echoPacket, func(ctx context.Context, w ResponseWriter, packet Packet) {
+			<-release
+		})
+		p.SetConcurrency(echoPacket, 1)
+	})
+	client := startTestPeer(t, "client")
+
+	client.Send(NewPacket(echoPacket, nil, server.lstn.LocalAddr().(*net.UDPAddr)))
+	waitFor(t, "a packet to be served", func() bool { return server.WorkerStats().Running == 1 })
+	if resp := request(t, client, server, echoPacket, nil); resp.Type() != Busy {
+		t.Fatalf("want %s over the limit; got %s", Busy, resp.Type())
+	}
+	// the other types have workers to spare
+	if resp := request(t, client, server, Ping, nil); resp.Type() != PeerInfo {
+		t.Fatalf("want %s; got %s", PeerInfo, resp.Type())
+	}
+}